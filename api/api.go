@@ -2,12 +2,10 @@ package api
 
 import (
 	"net/url"
-)
+	"time"
 
-var platformNameMap = map[string]string{
-	"live.bilibili.com": "哔哩哔哩",
-	"www.youtube.com":   "YouTube",
-}
+	"github.com/lintmx/dd-recorder/utils"
+)
 
 // LiveAPI interface
 type LiveAPI interface {
@@ -18,12 +16,14 @@ type LiveAPI interface {
 	GetTitle() string
 	GetAuthor() string
 	GetLiveID() string
+	GetRoomID() string
 	GetStreamURLs() ([]StreamURL, error)
 	GetDanmaku(chan struct{}) (<-chan *DanmakuMessage, error)
 }
 
 // BaseAPI live info
 type BaseAPI struct {
+	platform   *Platform
 	liveURL    *url.URL
 	liveID     string
 	liveTitle  string
@@ -31,18 +31,88 @@ type BaseAPI struct {
 	liveStatus bool
 }
 
+// stream protocol
+const (
+	ProtocolHLS = "hls"
+	ProtocolFLV = "http-flv"
+)
+
 // StreamURL store stream info
 type StreamURL struct {
 	PlayURL  url.URL
 	FileType string
+	Protocol string
+	// Quality is platform defined, higher is better, 0 if unknown
+	Quality     int64
+	QualityName string
+}
+
+// danmakuRetryInterval is the wait before the danmaku is connected again
+const danmakuRetryInterval = 3 * time.Second
+
+// sleepWithDone sleep d and return true, false if done is closed first
+func sleepWithDone(d time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// DanmakuType is the type of danmaku message
+type DanmakuType uint8
+
+// danmaku message type
+const (
+	DanmakuTypeChat DanmakuType = iota + 1
+	DanmakuTypeGift
+	DanmakuTypeSuperChat
+	DanmakuTypeGuard
+	DanmakuTypeEnter
+	DanmakuTypeRoomChange
+	DanmakuTypeLiveStart
+	DanmakuTypeLiveEnd
+)
+
+var danmakuTypeNames = map[DanmakuType]string{
+	DanmakuTypeChat:       "chat",
+	DanmakuTypeGift:       "gift",
+	DanmakuTypeSuperChat:  "super_chat",
+	DanmakuTypeGuard:      "guard",
+	DanmakuTypeEnter:      "enter",
+	DanmakuTypeRoomChange: "room_change",
+	DanmakuTypeLiveStart:  "live_start",
+	DanmakuTypeLiveEnd:    "live_end",
+}
+
+// String return the name of type
+func (t DanmakuType) String() string {
+	if name, ok := danmakuTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
 }
 
 // DanmakuMessage store danmaku msg
 type DanmakuMessage struct {
 	Content  string
-	SendTime int64
-	Type     uint8
+	SendTime int64 // unix millisecond
+	Type     DanmakuType
 	UserName string
+	UserID   string
+	// paid message, Price is in Currency
+	Price    float64
+	Currency string
+	// gift and guard
+	GiftID    string
+	GiftName  string
+	GiftCount int64
+	// guard level or super chat duration in seconds
+	Level int64
 }
 
 // GetLiveURL get live url
@@ -57,7 +127,10 @@ func (b *BaseAPI) GetLiveStatus() bool {
 
 // GetPlatformName return a name for live platform
 func (b *BaseAPI) GetPlatformName() string {
-	return platformNameMap[b.liveURL.Host]
+	if b.platform == nil {
+		return ""
+	}
+	return b.platform.Name
 }
 
 // GetTitle return live title
@@ -75,19 +148,47 @@ func (b *BaseAPI) GetLiveID() string {
 	return b.liveID
 }
 
-// Check select api
+// GetRoomID return the room id of platform, same as live id by default
+func (b *BaseAPI) GetRoomID() string {
+	return b.liveID
+}
+
+// SetLiveID set live id, used by platform implementations
+func (b *BaseAPI) SetLiveID(id string) {
+	b.liveID = id
+}
+
+// SetLiveStatus set live status, used by platform implementations
+func (b *BaseAPI) SetLiveStatus(status bool) {
+	b.liveStatus = status
+}
+
+// SetTitle set live title, used by platform implementations
+func (b *BaseAPI) SetTitle(title string) {
+	b.liveTitle = title
+}
+
+// SetAuthor set live author, used by platform implementations
+func (b *BaseAPI) SetAuthor(author string) {
+	b.liveAuthor = author
+}
+
+// Check select api from registered platforms
 func Check(url *url.URL) LiveAPI {
-	base := &BaseAPI{
-		liveURL: url,
+	platform := Match(url)
+	if platform == nil {
+		return nil
 	}
 
-	// switch live api
-	switch url.Host {
-	case "www.youtube.com":
-		return NewYouTubeLive(base)
-	case "live.bilibili.com":
-		return NewBilibiliLive(base)
+	base := &BaseAPI{
+		platform: platform,
+		liveURL:  url,
 	}
 
-	return nil
+	return platform.New(base)
+}
+
+// MetricLabels return labels of room metrics, the monitor id, platform and author
+func MetricLabels(live LiveAPI) []string {
+	return []string{utils.BKDRHash64(live.GetLiveURL()), live.GetPlatformName(), live.GetAuthor()}
 }
@@ -9,9 +9,21 @@ import (
 
 const testURL = "https://live.bilibili.com/14917277"
 
+// testLiveAPI return the api of testURL, the test is skipped in short mode or without network
+func testLiveAPI(t *testing.T) LiveAPI {
+	if testing.Short() {
+		t.Skip("network test skipped in short mode")
+	}
+	u, _ := url.Parse(testURL)
+	api := Check(u)
+	if api == nil {
+		t.Skip("live api not available")
+	}
+	return api
+}
+
 func TestRefreshLiveInfo(t *testing.T) {
-	url, _ := url.Parse(testURL)
-	api := Check(url)
+	api := testLiveAPI(t)
 
 	if err := api.RefreshLiveInfo(); err == nil {
 		t.Logf("Success!\n\nStatus: %t\nAuthor: %s\nTitle: %s\nID: %s", api.GetLiveStatus(), api.GetAuthor(), api.GetTitle(), api.GetLiveID())
@@ -22,8 +34,7 @@ func TestRefreshLiveInfo(t *testing.T) {
 }
 
 func TestGetStreamURLs(t *testing.T) {
-	url, _ := url.Parse(testURL)
-	api := Check(url)
+	api := testLiveAPI(t)
 
 	if urls, err := api.GetStreamURLs(); err == nil {
 		t.Log("Success")
@@ -2,15 +2,23 @@ package api
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"github.com/gorilla/websocket"
+	"github.com/lintmx/dd-recorder/metrics"
 	"github.com/lintmx/dd-recorder/utils"
 	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,25 +29,59 @@ const (
 	SequenceID  = 1
 )
 
+// websocket body protocol version
+const (
+	ProtocolVerJSON   = 0
+	ProtocolVerInt    = 1
+	ProtocolVerZlib   = 2
+	ProtocolVerBrotli = 3
+)
+
 // websocket operation protocol
 const (
-	OperationTypeHeart   = 2
-	OperationTypeMessage = 5
-	OperationTypeEnter   = 7
+	OperationTypeHeart      = 2
+	OperationTypeHeartReply = 3
+	OperationTypeMessage    = 5
+	OperationTypeEnter      = 7
+	OperationTypeEnterReply = 8
 )
 
 var (
 	bilibiliRealRoomIDAPI = "https://api.live.bilibili.com/room/v1/Room/room_init?id=%s"
 	bilibiliRoomInfoAPI   = "https://api.live.bilibili.com/room/v1/Room/get_info?room_id=%d"
 	bilibiliRoomAnchorAPI = "https://api.live.bilibili.com/live_user/v1/UserInfo/get_anchor_in_room?roomid=%d"
-	bilibiliPlayURLAPI    = "https://api.live.bilibili.com/room/v1/Room/playUrl?cid=%d&quality=4" // TODO: 暂时解决逼站画质问题，最好应该在获取 URL 那里解析 json 做判断
+	bilibiliPlayURLAPI    = "https://api.live.bilibili.com/room/v1/Room/playUrl?cid=%d&qn=%d&platform=web"
 	bilibiliDanmakuAPI    = "https://api.live.bilibili.com/room/v1/Danmu/getConf?room_id=%d&platform=pc&player=web"
 )
 
+var bilibiliURLRegex = regexp.MustCompile(`^(?:https?:\/\/)?live\.bilibili\.com\/(\d+)[\/\?\#]?.*$`)
+
+func init() {
+	Register(&Platform{
+		Name:    "哔哩哔哩",
+		Hosts:   []string{"live.bilibili.com"},
+		Pattern: bilibiliURLRegex,
+		New: func(base *BaseAPI) LiveAPI {
+			if live := NewBilibiliLive(base); live != nil {
+				return live
+			}
+			return nil
+		},
+	})
+}
+
 // BilibiliLive bilibili live api
 type BilibiliLive struct {
 	BaseAPI
-	roomID int64
+	roomID     int64
+	popularity uint32
+}
+
+// danmakuPacket is a packet of bilibili websocket
+type danmakuPacket struct {
+	ProtocolVer uint16
+	Operation   uint32
+	Body        []byte
 }
 
 type danmakuInitMsg struct {
@@ -55,8 +97,7 @@ func NewBilibiliLive(base *BaseAPI) *BilibiliLive {
 	bilibiliLive := BilibiliLive{
 		BaseAPI: *base,
 	}
-	regexURL := regexp.MustCompile(`^(?:https?:\/\/)?live\.bilibili\.com\/(\d+)[\/\?\#]?.*$`)
-	if result := regexURL.FindStringSubmatch(bilibiliLive.GetLiveURL()); result != nil {
+	if result := bilibiliURLRegex.FindStringSubmatch(bilibiliLive.GetLiveURL()); result != nil {
 		bilibiliLive.liveID = result[1]
 		if err := bilibiliLive.RefreshLiveInfo(); err != nil {
 			zap.L().Error("Init Live API", zap.String("url", bilibiliLive.GetLiveURL()))
@@ -69,15 +110,37 @@ func NewBilibiliLive(base *BaseAPI) *BilibiliLive {
 	return nil
 }
 
-func (b *BilibiliLive) getRealRoomID() error {
-	body, err := utils.HTTPGet(fmt.Sprintf(bilibiliRealRoomIDAPI, b.liveID))
+// GetRoomID return the real room id, live id may be a short id
+func (b *BilibiliLive) GetRoomID() string {
+	if b.roomID == 0 {
+		return b.liveID
+	}
+	return strconv.FormatInt(b.roomID, 10)
+}
+
+// get request an api returning code and msg, errors are counted by endpoint
+func (b *BilibiliLive) get(endpoint, apiURL string) (string, error) {
+	body, err := utils.HTTPGet(apiURL)
 
 	if err != nil {
-		return fmt.Errorf("Http Error - bilibiliRealRoomIDAPI - %s", err.Error())
+		err = fmt.Errorf("Http Error - %s - %s", endpoint, err.Error())
 	} else if code := gjson.Get(body, "code"); !code.Exists() {
-		return fmt.Errorf("bilibiliRealRoomIDAPI is broken")
+		err = fmt.Errorf("%s is broken", endpoint)
 	} else if code.Int() != 0 {
-		return fmt.Errorf("bilibiliRealRoomIDAPI - %s", gjson.Get(body, "msg").String())
+		err = fmt.Errorf("%s - %s", endpoint, gjson.Get(body, "msg").String())
+	}
+
+	if err != nil {
+		metrics.APIErrors.Inc(b.GetPlatformName(), endpoint)
+		return "", err
+	}
+	return body, nil
+}
+
+func (b *BilibiliLive) getRealRoomID() error {
+	body, err := b.get("bilibiliRealRoomIDAPI", fmt.Sprintf(bilibiliRealRoomIDAPI, b.liveID))
+	if err != nil {
+		return err
 	}
 
 	b.roomID = gjson.Get(body, "data.room_id").Int()
@@ -94,14 +157,9 @@ func (b *BilibiliLive) RefreshLiveInfo() error {
 	}
 
 	// get live title and live status
-	body, err := utils.HTTPGet(fmt.Sprintf(bilibiliRoomInfoAPI, b.roomID))
-
+	body, err := b.get("bilibiliRoomInfoAPI", fmt.Sprintf(bilibiliRoomInfoAPI, b.roomID))
 	if err != nil {
-		return fmt.Errorf("Http Error - bilibiliRoomInfoAPI - %s", err.Error())
-	} else if code := gjson.Get(body, "code"); !code.Exists() {
-		return fmt.Errorf("bilibiliRoomInfoAPI is broken")
-	} else if code.Int() != 0 {
-		return fmt.Errorf("bilibiliRoomInfoAPI - %s", gjson.Get(body, "msg").String())
+		return err
 	}
 
 	status := gjson.Get(body, "data.live_status").Int() == 1
@@ -110,14 +168,9 @@ func (b *BilibiliLive) RefreshLiveInfo() error {
 	b.liveTitle = gjson.Get(body, "data.title").String()
 
 	// get live author
-	body, err = utils.HTTPGet(fmt.Sprintf(bilibiliRoomAnchorAPI, b.roomID))
-
+	body, err = b.get("bilibiliRoomAnchorAPI", fmt.Sprintf(bilibiliRoomAnchorAPI, b.roomID))
 	if err != nil {
-		return fmt.Errorf("Http Error - bilibiliRoomAnchorAPI - %s", err.Error())
-	} else if code := gjson.Get(body, "code"); !code.Exists() {
-		return fmt.Errorf("bilibiliRoomAnchorAPI is broken")
-	} else if code.Int() != 0 {
-		return fmt.Errorf("bilibiliRoomAnchorAPI - %s", gjson.Get(body, "msg").String())
+		return err
 	}
 
 	b.liveAuthor = gjson.Get(body, "data.info.uname").String()
@@ -125,7 +178,7 @@ func (b *BilibiliLive) RefreshLiveInfo() error {
 	return nil
 }
 
-// GetStreamURLs return live stream url map
+// GetStreamURLs return stream urls of every quality and cdn line
 func (b *BilibiliLive) GetStreamURLs() ([]StreamURL, error) {
 	streamURLs := []StreamURL{}
 	if b.roomID == 0 {
@@ -134,35 +187,74 @@ func (b *BilibiliLive) GetStreamURLs() ([]StreamURL, error) {
 		}
 	}
 
-	// get live title and live status
-	body, err := utils.HTTPGet(fmt.Sprintf(bilibiliPlayURLAPI, b.roomID))
+	// query the available qualities
+	data, err := b.getPlayURL(0)
+	if err != nil {
+		return streamURLs, err
+	}
+
+	qualities := data.Get("quality_description").Array()
+	if len(qualities) == 0 {
+		return append(streamURLs, parseBilibiliDurl(data, data.Get("current_qn").Int(), "")...), nil
+	}
+
+	for _, quality := range qualities {
+		qn := quality.Get("qn").Int()
+		qnData := data
+
+		if qn != data.Get("current_qn").Int() {
+			if qnData, err = b.getPlayURL(qn); err != nil {
+				zap.L().Debug("Get Bilibili Play Url",
+					zap.Int64("Qn", qn),
+					zap.String("Err", err.Error()),
+				)
+				continue
+			}
+		}
+
+		streamURLs = append(streamURLs, parseBilibiliDurl(qnData, qn, quality.Get("desc").String())...)
+	}
+
+	if len(streamURLs) == 0 {
+		return streamURLs, fmt.Errorf("bilibiliPlayURLAPI return no stream")
+	}
 
+	return streamURLs, nil
+}
+
+// getPlayURL return data of play url api, qn 0 for default quality
+func (b *BilibiliLive) getPlayURL(qn int64) (gjson.Result, error) {
+	body, err := b.get("bilibiliPlayURLAPI", fmt.Sprintf(bilibiliPlayURLAPI, b.roomID, qn))
 	if err != nil {
-		return streamURLs, fmt.Errorf("Http Error - bilibiliPlayURLAPI - %s", err.Error())
-	} else if code := gjson.Get(body, "code"); !code.Exists() {
-		return streamURLs, fmt.Errorf("bilibiliPlayURLAPI is broken")
-	} else if code.Int() != 0 {
-		return streamURLs, fmt.Errorf("bilibiliPlayURLAPI - %s", gjson.Get(body, "msg").String())
+		return gjson.Result{}, err
 	}
 
-	gjson.Get(body, "data.durl.#.url").ForEach(func(key, value gjson.Result) bool {
+	return gjson.Get(body, "data"), nil
+}
+
+// parseBilibiliDurl return a StreamURL for each cdn line
+func parseBilibiliDurl(data gjson.Result, qn int64, desc string) []StreamURL {
+	streamURLs := []StreamURL{}
+
+	data.Get("durl.#.url").ForEach(func(key, value gjson.Result) bool {
 		liveURL, err := url.Parse(value.String())
 
 		if err != nil {
 			return true
 		}
 
-		streamURL := StreamURL{
-			PlayURL:  *liveURL,
-			FileType: "ts",
-		}
-
-		streamURLs = append(streamURLs, streamURL)
+		streamURLs = append(streamURLs, StreamURL{
+			PlayURL:     *liveURL,
+			FileType:    "flv",
+			Protocol:    ProtocolFLV,
+			Quality:     qn,
+			QualityName: desc,
+		})
 
 		return true
 	})
 
-	return streamURLs, nil
+	return streamURLs
 }
 
 // GetDanmaku push danmaku in chan
@@ -170,25 +262,27 @@ func (b *BilibiliLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, e
 	msgChan := make(chan *DanmakuMessage)
 
 	go func() {
+		defer close(msgChan)
 		// heart packet
 		heartTicker := time.NewTicker(30 * time.Second)
 		defer heartTicker.Stop()
 		for {
-			DanmakuRestart:
+		DanmakuRestart:
 			if b.roomID == 0 {
 				if err := b.getRealRoomID(); err != nil {
+					if !sleepWithDone(danmakuRetryInterval, done) {
+						return
+					}
 					continue
 				}
 			}
 
 			// get danmaku url
-			body, err := utils.HTTPGet(fmt.Sprintf(bilibiliDanmakuAPI, b.roomID))
-
+			body, err := b.get("bilibiliDanmakuAPI", fmt.Sprintf(bilibiliDanmakuAPI, b.roomID))
 			if err != nil {
-				continue
-			} else if code := gjson.Get(body, "code"); !code.Exists() {
-				continue
-			} else if code.Int() != 0 {
+				if !sleepWithDone(danmakuRetryInterval, done) {
+					return
+				}
 				continue
 			}
 
@@ -206,19 +300,25 @@ func (b *BilibiliLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, e
 				return true
 			})
 
-			if danmakuURL == (&url.URL{}) {
+			if *danmakuURL == (url.URL{}) {
+				if !sleepWithDone(danmakuRetryInterval, done) {
+					return
+				}
 				continue
 			}
 
 			conn, _, err := websocket.DefaultDialer.Dial(danmakuURL.String(), nil)
 			if err != nil {
+				if !sleepWithDone(danmakuRetryInterval, done) {
+					return
+				}
 				continue
 			}
 
 			init, _ := json.Marshal(&danmakuInitMsg{
 				ClientVer: "1.5.10.1",
 				Platform:  "web",
-				ProtoVer:  1,
+				ProtoVer:  ProtocolVerBrotli,
 				RoomID:    int(b.roomID),
 				UID:       2,
 			})
@@ -227,18 +327,19 @@ func (b *BilibiliLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, e
 			conn.WriteMessage(websocket.BinaryMessage, msgEncode(init, OperationTypeEnter))
 			exitChan := make(chan struct{})
 
-			go danmakuReceive(conn, msgChan, exitChan)
+			go b.danmakuReceive(conn, msgChan, exitChan)
 
 			for {
 				select {
 				case <-done:
 					conn.Close()
-					select {
-					case <-exitChan:
-						close(msgChan)
-					}
+					<-exitChan
 					return
 				case <-exitChan:
+					metrics.DanmakuReconnects.Inc(MetricLabels(b)...)
+					if !sleepWithDone(danmakuRetryInterval, done) {
+						return
+					}
 					goto DanmakuRestart
 				case <-heartTicker.C:
 					conn.WriteMessage(websocket.BinaryMessage, msgEncode([]byte{}, OperationTypeHeart))
@@ -250,28 +351,102 @@ func (b *BilibiliLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, e
 	return msgChan, nil
 }
 
-func danmakuReceive(conn *websocket.Conn, msgChan chan *DanmakuMessage, exitChan chan struct{}) {
+func (b *BilibiliLive) danmakuReceive(conn *websocket.Conn, msgChan chan *DanmakuMessage, exitChan chan struct{}) {
 	defer close(exitChan)
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
 			return
 		}
-		for {
-			if len(message) <= 16 {
-				break
-			}
-			bodyLen := binary.BigEndian.Uint32(message[:4])
-			operation := binary.BigEndian.Uint32(message[8:12])
-			if operation == OperationTypeMessage {
-				if msg := danmakuDecode(message[12:bodyLen]); msg != nil {
+
+		packets, err := danmakuUnpack(message)
+		if err != nil {
+			zap.L().Debug("Bilibili Danmaku Unpack",
+				zap.Int64("RoomId", b.roomID),
+				zap.String("Err", err.Error()),
+			)
+		}
+
+		for _, packet := range packets {
+			switch packet.Operation {
+			case OperationTypeMessage:
+				if msg := danmakuDecode(packet.Body); msg != nil {
 					msgChan <- msg
 				}
+			case OperationTypeHeartReply:
+				if len(packet.Body) >= 4 {
+					atomic.StoreUint32(&b.popularity, binary.BigEndian.Uint32(packet.Body))
+				}
+			case OperationTypeEnterReply:
+				if code := gjson.GetBytes(packet.Body, "code"); code.Exists() && code.Int() != 0 {
+					zap.L().Error("Bilibili Danmaku Auth",
+						zap.Int64("RoomId", b.roomID),
+						zap.Int64("Code", code.Int()),
+					)
+					conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// GetPopularity return popularity from the last heartbeat reply
+func (b *BilibiliLive) GetPopularity() uint32 {
+	return atomic.LoadUint32(&b.popularity)
+}
+
+// danmakuUnpack split a message into packets, compressed packets are unpacked recursively
+func danmakuUnpack(message []byte) ([]danmakuPacket, error) {
+	packets := []danmakuPacket{}
+
+	for len(message) > 0 {
+		if len(message) < HeaderLen {
+			return packets, fmt.Errorf("danmaku packet header too short - %d", len(message))
+		}
+
+		packetLen := binary.BigEndian.Uint32(message[0:4])
+		headerLen := binary.BigEndian.Uint16(message[4:6])
+		protocolVer := binary.BigEndian.Uint16(message[6:8])
+		operation := binary.BigEndian.Uint32(message[8:12])
+
+		if packetLen < uint32(headerLen) || packetLen > uint32(len(message)) || headerLen < HeaderLen {
+			return packets, fmt.Errorf("danmaku packet length invalid - %d/%d", packetLen, len(message))
+		}
+		body := message[headerLen:packetLen]
+		message = message[packetLen:]
+
+		var reader io.Reader
+		switch protocolVer {
+		case ProtocolVerZlib:
+			zr, err := zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return packets, err
 			}
-			message = append(message[bodyLen:])
+			reader = zr
+		case ProtocolVerBrotli:
+			reader = brotli.NewReader(bytes.NewReader(body))
+		default:
+			packets = append(packets, danmakuPacket{
+				ProtocolVer: protocolVer,
+				Operation:   operation,
+				Body:        body,
+			})
+			continue
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return packets, fmt.Errorf("danmaku packet decompress - %s", err.Error())
+		}
+		nested, err := danmakuUnpack(data)
+		packets = append(packets, nested...)
+		if err != nil {
+			return packets, err
 		}
 	}
 
+	return packets, nil
 }
 
 func msgEncode(body []byte, operation uint32) []byte {
@@ -286,9 +461,16 @@ func msgEncode(body []byte, operation uint32) []byte {
 }
 
 func danmakuDecode(content []byte) *DanmakuMessage {
-	body := gjson.Parse(string(content))
+	body := gjson.ParseBytes(content)
+	data := body.Get("data")
 
-	switch body.Get("cmd").String() {
+	// cmd may carry a suffix like DANMU_MSG:4:0:2:2:2:0
+	cmd := body.Get("cmd").String()
+	if i := strings.Index(cmd, ":"); i >= 0 {
+		cmd = cmd[:i]
+	}
+
+	switch cmd {
 	case "DANMU_MSG":
 		// filter gift danmaku
 		if body.Get("info.0.5").Int() == 0 {
@@ -297,10 +479,85 @@ func danmakuDecode(content []byte) *DanmakuMessage {
 		return &DanmakuMessage{
 			Content:  body.Get("info.1").String(),
 			SendTime: body.Get("info.0.4").Int(),
-			Type:     1,
+			Type:     DanmakuTypeChat,
 			UserName: body.Get("info.2.1").String(),
+			UserID:   body.Get("info.2.0").String(),
+		}
+	case "SEND_GIFT":
+		msg := &DanmakuMessage{
+			SendTime:  data.Get("timestamp").Int() * 1000,
+			Type:      DanmakuTypeGift,
+			UserName:  data.Get("uname").String(),
+			UserID:    data.Get("uid").String(),
+			GiftID:    data.Get("giftId").String(),
+			GiftName:  data.Get("giftName").String(),
+			GiftCount: data.Get("num").Int(),
+		}
+		// gold coin is 1/1000 CNY, silver coin is free
+		if data.Get("coin_type").String() == "gold" {
+			msg.Price = data.Get("total_coin").Float() / 1000
+			msg.Currency = "CNY"
+		}
+		return msg
+	case "SUPER_CHAT_MESSAGE":
+		return &DanmakuMessage{
+			Content:   data.Get("message").String(),
+			SendTime:  data.Get("start_time").Int() * 1000,
+			Type:      DanmakuTypeSuperChat,
+			UserName:  data.Get("user_info.uname").String(),
+			UserID:    data.Get("uid").String(),
+			Price:     data.Get("price").Float(),
+			Currency:  "CNY",
+			GiftID:    data.Get("gift.gift_id").String(),
+			GiftName:  data.Get("gift.gift_name").String(),
+			GiftCount: data.Get("gift.num").Int(),
+			Level:     data.Get("time").Int(),
+		}
+	case "GUARD_BUY":
+		return &DanmakuMessage{
+			SendTime:  data.Get("start_time").Int() * 1000,
+			Type:      DanmakuTypeGuard,
+			UserName:  data.Get("username").String(),
+			UserID:    data.Get("uid").String(),
+			Price:     data.Get("price").Float() * float64(data.Get("num").Int()) / 1000,
+			Currency:  "CNY",
+			GiftID:    data.Get("gift_id").String(),
+			GiftName:  data.Get("gift_name").String(),
+			GiftCount: data.Get("num").Int(),
+			Level:     data.Get("guard_level").Int(),
+		}
+	case "INTERACT_WORD":
+		// msg_type 1 enter, 2 follow, 3 share
+		return &DanmakuMessage{
+			Content:  interactTypes[data.Get("msg_type").Int()],
+			SendTime: data.Get("timestamp").Int() * 1000,
+			Type:     DanmakuTypeEnter,
+			UserName: data.Get("uname").String(),
+			UserID:   data.Get("uid").String(),
+		}
+	case "ROOM_CHANGE":
+		return &DanmakuMessage{
+			Content:  data.Get("title").String(),
+			SendTime: time.Now().UnixNano() / 1e6,
+			Type:     DanmakuTypeRoomChange,
+		}
+	case "LIVE":
+		return &DanmakuMessage{
+			SendTime: time.Now().UnixNano() / 1e6,
+			Type:     DanmakuTypeLiveStart,
+		}
+	case "PREPARING":
+		return &DanmakuMessage{
+			SendTime: time.Now().UnixNano() / 1e6,
+			Type:     DanmakuTypeLiveEnd,
 		}
 	}
 
 	return nil
 }
+
+var interactTypes = map[int64]string{
+	1: "enter",
+	2: "follow",
+	3: "share",
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func testPacket(ver uint16, operation uint32, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(len(body)+HeaderLen))
+	binary.Write(buf, binary.BigEndian, uint16(HeaderLen))
+	binary.Write(buf, binary.BigEndian, ver)
+	binary.Write(buf, binary.BigEndian, operation)
+	binary.Write(buf, binary.BigEndian, uint32(SequenceID))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func testZlib(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func testBrotli(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := brotli.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func testHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+const testDanmu = `{"cmd":"DANMU_MSG","info":[[0,1,25,16777215,1561000000000,-1,0,"abc",0,0,0],"草",[12345,"user",0,0,0,10000,1,""]]}`
+
+func TestDanmakuUnpack(t *testing.T) {
+	danmu := testPacket(ProtocolVerJSON, OperationTypeMessage, []byte(testDanmu))
+	batch := append(append([]byte{}, danmu...), danmu...)
+
+	tests := []struct {
+		name       string
+		frame      []byte
+		operations []uint32
+		bodies     []string
+		err        bool
+	}{
+		{
+			name:       "auth reply",
+			frame:      testHex("0000001a0010000100000008000000017b22636f6465223a307d"),
+			operations: []uint32{OperationTypeEnterReply},
+			bodies:     []string{`{"code":0}`},
+		},
+		{
+			name:       "heartbeat reply",
+			frame:      testHex("00000014001000010000000300000001000004d2"),
+			operations: []uint32{OperationTypeHeartReply},
+			bodies:     []string{"\x00\x00\x04\xd2"},
+		},
+		{
+			name:       "plain message",
+			frame:      danmu,
+			operations: []uint32{OperationTypeMessage},
+			bodies:     []string{testDanmu},
+		},
+		{
+			name:       "zlib batch",
+			frame:      testPacket(ProtocolVerZlib, OperationTypeMessage, testZlib(batch)),
+			operations: []uint32{OperationTypeMessage, OperationTypeMessage},
+			bodies:     []string{testDanmu, testDanmu},
+		},
+		{
+			name:       "brotli batch",
+			frame:      testPacket(ProtocolVerBrotli, OperationTypeMessage, testBrotli(batch)),
+			operations: []uint32{OperationTypeMessage, OperationTypeMessage},
+			bodies:     []string{testDanmu, testDanmu},
+		},
+		{
+			name: "brotli and plain in one frame",
+			frame: append(
+				testPacket(ProtocolVerBrotli, OperationTypeMessage, testBrotli(danmu)),
+				testHex("00000014001000010000000300000001000004d2")...,
+			),
+			operations: []uint32{OperationTypeMessage, OperationTypeHeartReply},
+			bodies:     []string{testDanmu, "\x00\x00\x04\xd2"},
+		},
+		{
+			name:  "truncated",
+			frame: danmu[:len(danmu)-1],
+			err:   true,
+		},
+		{
+			name:  "bad zlib",
+			frame: testPacket(ProtocolVerZlib, OperationTypeMessage, []byte("not zlib")),
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		packets, err := danmakuUnpack(test.frame)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if len(packets) != len(test.operations) {
+			t.Errorf("%s: want %d packets, got %d", test.name, len(test.operations), len(packets))
+			continue
+		}
+		for i, packet := range packets {
+			if packet.Operation != test.operations[i] || string(packet.Body) != test.bodies[i] {
+				t.Errorf("%s: packet %d = %d %q", test.name, i, packet.Operation, packet.Body)
+			}
+		}
+	}
+}
+
+func TestDanmakuDecode(t *testing.T) {
+	tests := []struct {
+		body string
+		want *DanmakuMessage
+	}{
+		{
+			body: testDanmu,
+			want: &DanmakuMessage{Type: DanmakuTypeChat, Content: "草", SendTime: 1561000000000, UserName: "user", UserID: "12345"},
+		},
+		{
+			body: `{"cmd":"DANMU_MSG:4:0:2:2:2:0","info":[[0,1,25,16777215,1561000000000,-1],"w",[1,"u"]]}`,
+			want: &DanmakuMessage{Type: DanmakuTypeChat, Content: "w", SendTime: 1561000000000, UserName: "u", UserID: "1"},
+		},
+		{
+			body: `{"cmd":"SEND_GIFT","data":{"giftName":"小心心","giftId":30607,"num":5,"uname":"u","uid":1,"coin_type":"silver","total_coin":0,"timestamp":1561000000}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeGift, SendTime: 1561000000000, UserName: "u", UserID: "1", GiftID: "30607", GiftName: "小心心", GiftCount: 5},
+		},
+		{
+			body: `{"cmd":"SEND_GIFT","data":{"giftName":"B坷垃","giftId":3,"num":2,"uname":"u","uid":1,"coin_type":"gold","total_coin":19800,"timestamp":1561000000}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeGift, SendTime: 1561000000000, UserName: "u", UserID: "1", GiftID: "3", GiftName: "B坷垃", GiftCount: 2, Price: 19.8, Currency: "CNY"},
+		},
+		{
+			body: `{"cmd":"SUPER_CHAT_MESSAGE","data":{"uid":1,"price":30,"message":"<3","time":60,"start_time":1561000000,"user_info":{"uname":"u"},"gift":{"gift_id":12000,"gift_name":"醒目留言","num":1}}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeSuperChat, Content: "<3", SendTime: 1561000000000, UserName: "u", UserID: "1", Price: 30, Currency: "CNY", GiftID: "12000", GiftName: "醒目留言", GiftCount: 1, Level: 60},
+		},
+		{
+			body: `{"cmd":"GUARD_BUY","data":{"uid":1,"username":"u","guard_level":3,"num":2,"price":198000,"gift_id":10003,"gift_name":"舰长","start_time":1561000000}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeGuard, SendTime: 1561000000000, UserName: "u", UserID: "1", Price: 396, Currency: "CNY", GiftID: "10003", GiftName: "舰长", GiftCount: 2, Level: 3},
+		},
+		{
+			body: `{"cmd":"INTERACT_WORD","data":{"uid":1,"uname":"u","msg_type":2,"timestamp":1561000000}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeEnter, Content: "follow", SendTime: 1561000000000, UserName: "u", UserID: "1"},
+		},
+		{
+			body: `{"cmd":"ROOM_CHANGE","data":{"title":"Minecraft","area_name":"单机"}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeRoomChange, Content: "Minecraft"},
+		},
+		{
+			body: `{"cmd":"LIVE","roomid":14917277}`,
+			want: &DanmakuMessage{Type: DanmakuTypeLiveStart},
+		},
+		{
+			body: `{"cmd":"PREPARING","roomid":"14917277"}`,
+			want: &DanmakuMessage{Type: DanmakuTypeLiveEnd},
+		},
+		{
+			body: `{"cmd":"ONLINE_RANK_COUNT","data":{"count":1}}`,
+			want: nil,
+		},
+	}
+
+	for _, test := range tests {
+		msg := danmakuDecode([]byte(test.body))
+		if msg == nil || test.want == nil {
+			if msg != test.want {
+				t.Errorf("%s: want %+v, got %+v", test.body, test.want, msg)
+			}
+			continue
+		}
+
+		// time of room events is the receive time
+		if test.want.SendTime == 0 {
+			msg.SendTime = 0
+		}
+		if *msg != *test.want {
+			t.Errorf("%s:\nwant %+v\ngot  %+v", test.body, *test.want, *msg)
+		}
+	}
+}
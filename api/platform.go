@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"sync"
+)
+
+// Platform describe a live platform
+type Platform struct {
+	// Name is the display name of platform
+	Name string
+	// Hosts is a list of host patterns, support `path.Match` syntax
+	Hosts []string
+	// Pattern must match the whole live room url
+	Pattern *regexp.Regexp
+	// New return a LiveAPI for the room, nil if init failed
+	New func(base *BaseAPI) LiveAPI
+}
+
+var (
+	platformLock sync.RWMutex
+	platforms    []*Platform
+)
+
+// Register add a platform into registry
+func Register(platform *Platform) {
+	if platform == nil || platform.New == nil {
+		panic("api: Register platform is nil")
+	}
+
+	platformLock.Lock()
+	defer platformLock.Unlock()
+
+	for _, p := range platforms {
+		if p.Name == platform.Name {
+			panic("api: Register called twice for platform " + platform.Name)
+		}
+	}
+	platforms = append(platforms, platform)
+}
+
+// Platforms return all registered platforms
+func Platforms() []*Platform {
+	platformLock.RLock()
+	defer platformLock.RUnlock()
+
+	return append([]*Platform{}, platforms...)
+}
+
+// Match return the platform which support the url
+func Match(u *url.URL) *Platform {
+	platformLock.RLock()
+	defer platformLock.RUnlock()
+
+	for _, p := range platforms {
+		if p.match(u) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func (p *Platform) match(u *url.URL) bool {
+	hostMatched := false
+	for _, host := range p.Hosts {
+		if ok, _ := path.Match(host, u.Host); ok {
+			hostMatched = true
+			break
+		}
+	}
+
+	if !hostMatched {
+		return false
+	}
+
+	return p.Pattern == nil || p.Pattern.MatchString(u.String())
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	// the test platform is dropped from the registry after the test
+	registered := Platforms()
+	defer func() {
+		platformLock.Lock()
+		platforms = registered
+		platformLock.Unlock()
+	}()
+	Register(&Platform{
+		Name:    "Test",
+		Hosts:   []string{"*.example.com"},
+		Pattern: regexp.MustCompile(`^https?://live\.example\.com/\d+$`),
+		New: func(base *BaseAPI) LiveAPI {
+			return nil
+		},
+	})
+
+	tests := []struct {
+		url      string
+		platform string
+	}{
+		{"https://live.bilibili.com/14917277", "哔哩哔哩"},
+		{"https://www.youtube.com/channel/UC1opHUrw8rvnsadT-iGp7Cg/live", "YouTube"},
+		{"https://live.example.com/123", "Test"},
+		{"https://live.example.com/abc", ""},
+		{"https://example.com/123", ""},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		name := ""
+		if p := Match(u); p != nil {
+			name = p.Name
+		}
+		if name != test.platform {
+			t.Errorf("Match(%s) = %q, want %q", test.url, name, test.platform)
+		}
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lintmx/dd-recorder/metrics"
 	"github.com/lintmx/dd-recorder/utils"
 	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
@@ -25,13 +28,29 @@ var (
 
 	initInvalidData = "contents.liveChatRenderer.continuations.0.invalidationContinuationData"
 	initTimeoutData = "contents.liveChatRenderer.continuations.0.timedContinuationData"
-	initMessageData = "contents.liveChatRenderer.actions.#.addChatItemAction.item.liveChatTextMessageRenderer"
+	initMessageData = "contents.liveChatRenderer.actions.#.addChatItemAction.item"
 
 	continuationInvalidData = "response.continuationContents.liveChatContinuation.continuations.0.invalidationContinuationData"
 	continuationTimeoutData = "response.continuationContents.liveChatContinuation.continuations.0.timedContinuationData"
-	continuationMessageData = "response.continuationContents.liveChatContinuation.actions.#.addChatItemAction.item.liveChatTextMessageRenderer"
+	continuationMessageData = "response.continuationContents.liveChatContinuation.actions.#.addChatItemAction.item"
 )
 
+var youtubeURLRegex = regexp.MustCompile(`^(?:https?:\/\/)?www\.youtube\.com\/channel\/([^\/]+)(?:[\/])?(?:live)?`)
+
+func init() {
+	Register(&Platform{
+		Name:    "YouTube",
+		Hosts:   []string{"www.youtube.com"},
+		Pattern: youtubeURLRegex,
+		New: func(base *BaseAPI) LiveAPI {
+			if live := NewYouTubeLive(base); live != nil {
+				return live
+			}
+			return nil
+		},
+	})
+}
+
 // YouTubeLive youtube live api
 type YouTubeLive struct {
 	BaseAPI
@@ -43,8 +62,7 @@ func NewYouTubeLive(base *BaseAPI) *YouTubeLive {
 	youtubeLive := YouTubeLive{
 		BaseAPI: *base,
 	}
-	regexURL := regexp.MustCompile(`^(?:https?:\/\/)?www\.youtube\.com\/channel\/([^\/]+)(?:[\/])?(?:live)?`)
-	if result := regexURL.FindStringSubmatch(youtubeLive.GetLiveURL()); result != nil {
+	if result := youtubeURLRegex.FindStringSubmatch(youtubeLive.GetLiveURL()); result != nil {
 		youtubeLive.liveID = result[1]
 		if err := youtubeLive.RefreshLiveInfo(); err != nil {
 			zap.L().Error("Init Live API", zap.String("url", youtubeLive.GetLiveURL()))
@@ -57,7 +75,13 @@ func NewYouTubeLive(base *BaseAPI) *YouTubeLive {
 }
 
 // get youtube live page js
-func (y *YouTubeLive) getLiveInfo() (string, error) {
+func (y *YouTubeLive) getLiveInfo() (info string, err error) {
+	defer func() {
+		if err != nil {
+			metrics.APIErrors.Inc(y.GetPlatformName(), "youtubeLiveURL")
+		}
+	}()
+
 	body, err := utils.HTTPGet(fmt.Sprintf(youtubeLiveURL, y.liveID))
 
 	if err != nil {
@@ -122,6 +146,7 @@ func (y *YouTubeLive) GetStreamURLs() ([]StreamURL, error) {
 		streamURLs = append(streamURLs, StreamURL{
 			PlayURL:  *hlsURL,
 			FileType: "ts",
+			Protocol: ProtocolHLS,
 		})
 	}
 
@@ -144,11 +169,18 @@ func (y *YouTubeLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, er
 				header,
 			)
 			if err != nil {
+				metrics.APIErrors.Inc(y.GetPlatformName(), "youtubeChatURL")
+				if !sleepWithDone(danmakuRetryInterval, done) {
+					return
+				}
 				continue
 			}
 
 			data := re.FindStringSubmatch(body)
 			if len(data) < 2 {
+				if !sleepWithDone(danmakuRetryInterval, done) {
+					return
+				}
 				continue
 			}
 
@@ -161,15 +193,15 @@ func (y *YouTubeLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, er
 				timeOutMs = continuationData.Get("timeoutMs").Int()
 				continuation = continuationData.Get("continuation").String()
 			} else {
+				if !sleepWithDone(danmakuRetryInterval, done) {
+					return
+				}
 				continue
 			}
 
 			gjson.Get(data[1], initMessageData).ForEach(func(key, value gjson.Result) bool {
-				msgChan <- &DanmakuMessage{
-					Content:  value.Get("message.runs.0.text").String(),
-					SendTime: value.Get("timestampUsec").Int() / 1e6,
-					Type:     1,
-					UserName: value.Get("authorName.simpleText").String(),
+				if msg := youtubeChatDecode(value); msg != nil {
+					msgChan <- msg
 				}
 				return true
 			})
@@ -184,6 +216,11 @@ func (y *YouTubeLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, er
 						header,
 					)
 					if err != nil {
+						metrics.APIErrors.Inc(y.GetPlatformName(), "youtubeChatAPI")
+						metrics.DanmakuReconnects.Inc(MetricLabels(y)...)
+						if !sleepWithDone(danmakuRetryInterval, done) {
+							return
+						}
 						goto DanmakuRestart
 					}
 
@@ -194,15 +231,16 @@ func (y *YouTubeLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, er
 						timeOutMs = continuationData.Get("timeoutMs").Int()
 						continuation = continuationData.Get("continuation").String()
 					} else {
+						metrics.DanmakuReconnects.Inc(MetricLabels(y)...)
+						if !sleepWithDone(danmakuRetryInterval, done) {
+							return
+						}
 						goto DanmakuRestart
 					}
 
 					gjson.Get(body, continuationMessageData).ForEach(func(key, value gjson.Result) bool {
-						msgChan <- &DanmakuMessage{
-							Content:  value.Get("message.runs.0.text").String(),
-							SendTime: value.Get("timestampUsec").Int() / 1e6,
-							Type:     1,
-							UserName: value.Get("authorName.simpleText").String(),
+						if msg := youtubeChatDecode(value); msg != nil {
+							msgChan <- msg
 						}
 						return true
 					})
@@ -213,3 +251,128 @@ func (y *YouTubeLive) GetDanmaku(done chan struct{}) (<-chan *DanmakuMessage, er
 
 	return msgChan, nil
 }
+
+// youtubeChatDecode decode a chat item renderer
+func youtubeChatDecode(item gjson.Result) *DanmakuMessage {
+	var renderer gjson.Result
+	msg := &DanmakuMessage{}
+
+	if renderer = item.Get("liveChatTextMessageRenderer"); renderer.Exists() {
+		msg.Type = DanmakuTypeChat
+		msg.Content = youtubeRunsText(renderer.Get("message.runs"))
+	} else if renderer = item.Get("liveChatPaidMessageRenderer"); renderer.Exists() {
+		msg.Type = DanmakuTypeSuperChat
+		msg.Content = youtubeRunsText(renderer.Get("message.runs"))
+		msg.Price, msg.Currency = parseYouTubeAmount(renderer.Get("purchaseAmountText.simpleText").String())
+	} else if renderer = item.Get("liveChatPaidStickerRenderer"); renderer.Exists() {
+		msg.Type = DanmakuTypeGift
+		msg.Price, msg.Currency = parseYouTubeAmount(renderer.Get("purchaseAmountText.simpleText").String())
+		msg.GiftName = renderer.Get("sticker.accessibility.accessibilityData.label").String()
+		msg.GiftCount = 1
+	} else if renderer = item.Get("liveChatMembershipItemRenderer"); renderer.Exists() {
+		msg.Type = DanmakuTypeGuard
+		// new member has a subtext, milestone has a primary text and message
+		msg.GiftName = youtubeRunsText(renderer.Get("headerPrimaryText.runs"))
+		if msg.GiftName == "" {
+			msg.GiftName = youtubeRunsText(renderer.Get("headerSubtext.runs"))
+			if msg.GiftName == "" {
+				msg.GiftName = renderer.Get("headerSubtext.simpleText").String()
+			}
+		}
+		msg.Content = youtubeRunsText(renderer.Get("message.runs"))
+		msg.GiftCount = 1
+	} else {
+		return nil
+	}
+
+	msg.SendTime = renderer.Get("timestampUsec").Int() / 1e3
+	msg.UserName = renderer.Get("authorName.simpleText").String()
+	msg.UserID = renderer.Get("authorExternalChannelId").String()
+
+	return msg
+}
+
+// youtubeRunsText join text runs, emoji is replaced by its shortcut
+func youtubeRunsText(runs gjson.Result) string {
+	text := strings.Builder{}
+
+	runs.ForEach(func(key, run gjson.Result) bool {
+		if t := run.Get("text"); t.Exists() {
+			text.WriteString(t.String())
+		} else if emoji := run.Get("emoji"); emoji.Exists() {
+			if shortcut := emoji.Get("shortcuts.0"); shortcut.Exists() {
+				text.WriteString(shortcut.String())
+			} else {
+				text.WriteString(emoji.Get("emojiId").String())
+			}
+		}
+		return true
+	})
+
+	return text.String()
+}
+
+var youtubeCurrencySymbols = map[string]string{
+	"$":   "USD",
+	"US$": "USD",
+	"CA$": "CAD",
+	"A$":  "AUD",
+	"NZ$": "NZD",
+	"HK$": "HKD",
+	"NT$": "TWD",
+	"MX$": "MXN",
+	"R$":  "BRL",
+	"¥":   "JPY",
+	"￥":   "JPY",
+	"CN¥": "CNY",
+	"€":   "EUR",
+	"£":   "GBP",
+	"₩":   "KRW",
+	"₹":   "INR",
+	"₱":   "PHP",
+	"₫":   "VND",
+	"₽":   "RUB",
+	"₪":   "ILS",
+}
+
+var youtubeAmountRegex = regexp.MustCompile(`[\d.,]*\d`)
+
+// parseYouTubeAmount parse text like "$5.00", "¥1,000" or "1.000,00 €"
+func parseYouTubeAmount(text string) (float64, string) {
+	loc := youtubeAmountRegex.FindStringIndex(text)
+	if loc == nil {
+		return 0, ""
+	}
+
+	symbol := strings.TrimSpace(text[:loc[0]] + text[loc[1]:])
+	currency, ok := youtubeCurrencySymbols[symbol]
+	if !ok {
+		currency = symbol
+	}
+
+	number := text[loc[0]:loc[1]]
+	lastComma := strings.LastIndex(number, ",")
+	lastDot := strings.LastIndex(number, ".")
+	switch {
+	case lastComma >= 0 && lastDot >= 0:
+		// the last separator is the decimal point
+		if lastComma > lastDot {
+			number = strings.Replace(strings.Replace(number, ".", "", -1), ",", ".", 1)
+		} else {
+			number = strings.Replace(number, ",", "", -1)
+		}
+	case lastComma >= 0:
+		// comma with three digits is a thousands separator
+		if strings.Count(number, ",") > 1 || len(number)-lastComma-1 == 3 {
+			number = strings.Replace(number, ",", "", -1)
+		} else {
+			number = strings.Replace(number, ",", ".", 1)
+		}
+	case strings.Count(number, ".") > 1:
+		number = strings.Replace(number, ".", "", -1)
+	}
+
+	amount, _ := strconv.ParseFloat(number, 64)
+
+	return amount, currency
+}
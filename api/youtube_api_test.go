@@ -0,0 +1,77 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseYouTubeAmount(t *testing.T) {
+	tests := []struct {
+		text     string
+		amount   float64
+		currency string
+	}{
+		{"$5.00", 5, "USD"},
+		{"¥1,000", 1000, "JPY"},
+		{"CA$2.79", 2.79, "CAD"},
+		{"NT$1,500.00", 1500, "TWD"},
+		{"2,00 €", 2, "EUR"},
+		{"1.234,56 €", 1234.56, "EUR"},
+		{"₩10,000", 10000, "KRW"},
+		{"CHF 10.00", 10, "CHF"},
+		{"", 0, ""},
+	}
+
+	for _, test := range tests {
+		amount, currency := parseYouTubeAmount(test.text)
+		if amount != test.amount || currency != test.currency {
+			t.Errorf("parseYouTubeAmount(%q) = %v %q, want %v %q", test.text, amount, currency, test.amount, test.currency)
+		}
+	}
+}
+
+func TestYouTubeChatDecode(t *testing.T) {
+	tests := []struct {
+		item string
+		want *DanmakuMessage
+	}{
+		{
+			item: `{"liveChatTextMessageRenderer":{"message":{"runs":[{"text":"hello "},{"emoji":{"emojiId":"😀","shortcuts":[":grinning:"]}},{"text":" world"},{"emoji":{"emojiId":"UCxxx/abc"}}]},"authorName":{"simpleText":"user"},"authorExternalChannelId":"UC123","timestampUsec":"1561000000123456"}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeChat, Content: "hello :grinning: worldUCxxx/abc", SendTime: 1561000000123, UserName: "user", UserID: "UC123"},
+		},
+		{
+			item: `{"liveChatPaidMessageRenderer":{"message":{"runs":[{"text":"thanks"}]},"purchaseAmountText":{"simpleText":"¥1,000"},"authorName":{"simpleText":"user"},"authorExternalChannelId":"UC123","timestampUsec":"1561000000000000"}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeSuperChat, Content: "thanks", Price: 1000, Currency: "JPY", SendTime: 1561000000000, UserName: "user", UserID: "UC123"},
+		},
+		{
+			item: `{"liveChatPaidStickerRenderer":{"sticker":{"accessibility":{"accessibilityData":{"label":"Cat waving"}}},"purchaseAmountText":{"simpleText":"$2.00"},"authorName":{"simpleText":"user"},"authorExternalChannelId":"UC123","timestampUsec":"1561000000000000"}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeGift, GiftName: "Cat waving", GiftCount: 1, Price: 2, Currency: "USD", SendTime: 1561000000000, UserName: "user", UserID: "UC123"},
+		},
+		{
+			item: `{"liveChatMembershipItemRenderer":{"headerSubtext":{"runs":[{"text":"Welcome to "},{"text":"Channel"},{"text":"!"}]},"authorName":{"simpleText":"user"},"authorExternalChannelId":"UC123","timestampUsec":"1561000000000000"}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeGuard, GiftName: "Welcome to Channel!", GiftCount: 1, SendTime: 1561000000000, UserName: "user", UserID: "UC123"},
+		},
+		{
+			item: `{"liveChatMembershipItemRenderer":{"headerPrimaryText":{"runs":[{"text":"Member for "},{"text":"6"},{"text":" months"}]},"headerSubtext":{"simpleText":"Member"},"message":{"runs":[{"text":"half a year"}]},"authorName":{"simpleText":"user"},"authorExternalChannelId":"UC123","timestampUsec":"1561000000000000"}}`,
+			want: &DanmakuMessage{Type: DanmakuTypeGuard, GiftName: "Member for 6 months", Content: "half a year", GiftCount: 1, SendTime: 1561000000000, UserName: "user", UserID: "UC123"},
+		},
+		{
+			item: `{"liveChatViewerEngagementMessageRenderer":{}}`,
+			want: nil,
+		},
+	}
+
+	for _, test := range tests {
+		msg := youtubeChatDecode(gjson.Parse(test.item))
+		if msg == nil || test.want == nil {
+			if msg != test.want {
+				t.Errorf("%s: want %+v, got %+v", test.item, test.want, msg)
+			}
+			continue
+		}
+		if *msg != *test.want {
+			t.Errorf("%s:\nwant %+v\ngot  %+v", test.item, *test.want, *msg)
+		}
+	}
+}
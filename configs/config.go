@@ -4,34 +4,212 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"os"
 )
 
+// stream downloader
+const (
+	DownloaderNative = "native"
+	DownloaderFFmpeg = "ffmpeg"
+)
+
+// danmaku output format
+const (
+	DanmakuFormatXML   = "xml"
+	DanmakuFormatASS   = "ass"
+	DanmakuFormatJSONL = "jsonl"
+)
+
+// default output path template
+const (
+	DefaultDirTemplate  = `{{.Platform}}/{{.Author}}/{{.RecordTime.Format "2006-01-02"}}`
+	DefaultFileTemplate = `[{{.Time.Format "2006-01-02 15-04-05"}}][{{.Platform}}][{{.Author}}] {{.Title}}`
+)
+
+// placeholder of hidden secrets
+const redacted = "<redacted>"
+
+// post process steps
+const (
+	StepFixFLV       = "fix_flv"
+	StepRemuxMP4     = "remux_mp4"
+	StepRemuxMKV     = "remux_mkv"
+	StepConcat       = "concat"
+	StepASS          = "ass"
+	StepDeleteSource = "delete_source"
+)
+
+// PostProcessConfig steps run on finished files, empty steps to disable
+type PostProcessConfig struct {
+	Workers int      `yaml:"workers"`
+	Steps   []string `yaml:"steps"`
+	// job queue file, default in out path
+	Queue string `yaml:"queue"`
+}
+
+// HookConfig shell commands run on events
+type HookConfig struct {
+	// second, default 60
+	Timeout         uint16   `yaml:"timeout"`
+	LiveStart       []string `yaml:"live_start"`
+	RecordStart     []string `yaml:"record_start"`
+	RecordFileOpen  []string `yaml:"record_file_open"`
+	RecordFileClose []string `yaml:"record_file_close"`
+	RecordStop      []string `yaml:"record_stop"`
+	LiveEnd         []string `yaml:"live_end"`
+	Error           []string `yaml:"error"`
+}
+
+// WebhookConfig is a receiver of events
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// empty for live_start, live_end and record_file_close
+	Events []string `yaml:"events"`
+}
+
+// HTTPConfig is the control api server
+type HTTPConfig struct {
+	// Listen address, empty to disable
+	Listen string `yaml:"listen"`
+	// Token required as bearer token if not empty
+	Token string `yaml:"token"`
+}
+
+// WatchdogConfig detect stalled recordings, 0 to disable a check
+type WatchdogConfig struct {
+	// StallTimeout second, restart a stream whose output has not grown
+	StallTimeout uint32 `yaml:"stall_timeout"`
+	// DanmakuTimeout second, report danmaku not received
+	DanmakuTimeout uint32 `yaml:"danmaku_timeout"`
+}
+
+// ASSConfig style of ass danmaku, zero value use the default
+type ASSConfig struct {
+	Width    int     `yaml:"width"`
+	Height   int     `yaml:"height"`
+	FontName string  `yaml:"font_name"`
+	FontSize int     `yaml:"font_size"`
+	Duration float64 `yaml:"duration"`
+	Opacity  float64 `yaml:"opacity"`
+}
+
 // Config struct
 type Config struct {
-	Debug    bool     `yaml:"debug"`
-	Interval uint16   `yaml:"interval"`
-	LogPath  string   `yaml:"log_path"`
-	OutPath  string   `yaml:"out_path"`
-	Rooms    []string `yaml:"rooms"`
+	Debug           bool              `yaml:"debug"`
+	Interval        uint16            `yaml:"interval"`
+	LogPath         string            `yaml:"log_path"`
+	OutPath         string            `yaml:"out_path"`
+	DirTemplate     string            `yaml:"dir_template"`
+	FileTemplate    string            `yaml:"file_template"`
+	Downloader      string            `yaml:"downloader"`
+	Quality         int64             `yaml:"quality"`
+	CDN             string            `yaml:"cdn"`
+	SegmentDuration uint32            `yaml:"segment_duration"`
+	SegmentSize     int64             `yaml:"segment_size"`
+	SplitOnTitle    bool              `yaml:"split_on_title_change"`
+	Danmaku         []string          `yaml:"danmaku"`
+	ASS             ASSConfig         `yaml:"ass"`
+	PostProcess     PostProcessConfig `yaml:"postprocess"`
+	Hooks           HookConfig        `yaml:"hooks"`
+	Webhooks        []WebhookConfig   `yaml:"webhooks"`
+	HTTP            HTTPConfig        `yaml:"http"`
+	Watchdog        WatchdogConfig    `yaml:"watchdog"`
+	WebhookQueue    string            `yaml:"webhook_queue"`
+	History         string            `yaml:"history"`
+	Rooms           []Room            `yaml:"rooms"`
 }
 
-// InitConfig return a config with parse
-func InitConfig(conf string) *Config {
-	config := &Config{}
+// Default return the config of settings set nowhere
+func Default() *Config {
+	return &Config{
+		Interval:     10,
+		OutPath:      "./Lives",
+		DirTemplate:  DefaultDirTemplate,
+		FileTemplate: DefaultFileTemplate,
+		Downloader:   DownloaderNative,
+		Danmaku:      []string{DanmakuFormatXML},
+		Watchdog:     WatchdogConfig{StallTimeout: 60},
+	}
+}
 
-	file, err := ioutil.ReadFile(conf)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to read configuration file - %s\n", conf)
-		os.Exit(1)
+// Load build the config in layers: defaults, the file if not empty, DD_* variables of
+// environ, then override. The result is validated, problems are returned as Errors.
+func Load(conf string, environ []string, override func(*Config)) (*Config, error) {
+	var data []byte
+	if conf != "" {
+		file, err := ioutil.ReadFile(conf)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read configuration file - %s", conf)
+		}
+		data = file
 	}
 
-	// Parse yaml
-	err = yaml.Unmarshal(file, config)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Configuration file parsing failed - %s\n", conf)
-		os.Exit(1)
+	return load(data, environ, override)
+}
+
+// ParseConfig parse and validate a yaml config, unknown keys are errors
+func ParseConfig(data []byte) (*Config, error) {
+	return load(data, nil, nil)
+}
+
+func load(data []byte, environ []string, override func(*Config)) (*Config, error) {
+	config := Default()
+	errs := Errors{}
+
+	if err := yaml.Unmarshal(data, config); err != nil {
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return nil, Errors{yamlError(err.Error())}
+		}
+	}
+	// strict decoding drop rooms with unknown keys, so it only collect errors
+	if err := yaml.UnmarshalStrict(data, &Config{}); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, msg := range typeErr.Errors {
+				errs = append(errs, yamlError(msg))
+			}
+		}
 	}
 
-	return config
+	if err := config.ApplyEnv(environ); err != nil {
+		errs = append(errs, err.(Errors)...)
+	}
+	if override != nil {
+		override(config)
+	}
+
+	config.fillTemplate()
+	errs = append(errs, config.validate()...)
+	if len(errs) > 0 {
+		errs.locate(data)
+		return nil, errs
+	}
+
+	return config, nil
+}
+
+// Redacted return the config in yaml with tokens and secrets hidden
+func (c *Config) Redacted() ([]byte, error) {
+	config := *c
+	if config.HTTP.Token != "" {
+		config.HTTP.Token = redacted
+	}
+	config.Webhooks = make([]WebhookConfig, len(c.Webhooks))
+	for i, hook := range c.Webhooks {
+		if hook.Secret != "" {
+			hook.Secret = redacted
+		}
+		config.Webhooks[i] = hook
+	}
+
+	return yaml.Marshal(&config)
+}
+
+// fillTemplate set empty path templates to the default
+func (c *Config) fillTemplate() {
+	if c.DirTemplate == "" {
+		c.DirTemplate = DefaultDirTemplate
+	}
+	if c.FileTemplate == "" {
+		c.FileTemplate = DefaultFileTemplate
+	}
 }
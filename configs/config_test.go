@@ -0,0 +1,75 @@
+package configs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(conf, []byte(`interval: 15
+out_path: `+dir+`
+quality: 400
+http:
+  listen: 127.0.0.1:8080
+  token: secret
+webhooks:
+  - url: https://example.com/hook
+    secret: secret
+rooms:
+  - https://live.bilibili.com/1
+  - url: https://live.bilibili.com/2
+    name: two
+`), 0644)
+
+	// file over defaults, env over file, override over env
+	config, err := Load(conf, []string{"DD_QUALITY=250", "DD_DEBUG=1", "DD_INTERVAL=20"}, func(c *Config) {
+		c.Interval = 30
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != 30 || config.Quality != 250 || !config.Debug || config.OutPath != dir ||
+		config.Downloader != DownloaderNative || len(config.Rooms) != 2 {
+		t.Errorf("config = %+v", config)
+	}
+
+	if _, err := Load(conf, []string{"DD_INTERVAL=0"}, nil); err == nil || !strings.Contains(err.Error(), "interval") {
+		t.Errorf("invalid env = %v", err)
+	}
+	if _, err := Load(filepath.Join(dir, "missing.yml"), nil, nil); err == nil {
+		t.Error("missing file loaded")
+	}
+	if config, err := Load("", nil, nil); err != nil || config.Interval != Default().Interval {
+		t.Errorf("defaults = %+v, %v", config, err)
+	}
+
+	data, err := config.Redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), ": secret") || config.HTTP.Token != "secret" || config.Webhooks[0].Secret != "secret" {
+		t.Errorf("secrets not hidden:\n%s", data)
+	}
+	if !strings.Contains(string(data), "- https://live.bilibili.com/1\n") || !strings.Contains(string(data), "name: two\n") {
+		t.Errorf("rooms:\n%s", data)
+	}
+
+	// the output is a valid config
+	reload, err := ParseConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reload.Interval != 30 || len(reload.Rooms) != 2 || reload.Rooms[1].Name != "two" {
+		t.Errorf("reload = %+v", reload)
+	}
+}
@@ -0,0 +1,107 @@
+package configs
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// prefix of environment variables overriding the config
+const envPrefix = "DD_"
+
+// ApplyEnv set settings from DD_* variables of environ, named after the yaml keys like
+// DD_OUT_PATH and DD_HTTP_LISTEN. Lists like DD_ROOMS and DD_DANMAKU are comma separated.
+// Webhooks and room overrides are only set in the file. Invalid values are returned as Errors.
+func (c *Config) ApplyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, item := range environ {
+		if i := strings.Index(item, "="); i > 0 && strings.HasPrefix(item, envPrefix) {
+			env[item[:i]] = item[i+1:]
+		}
+	}
+
+	errs := Errors{}
+	applyEnv(reflect.ValueOf(c).Elem(), envPrefix, env, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// applyEnv set fields of struct v from env
+func applyEnv(v reflect.Value, prefix string, env map[string]string, errs *Errors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			applyEnv(field, name+"_", env, errs)
+			continue
+		}
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		if err := setValue(field, value); err != nil {
+			*errs = append(*errs, &FieldError{Field: name, Reason: err.Error()})
+		}
+	}
+}
+
+// setValue parse value into field
+func setValue(field reflect.Value, value string) error {
+	invalid := fmt.Errorf("invalid value %q", value)
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalid
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return invalid
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return invalid
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return invalid
+		}
+		field.SetFloat(n)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		switch field.Interface().(type) {
+		case []string:
+			field.Set(reflect.ValueOf(items))
+		case []Room:
+			field.Set(reflect.ValueOf(Rooms(items)))
+		default:
+			return fmt.Errorf("only set in the configuration file")
+		}
+	default:
+		return fmt.Errorf("only set in the configuration file")
+	}
+	return nil
+}
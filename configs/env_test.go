@@ -0,0 +1,54 @@
+package configs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	config := Default()
+	err := config.ApplyEnv([]string{
+		"DD_INTERVAL=30",
+		"DD_DEBUG=true",
+		"DD_OUT_PATH=/data",
+		"DD_QUALITY=-1",
+		"DD_DANMAKU=xml, ass",
+		"DD_ROOMS=https://live.bilibili.com/1,https://live.bilibili.com/2",
+		"DD_HTTP_LISTEN=:8080",
+		"DD_ASS_OPACITY=0.5",
+		"DD_HOOKS_LIVE_END=echo end",
+		"DD_HOOK_EVENT=live_start",
+		"DD_HOOK_DANMAKU=0",
+		"PATH=/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.Interval = 30
+	want.Debug = true
+	want.OutPath = "/data"
+	want.Quality = -1
+	want.Danmaku = []string{"xml", "ass"}
+	want.Rooms = []Room{{URL: "https://live.bilibili.com/1"}, {URL: "https://live.bilibili.com/2"}}
+	want.HTTP.Listen = ":8080"
+	want.ASS.Opacity = 0.5
+	want.Hooks.LiveEnd = []string{"echo end"}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+
+	err = Default().ApplyEnv([]string{
+		"DD_INTERVAL=-1",
+		"DD_DEBUG=maybe",
+		"DD_WEBHOOKS=https://example.com",
+	})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("err = %v, want 3 errors", err)
+	}
+	if errs[1].Error() != `DD_INTERVAL: invalid value "-1"` {
+		t.Errorf("error = %s", errs[1].Error())
+	}
+}
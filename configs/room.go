@@ -0,0 +1,160 @@
+package configs
+
+import (
+	"net/url"
+	"reflect"
+)
+
+// Room is a live room in config, a plain url or a mapping overriding global settings,
+// zero fields fall back to the global config
+type Room struct {
+	URL string `yaml:"url"`
+	// Name is an alias shown in the dashboard and path templates, default the author
+	Name string `yaml:"name,omitempty"`
+	// Enabled false keep the room in config without monitoring, default true
+	Enabled         *bool      `yaml:"enabled,omitempty"`
+	Interval        uint16     `yaml:"interval,omitempty"`
+	OutPath         string     `yaml:"out_path,omitempty"`
+	DirTemplate     string     `yaml:"dir_template,omitempty"`
+	FileTemplate    string     `yaml:"file_template,omitempty"`
+	Downloader      string     `yaml:"downloader,omitempty"`
+	Quality         *int64     `yaml:"quality,omitempty"`
+	CDN             *string    `yaml:"cdn,omitempty"`
+	Danmaku         *bool      `yaml:"danmaku,omitempty"`
+	SegmentDuration *uint32    `yaml:"segment_duration,omitempty"`
+	SegmentSize     *int64     `yaml:"segment_size,omitempty"`
+	SplitOnTitle    *bool      `yaml:"split_on_title_change,omitempty"`
+	Hooks           HookConfig `yaml:"hooks,omitempty"`
+}
+
+// UnmarshalYAML accept a url string or a mapping
+func (r *Room) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var u string
+	if err := unmarshal(&u); err == nil {
+		*r = Room{URL: u}
+		return nil
+	}
+
+	// without methods to not recurse
+	type room Room
+	var value room
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	*r = Room(value)
+	return nil
+}
+
+// MarshalYAML write a room without overrides as its url
+func (r Room) MarshalYAML() (interface{}, error) {
+	if reflect.DeepEqual(r, Room{URL: r.URL}) {
+		return r.URL, nil
+	}
+
+	type room Room
+	return room(r), nil
+}
+
+// Rooms return rooms of urls
+func Rooms(urls []string) []Room {
+	rooms := make([]Room, 0, len(urls))
+	for _, u := range urls {
+		rooms = append(rooms, Room{URL: u})
+	}
+	return rooms
+}
+
+// IsEnabled return false if the room is disabled
+func (r Room) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// DanmakuEnabled return false if danmaku of the room is not recorded
+func (r Room) DanmakuEnabled() bool {
+	return r.Danmaku == nil || *r.Danmaku
+}
+
+// Room return the room of url in config, or a room without overrides
+func (c *Config) Room(liveURL string) Room {
+	key := normalizeURL(liveURL)
+	for _, room := range c.Rooms {
+		if normalizeURL(room.URL) == key {
+			return room
+		}
+	}
+
+	return Room{URL: liveURL}
+}
+
+// ForRoom return a copy of config with overrides of room applied
+func (c *Config) ForRoom(room Room) *Config {
+	config := *c
+	if room.Interval > 0 {
+		config.Interval = room.Interval
+	}
+	if room.OutPath != "" {
+		config.OutPath = room.OutPath
+	}
+	if room.DirTemplate != "" {
+		config.DirTemplate = room.DirTemplate
+	}
+	if room.FileTemplate != "" {
+		config.FileTemplate = room.FileTemplate
+	}
+	if room.Downloader != "" {
+		config.Downloader = room.Downloader
+	}
+	if room.Quality != nil {
+		config.Quality = *room.Quality
+	}
+	if room.CDN != nil {
+		config.CDN = *room.CDN
+	}
+	if room.SegmentDuration != nil {
+		config.SegmentDuration = *room.SegmentDuration
+	}
+	if room.SegmentSize != nil {
+		config.SegmentSize = *room.SegmentSize
+	}
+	if room.SplitOnTitle != nil {
+		config.SplitOnTitle = *room.SplitOnTitle
+	}
+	config.Hooks = mergeHooks(c.Hooks, room.Hooks)
+
+	return &config
+}
+
+// mergeHooks return global hooks with commands of events set by room replaced
+func mergeHooks(global, room HookConfig) HookConfig {
+	pick := func(global, room []string) []string {
+		if len(room) > 0 {
+			return room
+		}
+		return global
+	}
+
+	hooks := HookConfig{
+		Timeout:         global.Timeout,
+		LiveStart:       pick(global.LiveStart, room.LiveStart),
+		RecordStart:     pick(global.RecordStart, room.RecordStart),
+		RecordFileOpen:  pick(global.RecordFileOpen, room.RecordFileOpen),
+		RecordFileClose: pick(global.RecordFileClose, room.RecordFileClose),
+		RecordStop:      pick(global.RecordStop, room.RecordStop),
+		LiveEnd:         pick(global.LiveEnd, room.LiveEnd),
+		Error:           pick(global.Error, room.Error),
+	}
+	if room.Timeout > 0 {
+		hooks.Timeout = room.Timeout
+	}
+	return hooks
+}
+
+// normalizeURL return url as the live api report it
+func normalizeURL(liveURL string) string {
+	u, err := url.Parse(liveURL)
+	if err != nil {
+		return liveURL
+	}
+	return u.String()
+}
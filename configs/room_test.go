@@ -0,0 +1,92 @@
+package configs
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRoom(t *testing.T) {
+	data := `
+interval: 15
+out_path: Live
+quality: 10000
+cdn: cn-gotcha
+segment_size: 1024
+danmaku: [xml]
+hooks:
+  timeout: 10
+  live_start: [global start]
+  live_end: [global end]
+rooms:
+  - https://live.bilibili.com/1
+  - url: https://live.bilibili.com/2
+    name: two
+    interval: 60
+    out_path: Two
+    quality: 0
+    cdn: ""
+    segment_size: 0
+    danmaku: false
+    dir_template: '{{.Name}}'
+    downloader: ffmpeg
+    hooks:
+      live_start: [room start]
+  - url: https://live.bilibili.com/3
+    enabled: false
+`
+	config, err := ParseConfig([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Rooms) != 3 {
+		t.Fatalf("rooms %+v", config.Rooms)
+	}
+
+	one := config.Room("https://live.bilibili.com/1")
+	if one.URL != "https://live.bilibili.com/1" || !one.IsEnabled() || !one.DanmakuEnabled() {
+		t.Errorf("room 1 = %+v", one)
+	}
+	if got := config.ForRoom(one); !reflect.DeepEqual(got, config) {
+		t.Errorf("room 1 config = %+v, want the global", got)
+	}
+
+	two := config.Room("https://live.bilibili.com/2")
+	if two.Name != "two" || two.DanmakuEnabled() {
+		t.Errorf("room 2 = %+v", two)
+	}
+	got := config.ForRoom(two)
+	want := *config
+	want.Interval = 60
+	want.OutPath = "Two"
+	want.Quality = 0
+	want.CDN = ""
+	want.SegmentSize = 0
+	want.DirTemplate = "{{.Name}}"
+	want.Downloader = DownloaderFFmpeg
+	want.Hooks = HookConfig{
+		Timeout:   10,
+		LiveStart: []string{"room start"},
+		LiveEnd:   []string{"global end"},
+	}
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("room 2 config = %+v, want %+v", got, want)
+	}
+
+	if config.Room("https://live.bilibili.com/3").IsEnabled() {
+		t.Error("room 3 enabled")
+	}
+	if room := config.Room("https://live.bilibili.com/4"); room.URL != "https://live.bilibili.com/4" || room.Name != "" {
+		t.Errorf("room not in config = %+v", room)
+	}
+
+	if err := yaml.Unmarshal([]byte("rooms:\n  - [https://live.bilibili.com/1]\n"), &Config{}); err == nil {
+		t.Error("room of a list parsed")
+	}
+
+	config.Rooms = []Room{{URL: "https://live.bilibili.com/1", FileTemplate: "{{.Nothing}}"}}
+	if err := config.Validate(); err == nil {
+		t.Error("invalid room template passed")
+	}
+}
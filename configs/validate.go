@@ -0,0 +1,312 @@
+package configs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/utils"
+)
+
+// FieldError is a problem of a config field
+type FieldError struct {
+	// Field path like rooms[1].url, empty if unknown
+	Field string
+	// Line in the configuration file, 0 if unknown
+	Line   int
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	msg := e.Reason
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	return msg
+}
+
+// Errors is every problem found in a config
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate check the config, return Errors with all problems or nil
+func (c *Config) Validate() error {
+	errs := c.validate()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (c *Config) validate() Errors {
+	errs := Errors{}
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Interval == 0 {
+		add("interval", "must be greater than 0")
+	}
+	if err := writable(c.OutPath); err != nil {
+		add("out_path", "%s", err.Error())
+	}
+	if err := checkTemplate(c.DirTemplate, c.FileTemplate); err != nil {
+		add("dir_template", "%s", err.Error())
+	}
+	switch c.Downloader {
+	case "", DownloaderNative, DownloaderFFmpeg:
+	default:
+		add("downloader", "unknown downloader %q, want %s or %s", c.Downloader, DownloaderNative, DownloaderFFmpeg)
+	}
+	for i, format := range c.Danmaku {
+		switch format {
+		case DanmakuFormatXML, DanmakuFormatASS, DanmakuFormatJSONL:
+		default:
+			add(fmt.Sprintf("danmaku[%d]", i), "unknown danmaku format %q", format)
+		}
+	}
+	for i, step := range c.PostProcess.Steps {
+		switch step {
+		case StepFixFLV, StepRemuxMP4, StepRemuxMKV, StepConcat, StepASS, StepDeleteSource:
+		default:
+			add(fmt.Sprintf("postprocess.steps[%d]", i), "unknown step %q", step)
+		}
+	}
+	// the api can remove rooms and read recordings
+	if c.HTTP.Listen != "" && c.HTTP.Token == "" && !loopback(c.HTTP.Listen) {
+		add("http.token", "required when http.listen %q is not a loopback address", c.HTTP.Listen)
+	}
+	for i, hook := range c.Webhooks {
+		if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add(fmt.Sprintf("webhooks[%d].url", i), "invalid url %q", hook.URL)
+		}
+	}
+
+	seen := make(map[string]int)
+	for i, room := range c.Rooms {
+		field := fmt.Sprintf("rooms[%d]", i)
+		if room.URL == "" {
+			add(field+".url", "required")
+			continue
+		}
+		u, err := url.Parse(room.URL)
+		if err != nil || u.Host == "" {
+			add(field+".url", "invalid url %q", room.URL)
+			continue
+		}
+		if api.Match(u) == nil {
+			add(field+".url", "platform of %s not supported", room.URL)
+		}
+		if first, ok := seen[u.String()]; ok {
+			add(field+".url", "duplicate of rooms[%d]", first)
+		} else {
+			seen[u.String()] = i
+		}
+
+		if room.OutPath != "" {
+			if err := writable(room.OutPath); err != nil {
+				add(field+".out_path", "%s", err.Error())
+			}
+		}
+		switch room.Downloader {
+		case "", DownloaderNative, DownloaderFFmpeg:
+		default:
+			add(field+".downloader", "unknown downloader %q, want %s or %s", room.Downloader, DownloaderNative, DownloaderFFmpeg)
+		}
+		if room.DirTemplate != "" || room.FileTemplate != "" {
+			config := c.ForRoom(room)
+			if err := checkTemplate(config.DirTemplate, config.FileTemplate); err != nil {
+				add(field+".dir_template", "%s", err.Error())
+			}
+		}
+	}
+
+	return errs
+}
+
+// loopback return true if a listen address only accept local connections
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkTemplate check path templates, empty ones are the default
+func checkTemplate(dir, file string) error {
+	if dir == "" {
+		dir = DefaultDirTemplate
+	}
+	if file == "" {
+		file = DefaultFileTemplate
+	}
+
+	_, err := utils.NewPathTemplate(dir, file)
+	return err
+}
+
+// writable check files can be created in dir, a missing dir is checked by its parent
+func writable(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", path)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return err
+		}
+		path = parent
+	}
+
+	file, err := ioutil.TempFile(path, ".dd-check")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", path)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return nil
+}
+
+// messages of yaml errors
+var (
+	yamlLineRe    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlUnknownRe = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// yamlError convert a message of yaml to a field error
+func yamlError(msg string) *FieldError {
+	e := &FieldError{Reason: msg}
+	if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+		e.Line, _ = strconv.Atoi(m[1])
+		e.Reason = m[2]
+	}
+	if m := yamlUnknownRe.FindStringSubmatch(e.Reason); m != nil {
+		e.Field = m[1]
+		e.Reason = "unknown key"
+	}
+	return e
+}
+
+// locate fill unknown lines from the yaml document and sort errors by line
+func (e Errors) locate(data []byte) {
+	entries := yamlEntries(data)
+	for _, err := range e {
+		if err.Line == 0 && err.Field != "" {
+			err.Line = lineOf(entries, err.Field)
+		}
+	}
+	sort.SliceStable(e, func(i, j int) bool {
+		return e[i].Line < e[j].Line
+	})
+}
+
+// yamlEntry is a key or a sequence item of a block style yaml line
+type yamlEntry struct {
+	indent int
+	text   string
+	line   int
+}
+
+// yamlEntries split lines to entries, "- key: v" is an item and a key inside it
+func yamlEntries(data []byte) []yamlEntry {
+	entries := []yamlEntry{}
+	for i, text := range strings.Split(string(data), "\n") {
+		content := strings.TrimLeft(text, " ")
+		indent := len(text) - len(content)
+		content = strings.TrimRight(content, " \r")
+		for content != "" && content[0] != '#' {
+			if content != "-" && !strings.HasPrefix(content, "- ") {
+				entries = append(entries, yamlEntry{indent, content, i + 1})
+				break
+			}
+			entries = append(entries, yamlEntry{indent, "-", i + 1})
+			rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			indent += len(content) - len(rest)
+			content = rest
+		}
+	}
+	return entries
+}
+
+// lineOf return the line of a field path like rooms[1].url, the deepest found on a miss
+func lineOf(entries []yamlEntry, field string) int {
+	line := 0
+	start, end, parent := 0, len(entries), -1
+	for _, token := range strings.FieldsFunc(field, func(r rune) bool { return r == '.' || r == '[' }) {
+		index := -1
+		if strings.HasSuffix(token, "]") {
+			index, _ = strconv.Atoi(strings.TrimSuffix(token, "]"))
+		}
+
+		// children are the entries with the indent of the first one
+		child := -1
+		found := -1
+		for i := start; i < end; i++ {
+			if entries[i].indent <= parent {
+				break
+			}
+			if child < 0 {
+				child = entries[i].indent
+			}
+			if entries[i].indent != child {
+				continue
+			}
+			if index >= 0 && entries[i].text == "-" {
+				if index == 0 {
+					found = i
+					break
+				}
+				index--
+			} else if index < 0 && (strings.HasPrefix(entries[i].text, token+":")) {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return line
+		}
+
+		line = entries[found].line
+		start, parent = found+1, child
+		end = len(entries)
+	}
+	return line
+}
@@ -0,0 +1,142 @@
+package configs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+
+	data := `interval: 0
+out_path: ` + file + `
+downloader: curl
+danmaku: [xml, srt]
+unknown: 1
+postprocess:
+  steps:
+    - remux_mp4
+    - upload
+rooms:
+  - https://live.bilibili.com/1
+  - url: "%zz"
+  - url: https://live.bilibili.com/1
+    name: again
+    foo: bar
+  - name: no url
+  - https://example.com/live
+  - url: https://www.youtube.com/channel/1/live
+    out_path: ` + filepath.Join(dir, "new", "dir") + `
+    file_template: '{{.Nothing}}'
+http:
+  listen: ":8080"
+`
+	_, err = ParseConfig([]byte(data))
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("err = %v, want Errors", err)
+	}
+
+	want := []string{
+		"line 1: interval: must be greater than 0",
+		"line 2: out_path: " + file + " is not a directory",
+		"line 3: downloader: unknown downloader \"curl\", want native or ffmpeg",
+		"line 4: danmaku[1]: unknown danmaku format \"srt\"",
+		"line 5: unknown: unknown key",
+		"line 9: postprocess.steps[1]: unknown step \"upload\"",
+		"line 12: rooms[1].url: invalid url \"%zz\"",
+		"line 13: rooms[2].url: duplicate of rooms[0]",
+		"line 15: foo: unknown key",
+		"line 16: rooms[3].url: required",
+		"line 17: rooms[4].url: platform of https://example.com/live not supported",
+		"line 18: rooms[5].dir_template: ",
+		"line 21: http.token: required when http.listen \":8080\" is not a loopback address",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("errors:\n%s", errs.Error())
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), want[i]) {
+			t.Errorf("error %d = %s, want %s", i, err.Error(), want[i])
+		}
+	}
+
+	if _, err := ParseConfig([]byte("interval: 10\nrooms: [\n")); err == nil || !strings.HasPrefix(err.Error(), "line ") {
+		t.Errorf("syntax error = %v", err)
+	}
+
+	config, err := ParseConfig([]byte("interval: 10\nout_path: " + filepath.Join(dir, "out") + "\nrooms:\n  - https://live.bilibili.com/1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DirTemplate != DefaultDirTemplate || config.FileTemplate != DefaultFileTemplate {
+		t.Errorf("templates %q %q, want the default", config.DirTemplate, config.FileTemplate)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); !os.IsNotExist(err) {
+		t.Error("validate created the output path")
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"192.168.1.2:8080", false},
+		{"8080", false},
+	}
+	for _, test := range tests {
+		if got := loopback(test.addr); got != test.want {
+			t.Errorf("loopback(%s) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestLineOf(t *testing.T) {
+	entries := yamlEntries([]byte(`a: 1
+# b: 2
+b:
+  c:
+    - x
+    -   d: 1
+        e: 2
+    - - f
+      - g
+  h: [1, 2]
+`))
+
+	tests := []struct {
+		field string
+		line  int
+	}{
+		{"a", 1},
+		{"b", 3},
+		{"b.c", 4},
+		{"b.c[0]", 5},
+		{"b.c[1].e", 7},
+		{"b.c[2][1]", 9},
+		{"b.h", 10},
+		{"b.h[1]", 10},
+		{"b.c[3]", 4},
+		{"e", 0},
+	}
+	for _, test := range tests {
+		if line := lineOf(entries, test.field); line != test.line {
+			t.Errorf("lineOf(%s) = %d, want %d", test.field, line, test.line)
+		}
+	}
+}
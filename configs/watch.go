@@ -0,0 +1,43 @@
+package configs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Watch poll the file every interval and call changed when its content changed,
+// block until ctx done
+func Watch(ctx context.Context, path string, interval time.Duration, changed func()) {
+	last, _ := ioutil.ReadFile(path)
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+			continue
+		}
+		modTime, size = info.ModTime(), info.Size()
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil || bytes.Equal(content, last) {
+			continue
+		}
+		last = content
+		changed()
+	}
+}
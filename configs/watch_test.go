@@ -0,0 +1,58 @@
+package configs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(path, []byte("interval: 10\n"), 0644)
+
+	changed := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Watch(ctx, path, 10*time.Millisecond, func() { changed <- struct{}{} })
+		close(done)
+	}()
+
+	wait := func(want bool) {
+		select {
+		case <-changed:
+			if !want {
+				t.Error("unexpected change")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Error("change not seen")
+			}
+		}
+	}
+
+	// same content with a new time is not a change
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	wait(false)
+
+	ioutil.WriteFile(path, []byte("interval: 20\n"), 0644)
+	wait(true)
+
+	os.Remove(path)
+	wait(false)
+	ioutil.WriteFile(path, []byte("interval: 30\n"), 0644)
+	wait(true)
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,433 @@
+package danmaku
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/configs"
+)
+
+// danmaku display mode, same as bilibili xml
+const (
+	modeScroll = 1
+	modeBottom = 4
+	modeTop    = 5
+)
+
+// ASSOptions style of ass subtitle
+type ASSOptions struct {
+	Width    int
+	Height   int
+	FontName string
+	FontSize int
+	// time a danmaku stay on screen
+	Duration time.Duration
+	// 0 is transparent, 1 is opaque
+	Opacity float64
+}
+
+// DefaultASSOptions return options for a 1080p video
+func DefaultASSOptions() ASSOptions {
+	return ASSOptions{
+		Width:    1920,
+		Height:   1080,
+		FontName: "Microsoft YaHei",
+		FontSize: 40,
+		Duration: 10 * time.Second,
+		Opacity:  0.8,
+	}
+}
+
+// NewASSOptions return options from config, zero fields use the default
+func NewASSOptions(conf configs.ASSConfig) ASSOptions {
+	opts := DefaultASSOptions()
+	if conf.Width > 0 && conf.Height > 0 {
+		opts.Width, opts.Height = conf.Width, conf.Height
+	}
+	if conf.FontName != "" {
+		opts.FontName = conf.FontName
+	}
+	if conf.FontSize > 0 {
+		opts.FontSize = conf.FontSize
+	}
+	if conf.Duration > 0 {
+		opts.Duration = time.Duration(conf.Duration * float64(time.Second))
+	}
+	if conf.Opacity > 0 && conf.Opacity <= 1 {
+		opts.Opacity = conf.Opacity
+	}
+
+	return opts
+}
+
+// assItem is a danmaku to be placed on screen
+type assItem struct {
+	Start time.Duration
+	Text  string
+	Mode  int
+	Color int
+	User  string
+}
+
+// assRow is the last scrolling danmaku in a row
+type assRow struct {
+	start time.Duration
+	width int
+	used  bool
+}
+
+// assLayout place danmaku into rows and avoid collision
+type assLayout struct {
+	opts      ASSOptions
+	rowHeight int
+	scroll    []assRow
+	top       []time.Duration
+	bottom    []time.Duration
+}
+
+func newASSLayout(opts ASSOptions) *assLayout {
+	rowHeight := opts.FontSize + opts.FontSize/5
+	rows := opts.Height / rowHeight
+	if rows < 1 {
+		rows = 1
+	}
+
+	return &assLayout{
+		opts:      opts,
+		rowHeight: rowHeight,
+		scroll:    make([]assRow, rows),
+		top:       make([]time.Duration, rows),
+		bottom:    make([]time.Duration, rows),
+	}
+}
+
+// textWidth estimate the rendered width, wide characters take a full font size
+func (l *assLayout) textWidth(text string) int {
+	width := 0
+	for _, r := range text {
+		if r < 0x2e80 {
+			width += l.opts.FontSize / 2
+		} else {
+			width += l.opts.FontSize
+		}
+	}
+	return width
+}
+
+// scrollRow return a row that the danmaku neither overlap the previous tail
+// nor catch up with it before it leaves, the earliest free row if all busy
+func (l *assLayout) scrollRow(start time.Duration, width int) int {
+	screen := float64(l.opts.Width)
+	duration := l.opts.Duration.Seconds()
+	best, bestFree := 0, time.Duration(-1)
+
+	for i, row := range l.scroll {
+		if !row.used {
+			return i
+		}
+
+		// time the previous tail enter the screen
+		tailIn := row.start + time.Duration(duration*float64(row.width)/(screen+float64(row.width))*float64(time.Second))
+		// time the new head reach the left edge
+		headOut := start + time.Duration(duration*screen/(screen+float64(width))*float64(time.Second))
+
+		if start >= tailIn && headOut >= row.start+l.opts.Duration {
+			return i
+		}
+		if bestFree < 0 || tailIn < bestFree {
+			best, bestFree = i, tailIn
+		}
+	}
+
+	return best
+}
+
+// fixedRow return the first free row of top or bottom lane
+func (l *assLayout) fixedRow(rows []time.Duration, start time.Duration) int {
+	best := 0
+	for i, free := range rows {
+		if free <= start {
+			return i
+		}
+		if free < rows[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// Place return a dialogue line for item
+func (l *assLayout) Place(item assItem) string {
+	text := assEscape(item.Text)
+	width := l.textWidth(item.Text)
+	end := item.Start + l.opts.Duration
+
+	var effect string
+	switch item.Mode {
+	case modeTop:
+		row := l.fixedRow(l.top, item.Start)
+		l.top[row] = end
+		effect = fmt.Sprintf("\\an8\\pos(%d,%d)", l.opts.Width/2, row*l.rowHeight)
+	case modeBottom:
+		row := l.fixedRow(l.bottom, item.Start)
+		l.bottom[row] = end
+		effect = fmt.Sprintf("\\an2\\pos(%d,%d)", l.opts.Width/2, l.opts.Height-row*l.rowHeight)
+	default:
+		row := l.scrollRow(item.Start, width)
+		l.scroll[row] = assRow{start: item.Start, width: width, used: true}
+		y := row * l.rowHeight
+		effect = fmt.Sprintf("\\move(%d,%d,%d,%d)", l.opts.Width, y, -width, y)
+	}
+
+	if color := item.Color & 0xffffff; color != 0xffffff {
+		// ass color is BGR
+		effect += fmt.Sprintf("\\c&H%02X%02X%02X&", color&0xff, color>>8&0xff, color>>16)
+	}
+
+	return fmt.Sprintf("Dialogue: 0,%s,%s,Default,,0,0,0,,{%s}%s\n",
+		assTime(item.Start), assTime(end), effect, text)
+}
+
+// assHeader return script info, style and events format
+func assHeader(opts ASSOptions) string {
+	alpha := int((1 - opts.Opacity) * 255)
+	if alpha < 0 {
+		alpha = 0
+	} else if alpha > 255 {
+		alpha = 255
+	}
+	outline := opts.FontSize / 20
+	if outline < 1 {
+		outline = 1
+	}
+
+	return fmt.Sprintf(`[Script Info]
+ScriptType: v4.00+
+Collisions: Normal
+PlayResX: %d
+PlayResY: %d
+WrapStyle: 2
+ScaledBorderAndShadow: yes
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Default,%s,%d,&H%02XFFFFFF,&H%02XFFFFFF,&H%02X000000,&H%02X000000,0,0,0,0,100,100,0,0,1,%d,0,7,0,0,0,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`, opts.Width, opts.Height, opts.FontName, opts.FontSize, alpha, alpha, alpha, alpha, outline)
+}
+
+// assTime format duration as H:MM:SS.cc
+func assTime(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	cs := d.Nanoseconds() / 1e7
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+// assEscape replace characters which start an override block or a line break
+func assEscape(text string) string {
+	return strings.NewReplacer(
+		"\\", "＼",
+		"{", "｛",
+		"}", "｝",
+		"\r\n", " ",
+		"\n", " ",
+		"\r", " ",
+	).Replace(text)
+}
+
+// ASSWriter write danmaku as ass subtitle during recording
+type ASSWriter struct {
+	file   *os.File
+	layout *assLayout
+}
+
+// NewASSWriter create an ass file
+func NewASSWriter(path string, opts ASSOptions) (*ASSWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.WriteString(assHeader(opts)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &ASSWriter{
+		file:   file,
+		layout: newASSLayout(opts),
+	}, nil
+}
+
+// Write chat as scrolling danmaku and super chat at top, ignore others
+func (a *ASSWriter) Write(msg *api.DanmakuMessage, offset time.Duration) error {
+	item := assItem{
+		Start: offset,
+		Mode:  modeScroll,
+		Color: 0xffffff,
+	}
+
+	switch msg.Type {
+	case api.DanmakuTypeChat:
+		item.Text = msg.Content
+	case api.DanmakuTypeSuperChat:
+		item.Text = fmt.Sprintf("[%.2f %s] %s: %s", msg.Price, msg.Currency, msg.UserName, msg.Content)
+		item.Mode = modeTop
+		item.Color = 0xffd700
+	default:
+		return nil
+	}
+
+	_, err := a.file.WriteString(a.layout.Place(item))
+	return err
+}
+
+// Mark is not shown in subtitles
+func (a *ASSWriter) Mark(marker Marker, content string, offset time.Duration) error {
+	return nil
+}
+
+// Close close the file
+func (a *ASSWriter) Close() error {
+	return a.file.Close()
+}
+
+// ConvertXMLToASS generate ass from a danmaku xml, a truncated xml is read until broken.
+// Return the count of danmaku written.
+func ConvertXMLToASS(src, dst string, opts ASSOptions) (int, error) {
+	return ConvertXMLsToASS([]string{src}, []time.Duration{0}, dst, opts)
+}
+
+// ConvertXMLsToASS merge danmaku xml of concatenated videos into one ass,
+// danmaku of srcs[i] is delayed by offsets[i].
+func ConvertXMLsToASS(srcs []string, offsets []time.Duration, dst string, opts ASSOptions) (int, error) {
+	items := []assItem{}
+	for i, src := range srcs {
+		in, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		xmlItems, err := readXMLItems(in)
+		in.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, item := range xmlItems {
+			if i < len(offsets) {
+				item.Start += offsets[i]
+			}
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Start < items[j].Start
+	})
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	if _, err := out.WriteString(assHeader(opts)); err != nil {
+		return 0, err
+	}
+	layout := newASSLayout(opts)
+	for _, item := range items {
+		if _, err := out.WriteString(layout.Place(item)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(items), nil
+}
+
+// readXMLItems read chat and super chat from xml
+func readXMLItems(r io.Reader) ([]assItem, error) {
+	items := []assItem{}
+	decoder := xml.NewDecoder(r)
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			// truncated file, keep what we got
+			if len(items) > 0 || err == io.ErrUnexpectedEOF {
+				return items, nil
+			}
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "d":
+			chat := xmlChat{}
+			if err := decoder.DecodeElement(&chat, &start); err != nil {
+				return items, nil
+			}
+			if item, ok := parseChatItem(chat); ok {
+				items = append(items, item)
+			}
+		case "sc":
+			sc := xmlSuperChat{}
+			if err := decoder.DecodeElement(&sc, &start); err != nil {
+				return items, nil
+			}
+			ts, _ := strconv.ParseFloat(sc.TS, 64)
+			items = append(items, assItem{
+				Start: time.Duration(ts * float64(time.Second)),
+				Text:  fmt.Sprintf("[%s %s] %s: %s", sc.Price, sc.Currency, sc.User, sc.Content),
+				Mode:  modeTop,
+				Color: 0xffd700,
+				User:  sc.User,
+			})
+		}
+	}
+}
+
+// parseChatItem parse p attribute "offset,mode,size,color,..."
+func parseChatItem(chat xmlChat) (assItem, bool) {
+	p := strings.Split(chat.P, ",")
+	if len(p) < 4 || utf8.RuneCountInString(chat.Content) == 0 {
+		return assItem{}, false
+	}
+
+	ts, err := strconv.ParseFloat(p[0], 64)
+	if err != nil {
+		return assItem{}, false
+	}
+	mode, _ := strconv.Atoi(p[1])
+	color, err := strconv.Atoi(p[3])
+	if err != nil {
+		color = 0xffffff
+	}
+	if mode != modeTop && mode != modeBottom {
+		mode = modeScroll
+	}
+
+	return assItem{
+		Start: time.Duration(ts * float64(time.Second)),
+		Text:  chat.Content,
+		Mode:  mode,
+		Color: color,
+		User:  chat.User,
+	}, true
+}
@@ -0,0 +1,150 @@
+package danmaku
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+func TestASSLayout(t *testing.T) {
+	opts := DefaultASSOptions()
+	layout := newASSLayout(opts)
+
+	// same time go to different rows
+	first := layout.Place(assItem{Start: 0, Text: "第一条弹幕", Mode: modeScroll, Color: 0xffffff})
+	second := layout.Place(assItem{Start: 0, Text: "第二条弹幕", Mode: modeScroll, Color: 0xffffff})
+	if !strings.Contains(first, "\\move(1920,0,") || !strings.Contains(second, "\\move(1920,48,") {
+		t.Errorf("want row 0 and 1, got\n%s%s", first, second)
+	}
+
+	// previous tail entered and never caught up, reuse row 0
+	third := layout.Place(assItem{Start: 5 * time.Second, Text: "ok", Mode: modeScroll, Color: 0xffffff})
+	if !strings.Contains(third, "\\move(1920,0,") {
+		t.Errorf("want row 0, got %s", third)
+	}
+
+	// a long text move faster and would catch up a short one
+	long := strings.Repeat("长", 40)
+	layout = newASSLayout(opts)
+	layout.Place(assItem{Start: 0, Text: "短", Mode: modeScroll, Color: 0xffffff})
+	if line := layout.Place(assItem{Start: time.Second, Text: long, Mode: modeScroll, Color: 0xffffff}); strings.Contains(line, "\\move(1920,0,") {
+		t.Errorf("long danmaku should not catch up a short one: %s", line)
+	}
+
+	top := layout.Place(assItem{Start: 0, Text: "top", Mode: modeTop, Color: 0xff0000})
+	if !strings.Contains(top, "\\an8\\pos(960,0)") || !strings.Contains(top, "\\c&H0000FF&") {
+		t.Errorf("unexpected top line %s", top)
+	}
+	top = layout.Place(assItem{Start: time.Second, Text: "top", Mode: modeTop, Color: 0xffffff})
+	if !strings.Contains(top, "\\an8\\pos(960,48)") || strings.Contains(top, "\\c") {
+		t.Errorf("unexpected top line %s", top)
+	}
+	bottom := layout.Place(assItem{Start: 0, Text: "bottom", Mode: modeBottom, Color: 0xffffff})
+	if !strings.Contains(bottom, "\\an2\\pos(960,1080)") {
+		t.Errorf("unexpected bottom line %s", bottom)
+	}
+}
+
+func TestASSFormat(t *testing.T) {
+	if s := assTime(3723*time.Second + 450*time.Millisecond); s != "1:02:03.45" {
+		t.Errorf("assTime = %s", s)
+	}
+	if s := assEscape("{\\b1}a\nb"); s != "｛＼b1｝a b" {
+		t.Errorf("assEscape = %s", s)
+	}
+
+	opts := DefaultASSOptions()
+	opts.Opacity = 0.5
+	if header := assHeader(opts); !strings.Contains(header, "Style: Default,Microsoft YaHei,40,&H7FFFFFFF,") {
+		t.Errorf("unexpected style in header\n%s", header)
+	}
+}
+
+func TestConvertXMLToASS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "danmaku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "test.xml")
+	dst := filepath.Join(dir, "test.ass")
+
+	writer, err := NewXMLWriter(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(&api.DanmakuMessage{Type: api.DanmakuTypeChat, Content: "second"}, 2*time.Second)
+	writer.Write(&api.DanmakuMessage{Type: api.DanmakuTypeChat, Content: "first"}, time.Second)
+	writer.Write(&api.DanmakuMessage{Type: api.DanmakuTypeGift, GiftName: "gift"}, time.Second)
+	writer.Write(&api.DanmakuMessage{Type: api.DanmakuTypeSuperChat, Content: "sc", UserName: "u", Price: 30, Currency: "CNY"}, 3*time.Second)
+	// leave the file truncated without footer
+	writer.file.Close()
+	ioutil.WriteFile(filepath.Join(dir, "bottom.xml"), []byte(`<i><d p="4.5,4,25,16711680,0,0,0,0">bottom</d></i>`), 0644)
+
+	count, err := ConvertXMLToASS(src, dst, DefaultASSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("want 3 danmaku, got %d", count)
+	}
+
+	data, _ := ioutil.ReadFile(dst)
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Dialogue:") {
+			lines = append(lines, line)
+		}
+	}
+	want := []string{"0:00:01.00,0:00:11.00,Default,,0,0,0,,{\\move(1920,0,-100,0)}first",
+		"0:00:02.00,0:00:12.00,Default,,0,0,0,,{\\move(1920,0,-120,0)}second",
+		"0:00:03.00,0:00:13.00,Default,,0,0,0,,{\\an8\\pos(960,0)\\c&H00D7FF&}[30.00 CNY] u: sc"}
+	if len(lines) != len(want) {
+		t.Fatalf("want %d dialogues, got\n%s", len(want), strings.Join(lines, "\n"))
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("dialogue %d = %s", i, line)
+		}
+	}
+
+	if _, err := ConvertXMLToASS(filepath.Join(dir, "bottom.xml"), dst, DefaultASSOptions()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(dst)
+	if !strings.Contains(string(data), "{\\an2\\pos(960,1080)\\c&H0000FF&}bottom") {
+		t.Errorf("bottom danmaku not converted\n%s", data)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "danmaku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "record")
+
+	writer, err := Open(base, []string{"xml", "ass", "srt"}, DefaultASSOptions())
+	if err == nil {
+		t.Error("want error for unknown format")
+	}
+	if err := writer.Write(&api.DanmakuMessage{Type: api.DanmakuTypeChat, Content: "hi"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{".xml", ".ass"} {
+		data, _ := ioutil.ReadFile(base + ext)
+		if !strings.Contains(string(data), "hi") {
+			t.Errorf("%s not written", ext)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package danmaku
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/configs"
+)
+
+// bytes read from the end of file to find the last complete line
+const tailSize = 64 * 1024
+
+// Marker is written by the recorder among danmaku for every platform, it is not received
+type Marker string
+
+// markers of a recording
+const (
+	MarkerRecordStart Marker = "record_start"
+	MarkerRecordStop  Marker = "record_stop"
+	MarkerTitleChange Marker = "title_change"
+)
+
+// lineEnd return the offset after the last newline before end, 0 if none.
+// It read back by tailSize so a long last line is skipped over.
+func lineEnd(file *os.File, end int64) (int64, error) {
+	for end > 0 {
+		start := end - tailSize
+		if start < 0 {
+			start = 0
+		}
+		tail := make([]byte, end-start)
+		if _, err := file.ReadAt(tail, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+			return start + int64(i+1), nil
+		}
+		end = start
+	}
+
+	return 0, nil
+}
+
+// Writer save danmaku messages of a recording
+type Writer interface {
+	// Write a message, offset is the time from the start of the video
+	Write(msg *api.DanmakuMessage, offset time.Duration) error
+	// Mark write a marker of the recording with content
+	Mark(marker Marker, content string, offset time.Duration) error
+	Close() error
+}
+
+// multiWriter write a message to every format
+type multiWriter []Writer
+
+func (m multiWriter) Write(msg *api.DanmakuMessage, offset time.Duration) error {
+	var errs []string
+	for _, w := range m {
+		if err := w.Write(msg, offset); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m multiWriter) Mark(marker Marker, content string, offset time.Duration) error {
+	var errs []string
+	for _, w := range m {
+		if err := w.Mark(marker, content, offset); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m multiWriter) Close() error {
+	var errs []string
+	for _, w := range m {
+		if err := w.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Open create writers of formats for base, the extension is appended to base.
+// Formats failed to open are reported in err and skipped.
+func Open(base string, formats []string, assOptions ASSOptions) (Writer, error) {
+	if len(formats) == 0 {
+		formats = []string{configs.DanmakuFormatXML}
+	}
+
+	var (
+		writers multiWriter
+		errs    []string
+	)
+	for _, format := range formats {
+		var (
+			w   Writer
+			err error
+		)
+		path := fmt.Sprintf("%s.%s", base, format)
+		switch format {
+		case configs.DanmakuFormatXML:
+			w, err = NewXMLWriter(path)
+		case configs.DanmakuFormatASS:
+			w, err = NewASSWriter(path, assOptions)
+		case configs.DanmakuFormatJSONL:
+			w, err = NewJSONLWriter(path)
+		default:
+			err = fmt.Errorf("unknown danmaku format %s", format)
+		}
+
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		writers = append(writers, w)
+	}
+
+	var err error
+	if len(errs) > 0 {
+		err = fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return writers, err
+}
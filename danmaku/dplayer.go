@@ -0,0 +1,118 @@
+package danmaku
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+// DPlayer danmaku types
+const (
+	dplayerRight  = 0
+	dplayerTop    = 1
+	dplayerBottom = 2
+)
+
+// DPlayerItem is a danmaku of DPlayer api v3, encoded as [time, type, color, author, text]
+type DPlayerItem struct {
+	Time   float64
+	Type   int
+	Color  int
+	Author string
+	Text   string
+}
+
+// MarshalJSON encode item as an array
+func (d DPlayerItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{d.Time, d.Type, d.Color, d.Author, d.Text})
+}
+
+// ReadDPlayer read danmaku of a video from the xml or jsonl beside it,
+// return an empty list if none
+func ReadDPlayer(video string) ([]DPlayerItem, error) {
+	base := strings.TrimSuffix(video, filepath.Ext(video))
+
+	if in, err := os.Open(base + ".xml"); err == nil {
+		defer in.Close()
+		items, err := readXMLItems(in)
+		if err != nil {
+			return nil, err
+		}
+
+		list := make([]DPlayerItem, 0, len(items))
+		for _, item := range items {
+			list = append(list, dplayerItem(item))
+		}
+		return list, nil
+	}
+
+	if in, err := os.Open(base + ".jsonl"); err == nil {
+		defer in.Close()
+		return readJSONLDPlayer(in)
+	}
+
+	return []DPlayerItem{}, nil
+}
+
+// readJSONLDPlayer read chat and super chat from json lines, broken lines are skipped
+func readJSONLDPlayer(r io.Reader) ([]DPlayerItem, error) {
+	list := []DPlayerItem{}
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			e := jsonlEvent{}
+			if json.Unmarshal(line, &e) == nil {
+				item := assItem{
+					Start: time.Duration(e.Offset * float64(time.Second)),
+					Mode:  modeScroll,
+					Color: 0xffffff,
+					User:  e.UserName,
+				}
+				switch e.Type {
+				case api.DanmakuTypeChat.String():
+					item.Text = e.Content
+				case api.DanmakuTypeSuperChat.String():
+					item.Text = fmt.Sprintf("[%g %s] %s: %s", e.Price, e.Currency, e.UserName, e.Content)
+					item.Mode = modeTop
+					item.Color = 0xffd700
+				}
+				if item.Text != "" {
+					list = append(list, dplayerItem(item))
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return list, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func dplayerItem(item assItem) DPlayerItem {
+	t := dplayerRight
+	switch item.Mode {
+	case modeTop:
+		t = dplayerTop
+	case modeBottom:
+		t = dplayerBottom
+	}
+
+	return DPlayerItem{
+		Time:   float64(item.Start/time.Millisecond) / 1000,
+		Type:   t,
+		Color:  item.Color,
+		Author: item.User,
+		Text:   item.Text,
+	}
+}
@@ -0,0 +1,52 @@
+package danmaku
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadDPlayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-dplayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	xmlBase := filepath.Join(dir, "a")
+	ioutil.WriteFile(xmlBase+".xml", []byte(xmlHeader+
+		`<d p="1.500,1,25,16711680,0,0,1,0" user="alice">hello</d>`+"\n"+
+		`<d p="2.000,5,25,16777215,0,0,2,0" user="bob">top</d>`+"\n"+
+		`<sc ts="3.25" uid="3" user="carol" price="30" currency="CNY" time="60">thanks</sc>`+"\n"+
+		`<d p="4.000,1,25`), 0644)
+
+	jsonlBase := filepath.Join(dir, "b")
+	ioutil.WriteFile(jsonlBase+".jsonl", []byte(
+		`{"type":"chat","offset":1.5,"user_name":"alice","content":"hello"}`+"\n"+
+			`{"type":"gift","offset":2,"user_name":"bob","gift_name":"x"}`+"\n"+
+			`{"type":"super_chat","offset":3.25,"user_name":"carol","content":"thanks","price":30,"currency":"CNY"}`+"\n"+
+			`{"type":"chat","offs`), 0644)
+
+	tests := []struct {
+		video string
+		want  string
+	}{
+		{xmlBase + ".flv", `[[1.5,0,16711680,"alice","hello"],[2,1,16777215,"bob","top"],[3.25,1,16766720,"carol","[30 CNY] carol: thanks"]]`},
+		{jsonlBase + ".mp4", `[[1.5,0,16777215,"alice","hello"],[3.25,1,16766720,"carol","[30 CNY] carol: thanks"]]`},
+		{filepath.Join(dir, "c.flv"), `[]`},
+	}
+
+	for _, test := range tests {
+		items, err := ReadDPlayer(test.video)
+		if err != nil {
+			t.Errorf("ReadDPlayer(%s) error %s", test.video, err.Error())
+			continue
+		}
+		data, _ := json.Marshal(items)
+		if string(data) != test.want {
+			t.Errorf("ReadDPlayer(%s) = %s, want %s", test.video, data, test.want)
+		}
+	}
+}
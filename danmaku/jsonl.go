@@ -0,0 +1,120 @@
+package danmaku
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+// jsonlEvent is a line of json lines log
+type jsonlEvent struct {
+	Type string `json:"type"`
+	// wall-clock time the message received
+	Time time.Time `json:"time"`
+	// seconds from the start of the video
+	Offset float64 `json:"offset"`
+	// unix millisecond from the platform, 0 if unknown
+	SendTime  int64   `json:"send_time,omitempty"`
+	UserID    string  `json:"user_id,omitempty"`
+	UserName  string  `json:"user_name,omitempty"`
+	Content   string  `json:"content,omitempty"`
+	Price     float64 `json:"price,omitempty"`
+	Currency  string  `json:"currency,omitempty"`
+	GiftID    string  `json:"gift_id,omitempty"`
+	GiftName  string  `json:"gift_name,omitempty"`
+	GiftCount int64   `json:"gift_count,omitempty"`
+	Level     int64   `json:"level,omitempty"`
+}
+
+// JSONLWriter write every message as a json line
+type JSONLWriter struct {
+	file    *os.File
+	encoder *json.Encoder
+	now     func() time.Time
+}
+
+// NewJSONLWriter create or append to a json lines file
+func NewJSONLWriter(path string) (*JSONLWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop a truncated last line
+	end, err := jsonlContinueOffset(file)
+	if err == nil {
+		err = file.Truncate(end)
+	}
+	if err == nil {
+		_, err = file.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetEscapeHTML(false)
+
+	return &JSONLWriter{
+		file:    file,
+		encoder: encoder,
+		now:     time.Now,
+	}, nil
+}
+
+// Write a message as a line
+func (j *JSONLWriter) Write(msg *api.DanmakuMessage, offset time.Duration) error {
+	if offset < 0 {
+		offset = 0
+	}
+
+	return j.encoder.Encode(&jsonlEvent{
+		Type:      msg.Type.String(),
+		Time:      j.now(),
+		Offset:    float64(offset/time.Millisecond) / 1000,
+		SendTime:  msg.SendTime,
+		UserID:    msg.UserID,
+		UserName:  msg.UserName,
+		Content:   msg.Content,
+		Price:     msg.Price,
+		Currency:  msg.Currency,
+		GiftID:    msg.GiftID,
+		GiftName:  msg.GiftName,
+		GiftCount: msg.GiftCount,
+		Level:     msg.Level,
+	})
+}
+
+// Mark write marker as a line
+func (j *JSONLWriter) Mark(marker Marker, content string, offset time.Duration) error {
+	if offset < 0 {
+		offset = 0
+	}
+
+	return j.encoder.Encode(&jsonlEvent{
+		Type:    string(marker),
+		Time:    j.now(),
+		Offset:  float64(offset/time.Millisecond) / 1000,
+		Content: content,
+	})
+}
+
+// Close close the file
+func (j *JSONLWriter) Close() error {
+	return j.file.Close()
+}
+
+// jsonlContinueOffset return the end of the last complete line,
+// read back by tailSize until a newline found
+func jsonlContinueOffset(file *os.File) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return lineEnd(file, stat.Size())
+}
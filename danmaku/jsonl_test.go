@@ -0,0 +1,121 @@
+package danmaku
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+func TestJSONLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "danmaku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.jsonl")
+
+	// a truncated line left by a crash
+	ioutil.WriteFile(path, []byte(`{"type":"chat","offset":0}`+"\n"+`{"type":"ch`), 0644)
+
+	now := time.Date(2019, 6, 20, 12, 0, 0, 0, time.UTC)
+	writer, err := NewJSONLWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.now = func() time.Time { return now }
+
+	messages := []*api.DanmakuMessage{
+		{Type: api.DanmakuTypeChat, Content: "<3 & \"草\"", UserName: "u", UserID: "1", SendTime: 1561000000000},
+		{Type: api.DanmakuTypeGift, UserName: "u", UserID: "2", GiftID: "3", GiftName: "B坷垃", GiftCount: 2, Price: 19.8, Currency: "CNY"},
+		{Type: api.DanmakuTypeRoomChange, Content: "Minecraft"},
+		{Type: api.DanmakuTypeLiveEnd},
+	}
+	for i, msg := range messages {
+		if err := writer.Write(msg, time.Duration(i)*1500*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Mark(MarkerTitleChange, "Terraria", 6*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, _ := os.Open(path)
+	defer file.Close()
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid line %q: %s", scanner.Text(), err.Error())
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 6 {
+		t.Fatalf("want 6 lines, got %d", len(events))
+	}
+	chat := events[1]
+	if chat["type"] != "chat" || chat["content"] != "<3 & \"草\"" || chat["user_id"] != "1" ||
+		chat["send_time"] != 1561000000000.0 || chat["time"] != "2019-06-20T12:00:00Z" || chat["offset"] != 0.0 {
+		t.Errorf("unexpected chat %v", chat)
+	}
+	gift := events[2]
+	if gift["type"] != "gift" || gift["gift_name"] != "B坷垃" || gift["gift_count"] != 2.0 || gift["price"] != 19.8 || gift["offset"] != 1.5 {
+		t.Errorf("unexpected gift %v", gift)
+	}
+	if events[3]["type"] != "room_change" || events[3]["content"] != "Minecraft" {
+		t.Errorf("unexpected room change %v", events[3])
+	}
+	if _, ok := events[4]["user_id"]; events[4]["type"] != "live_end" || ok {
+		t.Errorf("unexpected live end %v", events[4])
+	}
+	if events[5]["type"] != "title_change" || events[5]["content"] != "Terraria" || events[5]["offset"] != 6.0 {
+		t.Errorf("unexpected marker %v", events[5])
+	}
+}
+
+func TestJSONLContinueOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "danmaku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.jsonl")
+
+	first := `{"type":"chat"}` + "\n"
+	long := `{"type":"chat","content":"` + strings.Repeat("a", 2*tailSize)
+	tests := []struct {
+		data string
+		want int64
+	}{
+		{"", 0},
+		{`{"type":"ch`, 0},
+		{first, int64(len(first))},
+		{first + `{"type":"ch`, int64(len(first))},
+		// a truncated line longer than the tail
+		{first + long, int64(len(first))},
+		{first + long + "\"}\n", int64(len(first + long + "\"}\n"))},
+	}
+	for _, test := range tests {
+		ioutil.WriteFile(path, []byte(test.data), 0644)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, err := jsonlContinueOffset(file)
+		file.Close()
+		if err != nil || offset != test.want {
+			t.Errorf("offset of %d bytes = %d %v, want %d", len(test.data), offset, err, test.want)
+		}
+	}
+}
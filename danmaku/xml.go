@@ -0,0 +1,318 @@
+package danmaku
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+	"go.uber.org/zap"
+)
+
+const (
+	xmlHeader = "<?xml version=\"1.0\" encoding=\"UTF-8\"?><i><chatserver>chat.bilibili.com</chatserver><chatid>0</chatid><mission>0</mission><maxlimit>0</maxlimit><source>k-v</source>\n"
+	xmlFooter = "</i>"
+)
+
+// xmlChat is a chat element, p is "offset,mode,size,color,time,pool,uid,id"
+type xmlChat struct {
+	XMLName xml.Name `xml:"d"`
+	P       string   `xml:"p,attr"`
+	User    string   `xml:"user,attr"`
+	Content string   `xml:",chardata"`
+}
+
+// xmlGift is a gift element
+type xmlGift struct {
+	XMLName   xml.Name `xml:"gift"`
+	TS        string   `xml:"ts,attr"`
+	UID       string   `xml:"uid,attr"`
+	User      string   `xml:"user,attr"`
+	GiftName  string   `xml:"giftname,attr"`
+	GiftCount int64    `xml:"giftcount,attr"`
+	Price     string   `xml:"price,attr"`
+	Currency  string   `xml:"currency,attr"`
+}
+
+// xmlSuperChat is a super chat element, time is the duration in seconds
+type xmlSuperChat struct {
+	XMLName  xml.Name `xml:"sc"`
+	TS       string   `xml:"ts,attr"`
+	UID      string   `xml:"uid,attr"`
+	User     string   `xml:"user,attr"`
+	Price    string   `xml:"price,attr"`
+	Currency string   `xml:"currency,attr"`
+	Time     int64    `xml:"time,attr"`
+	Content  string   `xml:",chardata"`
+}
+
+// xmlGuard is a guard element
+type xmlGuard struct {
+	XMLName  xml.Name `xml:"guard"`
+	TS       string   `xml:"ts,attr"`
+	UID      string   `xml:"uid,attr"`
+	User     string   `xml:"user,attr"`
+	Level    int64    `xml:"level,attr"`
+	Count    int64    `xml:"count,attr"`
+	Price    string   `xml:"price,attr"`
+	Currency string   `xml:"currency,attr"`
+}
+
+// xmlEvent is any other message
+type xmlEvent struct {
+	XMLName xml.Name `xml:"event"`
+	TS      string   `xml:"ts,attr"`
+	Type    string   `xml:"type,attr"`
+	UID     string   `xml:"uid,attr"`
+	User    string   `xml:"user,attr"`
+	Content string   `xml:",chardata"`
+}
+
+// xmlDocument is the root of danmaku xml
+type xmlDocument struct {
+	XMLName    xml.Name       `xml:"i"`
+	Chats      []xmlChat      `xml:"d"`
+	Gifts      []xmlGift      `xml:"gift"`
+	SuperChats []xmlSuperChat `xml:"sc"`
+	Guards     []xmlGuard     `xml:"guard"`
+	Events     []xmlEvent     `xml:"event"`
+}
+
+// XMLWriter write danmaku in bilibili xml format
+type XMLWriter struct {
+	file *os.File
+}
+
+// NewXMLWriter create or continue a danmaku xml file
+func NewXMLWriter(path string) (*XMLWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop the footer or a truncated line of an existing file
+	end, _, err := xmlContinueOffset(file)
+	if err == nil {
+		err = file.Truncate(end)
+	}
+	if err == nil {
+		_, err = file.Seek(end, io.SeekStart)
+	}
+	if err == nil && end == 0 {
+		_, err = file.WriteString(xmlHeader)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &XMLWriter{
+		file: file,
+	}, nil
+}
+
+// Write a message as a line of xml
+func (x *XMLWriter) Write(msg *api.DanmakuMessage, offset time.Duration) error {
+	data, err := xmlMarshal(msg, offset)
+	if err != nil {
+		return err
+	}
+
+	_, err = x.file.Write(append(data, '\n'))
+	return err
+}
+
+// Mark write marker as an event
+func (x *XMLWriter) Mark(marker Marker, content string, offset time.Duration) error {
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := xml.Marshal(&xmlEvent{
+		TS:      fmt.Sprintf("%.3f", offset.Seconds()),
+		Type:    string(marker),
+		Content: content,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = x.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close write footer and close file
+func (x *XMLWriter) Close() error {
+	_, err := x.file.WriteString(xmlFooter)
+	if closeErr := x.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func xmlMarshal(msg *api.DanmakuMessage, offset time.Duration) ([]byte, error) {
+	// TODO: message received before the video start
+	if offset < 0 {
+		offset = 0
+	}
+	ts := fmt.Sprintf("%.3f", offset.Seconds())
+	price := fmt.Sprintf("%.2f", msg.Price)
+
+	var element interface{}
+	switch msg.Type {
+	case api.DanmakuTypeChat:
+		uid := msg.UserID
+		if uid == "" {
+			uid = "0"
+		}
+		element = &xmlChat{
+			P:       fmt.Sprintf("%s,1,25,16777215,%d,0,%s,0", ts, msg.SendTime/1000, strings.Replace(uid, ",", "", -1)),
+			User:    msg.UserName,
+			Content: msg.Content,
+		}
+	case api.DanmakuTypeGift:
+		element = &xmlGift{
+			TS:        ts,
+			UID:       msg.UserID,
+			User:      msg.UserName,
+			GiftName:  msg.GiftName,
+			GiftCount: msg.GiftCount,
+			Price:     price,
+			Currency:  msg.Currency,
+		}
+	case api.DanmakuTypeSuperChat:
+		element = &xmlSuperChat{
+			TS:       ts,
+			UID:      msg.UserID,
+			User:     msg.UserName,
+			Price:    price,
+			Currency: msg.Currency,
+			Time:     msg.Level,
+			Content:  msg.Content,
+		}
+	case api.DanmakuTypeGuard:
+		element = &xmlGuard{
+			TS:       ts,
+			UID:      msg.UserID,
+			User:     msg.UserName,
+			Level:    msg.Level,
+			Count:    msg.GiftCount,
+			Price:    price,
+			Currency: msg.Currency,
+		}
+	default:
+		element = &xmlEvent{
+			TS:      ts,
+			Type:    msg.Type.String(),
+			UID:     msg.UserID,
+			User:    msg.UserName,
+			Content: msg.Content,
+		}
+	}
+
+	return xml.Marshal(element)
+}
+
+// xmlContinueOffset return where to continue writing an existing file,
+// it is the start of footer or the end of the last complete line.
+// 0 means the file should be written from scratch, complete is true if footer exists.
+func xmlContinueOffset(file *os.File) (offset int64, complete bool, err error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := stat.Size()
+	if size <= int64(len(xmlHeader)) {
+		return 0, false, nil
+	}
+
+	start := size - tailSize
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, size-start)
+	if _, err := file.ReadAt(tail, start); err != nil {
+		return 0, false, err
+	}
+
+	trimmed := bytes.TrimRight(tail, " \t\r\n")
+	if bytes.HasSuffix(trimmed, []byte(xmlFooter)) {
+		return start + int64(len(trimmed)-len(xmlFooter)), true, nil
+	}
+
+	if offset, err = lineEnd(file, size); err != nil || offset < int64(len(xmlHeader)) {
+		return 0, false, err
+	}
+
+	return offset, false, nil
+}
+
+// RepairXML fix a danmaku xml without footer, return true if file changed
+func RepairXML(path string) (bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// skip xml not written by recorder
+	head := make([]byte, len(xmlHeader))
+	if n, _ := file.ReadAt(head, 0); n == 0 || xmlHeader[:n] != string(head[:n]) {
+		return false, nil
+	}
+
+	end, complete, err := xmlContinueOffset(file)
+	if err != nil || complete {
+		return false, err
+	}
+
+	if err := file.Truncate(end); err != nil {
+		return false, err
+	}
+	content := xmlFooter
+	if end == 0 {
+		content = xmlHeader + xmlFooter
+	}
+	_, err = file.WriteAt([]byte(content), end)
+
+	return true, err
+}
+
+// RepairXMLFiles repair danmaku xml under root modified before, newer ones may be recording
+func RepairXMLFiles(root string, before time.Time) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".xml" || !info.ModTime().Before(before) {
+			return nil
+		}
+
+		repairXMLFile(path)
+		return nil
+	})
+}
+
+// RepairVideoXML repair danmaku xml beside each video file, videos without xml are skipped
+func RepairVideoXML(videos []string) {
+	for _, video := range videos {
+		path := strings.TrimSuffix(video, filepath.Ext(video)) + ".xml"
+		if _, err := os.Stat(path); err == nil {
+			repairXMLFile(path)
+		}
+	}
+}
+
+// repairXMLFile repair path and log the result
+func repairXMLFile(path string) {
+	if repaired, err := RepairXML(path); err != nil {
+		zap.L().Error("Repair Danmaku",
+			zap.String("Path", path),
+			zap.String("Err", err.Error()),
+		)
+	} else if repaired {
+		zap.L().Info("Repair Danmaku", zap.String("Path", path))
+	}
+}
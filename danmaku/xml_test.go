@@ -0,0 +1,157 @@
+package danmaku
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+func readTestXML(t *testing.T, path string) *xmlDocument {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := &xmlDocument{}
+	if err := xml.Unmarshal(data, doc); err != nil {
+		t.Fatalf("invalid xml: %s\n%s", err.Error(), data)
+	}
+	return doc
+}
+
+func TestXMLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "danmaku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.xml")
+
+	messages := []*api.DanmakuMessage{
+		{Type: api.DanmakuTypeChat, Content: `<b>"quote" & 'apos'</b>`, UserName: "a<b>", UserID: "1", SendTime: 1561000000000},
+		{Type: api.DanmakuTypeChat, Content: "line\nbreak\x01", UserName: "u,ser"},
+		{Type: api.DanmakuTypeGift, UserName: "&", UserID: "2", GiftName: "<gift>", GiftCount: 3, Price: 1.5, Currency: "CNY"},
+		{Type: api.DanmakuTypeSuperChat, Content: "</sc>", UserName: "u", UserID: "3", Price: 30, Currency: "CNY", Level: 60},
+		{Type: api.DanmakuTypeGuard, UserName: "u", UserID: "4", Level: 3, GiftCount: 1, Price: 198, Currency: "CNY"},
+		{Type: api.DanmakuTypeRoomChange, Content: "new <title>"},
+	}
+
+	writer, err := NewXMLWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range messages {
+		if err := writer.Write(msg, time.Duration(i)*time.Second-time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := readTestXML(t, path)
+	if len(doc.Chats) != 2 || len(doc.Gifts) != 1 || len(doc.SuperChats) != 1 || len(doc.Guards) != 1 || len(doc.Events) != 1 {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	if doc.Chats[0].Content != messages[0].Content || doc.Chats[0].User != "a<b>" {
+		t.Errorf("chat not round trip: %+v", doc.Chats[0])
+	}
+	if doc.Chats[0].P != "0.000,1,25,16777215,1561000000,0,1,0" {
+		t.Errorf("unexpected p %q", doc.Chats[0].P)
+	}
+	if doc.Chats[1].Content != "line\nbreak�" {
+		t.Errorf("chat not round trip: %q", doc.Chats[1].Content)
+	}
+	if g := doc.Gifts[0]; g.User != "&" || g.GiftName != "<gift>" || g.GiftCount != 3 || g.Price != "1.50" || g.TS != "1.999" {
+		t.Errorf("gift not round trip: %+v", g)
+	}
+	if sc := doc.SuperChats[0]; sc.Content != "</sc>" || sc.Time != 60 || sc.Price != "30.00" {
+		t.Errorf("super chat not round trip: %+v", sc)
+	}
+	if g := doc.Guards[0]; g.Level != 3 || g.UID != "4" {
+		t.Errorf("guard not round trip: %+v", g)
+	}
+	if e := doc.Events[0]; e.Type != "room_change" || e.Content != "new <title>" {
+		t.Errorf("event not round trip: %+v", e)
+	}
+
+	// continue an existing file
+	writer, err = NewXMLWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(messages[0], 0)
+	writer.Close()
+
+	if doc := readTestXML(t, path); len(doc.Chats) != 3 {
+		t.Errorf("want 3 chats after continue, got %d", len(doc.Chats))
+	}
+}
+
+func TestRepairXML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "danmaku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		content  string
+		repaired bool
+		chats    int
+	}{
+		{"complete", xmlHeader + "<d p=\"0\">a</d>\n" + xmlFooter + "\n", false, 1},
+		{"no footer", xmlHeader + "<d p=\"0\">a</d>\n", true, 1},
+		{"truncated line", xmlHeader + "<d p=\"0\">a</d>\n<d p=\"1\">b", true, 1},
+		{"truncated header", xmlHeader[:20], true, 0},
+		{"header only", xmlHeader, true, 0},
+		{"truncated long line", xmlHeader + "<d p=\"0\">a</d>\n<d p=\"1\">" + strings.Repeat("b", 3*tailSize), true, 1},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name+".xml")
+		ioutil.WriteFile(path, []byte(test.content), 0644)
+
+		repaired, err := RepairXML(path)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if repaired != test.repaired {
+			t.Errorf("%s: repaired = %t, want %t", test.name, repaired, test.repaired)
+		}
+		if doc := readTestXML(t, path); len(doc.Chats) != test.chats {
+			t.Errorf("%s: want %d chats, got %d", test.name, test.chats, len(doc.Chats))
+		}
+	}
+
+	// other xml is not touched
+	path := filepath.Join(dir, "other.xml")
+	ioutil.WriteFile(path, []byte("<?xml version=\"1.0\"?><root>"), 0644)
+	if repaired, _ := RepairXML(path); repaired {
+		t.Error("xml not written by recorder repaired")
+	}
+
+	// only xml beside the videos, or written before are repaired
+	open := xmlHeader + "<d p=\"0\">a</d>\n"
+	for _, name := range []string{"video", "recording", "old"} {
+		ioutil.WriteFile(filepath.Join(dir, name+".xml"), []byte(open), 0644)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "old.xml"), old, old)
+	RepairVideoXML([]string{filepath.Join(dir, "video.flv"), filepath.Join(dir, "missing.flv")})
+	RepairXMLFiles(dir, time.Now().Add(-time.Minute))
+	for name, want := range map[string]bool{"video": true, "recording": false, "old": true} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name+".xml"))
+		if repaired := strings.HasSuffix(string(data), xmlFooter); repaired != want {
+			t.Errorf("%s: repaired = %t, want %t", name, repaired, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package event
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+// Type of event
+type Type string
+
+// event types, live_start and live_end follow the live status of the room,
+// record_start and record_stop a recording session
+const (
+	LiveStart       Type = "live_start"
+	LiveEnd         Type = "live_end"
+	RecordStart     Type = "record_start"
+	RecordStop      Type = "record_stop"
+	TitleChange     Type = "title_change"
+	RecordFileOpen  Type = "record_file_open"
+	RecordFileClose Type = "record_file_close"
+	Error           Type = "error"
+)
+
+// Event is something happened to a room
+type Event struct {
+	Type      Type      `json:"type"`
+	Time      time.Time `json:"time"`
+	MonitorID string    `json:"monitor_id"`
+	URL       string    `json:"url"`
+	Platform  string    `json:"platform"`
+	Author    string    `json:"author"`
+	Title     string    `json:"title"`
+	// Session is the id of a recording session, files of a live share it
+	Session string `json:"session,omitempty"`
+	// File is the path of the recording file
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Quality of the stream, on file events
+	Quality string `json:"quality,omitempty"`
+	// Size of the closed file in bytes
+	Size int64 `json:"size,omitempty"`
+	// Danmaku received in the session and Reason the recording stopped, on record_stop
+	Danmaku int64  `json:"danmaku,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// reasons a recording stopped
+const (
+	ReasonLiveEnd  = "live_end"
+	ReasonStopped  = "stopped"
+	ReasonPaused   = "paused"
+	ReasonRemoved  = "removed"
+	ReasonShutdown = "shutdown"
+)
+
+// Handler receive events, it is called synchronously and should return fast
+type Handler func(e *Event)
+
+// Bus dispatch events to handlers
+type Bus struct {
+	lock     sync.RWMutex
+	handlers []Handler
+}
+
+// NewBus return an empty bus
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe add a handler
+func (b *Bus) Subscribe(handler Handler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Publish send e to every handler in subscribe order, a nil bus drop it
+func (b *Bus) Publish(e *Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.lock.RLock()
+	handlers := b.handlers
+	b.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+// New return an event of live
+func New(t Type, monitorID string, live api.LiveAPI) *Event {
+	return &Event{
+		Type:      t,
+		Time:      time.Now(),
+		MonitorID: monitorID,
+		URL:       live.GetLiveURL(),
+		Platform:  live.GetPlatformName(),
+		Author:    live.GetAuthor(),
+		Title:     live.GetTitle(),
+	}
+}
+
+// Buffer keep the latest events in memory
+type Buffer struct {
+	lock   sync.RWMutex
+	events []Event
+	next   int
+	full   bool
+}
+
+// NewBuffer return a buffer holding size events
+func NewBuffer(size int) *Buffer {
+	if size <= 0 {
+		size = 1
+	}
+	return &Buffer{events: make([]Event, size)}
+}
+
+// Handle add e into buffer, subscribed to the event bus
+func (b *Buffer) Handle(e *Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.events[b.next] = *e
+	b.next = (b.next + 1) % len(b.events)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Events return at most limit latest events of monitorID, newest first,
+// empty monitorID for all monitors and limit <= 0 for no limit
+func (b *Buffer) Events(monitorID string, limit int) []Event {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.events)
+	}
+
+	events := []Event{}
+	for i := 1; i <= count; i++ {
+		e := b.events[(b.next-i+len(b.events))%len(b.events)]
+		if monitorID != "" && e.MonitorID != monitorID {
+			continue
+		}
+		events = append(events, e)
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+	}
+	return events
+}
@@ -0,0 +1,35 @@
+package event
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBuffer(t *testing.T) {
+	b := NewBuffer(4)
+	for i := 0; i < 6; i++ {
+		b.Handle(&Event{Type: LiveStart, MonitorID: fmt.Sprint(i % 2), Title: fmt.Sprint(i)})
+	}
+
+	tests := []struct {
+		monitorID string
+		limit     int
+		want      []string
+	}{
+		{"", 0, []string{"5", "4", "3", "2"}},
+		{"", 2, []string{"5", "4"}},
+		{"0", 0, []string{"4", "2"}},
+		{"1", 1, []string{"5"}},
+		{"2", 0, []string{}},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		for _, e := range b.Events(test.monitorID, test.limit) {
+			got = append(got, e.Title)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("Events(%q, %d) = %v, want %v", test.monitorID, test.limit, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// ReasonInterrupted is the reason of sessions left by an unclean exit
+const ReasonInterrupted = "interrupted"
+
+// ErrNotFound is returned for an unknown session id
+var ErrNotFound = fmt.Errorf("session not found")
+
+var (
+	// sessions keyed by start time and id, in start order
+	sessionBucket = []byte("sessions")
+	// session id to the key in sessions
+	indexBucket = []byte("index")
+	// monitor id to the id of its recording session
+	activeBucket = []byte("active")
+)
+
+// Session is a recording of a live
+type Session struct {
+	ID        string     `json:"id"`
+	MonitorID string     `json:"monitor_id"`
+	URL       string     `json:"url"`
+	Platform  string     `json:"platform"`
+	Author    string     `json:"author"`
+	Titles    []Title    `json:"titles"`
+	Start     time.Time  `json:"start"`
+	End       *time.Time `json:"end,omitempty"`
+	// Duration in seconds, set when ended
+	Duration float64 `json:"duration"`
+	// Size of the files in bytes
+	Size int64 `json:"size"`
+	// Quality of the last stream
+	Quality   string `json:"quality,omitempty"`
+	Danmaku   int64  `json:"danmaku"`
+	Reason    string `json:"reason,omitempty"`
+	Errors    int    `json:"errors,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	Files     []File `json:"files"`
+}
+
+// Title of the live since Time
+type Title struct {
+	Time  time.Time `json:"time"`
+	Title string    `json:"title"`
+}
+
+// File is a recording file of a session
+type File struct {
+	Path    string     `json:"path"`
+	Quality string     `json:"quality,omitempty"`
+	Open    time.Time  `json:"open"`
+	Close   *time.Time `json:"close,omitempty"`
+	Size    int64      `json:"size"`
+}
+
+// Query filter sessions, zero fields match all
+type Query struct {
+	MonitorID string
+	// Author match a part of the author, case insensitive
+	Author string
+	// sessions started in [Since, Until)
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// Store keep sessions in a bbolt database. The file is opened for each operation,
+// so the history command can read it while recording.
+type Store struct {
+	path string
+	lock sync.Mutex
+}
+
+// New return a store of the database at path, created on the first write
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+// Path return the database path of config
+func Path(config *configs.Config) string {
+	if config.History != "" {
+		return config.History
+	}
+	return filepath.Join(config.OutPath, ".history.db")
+}
+
+// ParseTime parse RFC3339 or a local date like 2006-01-02
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q, want RFC3339 or 2006-01-02", value)
+	}
+	return t, nil
+}
+
+// update run f in a write transaction
+func (s *Store) update(f func(tx *bolt.Tx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sessionBucket, indexBucket, activeBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return f(tx)
+	})
+}
+
+// view run f in a read transaction, f is not called if nothing written yet
+func (s *Store) view(f func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(sessionBucket) == nil {
+			return nil
+		}
+		return f(tx)
+	})
+}
+
+// Handle record e, subscribed to the event bus
+func (s *Store) Handle(e *event.Event) {
+	switch e.Type {
+	case event.RecordStart, event.TitleChange, event.RecordFileOpen, event.RecordFileClose, event.Error, event.RecordStop:
+	default:
+		return
+	}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		return apply(tx, e)
+	})
+	if err != nil {
+		zap.L().Error("History",
+			zap.String("Event", string(e.Type)),
+			zap.String("Err", err.Error()),
+		)
+	}
+}
+
+// apply e to its session, events out of a session are dropped
+func apply(tx *bolt.Tx, e *event.Event) error {
+	active := tx.Bucket(activeBucket)
+	id := e.Session
+	if id == "" {
+		id = string(active.Get([]byte(e.MonitorID)))
+	}
+	if id == "" {
+		return nil
+	}
+
+	session, key, err := get(tx, id)
+	if err == ErrNotFound {
+		session = &Session{ID: id, MonitorID: e.MonitorID, Start: e.Time}
+		key = sessionKey(session)
+	} else if err != nil {
+		return err
+	}
+	if e.URL != "" {
+		session.URL = e.URL
+	}
+	if e.Platform != "" {
+		session.Platform = e.Platform
+	}
+	if e.Author != "" {
+		session.Author = e.Author
+	}
+
+	switch e.Type {
+	case event.RecordStart:
+		session.addTitle(e.Time, e.Title)
+		if err := active.Put([]byte(e.MonitorID), []byte(id)); err != nil {
+			return err
+		}
+	case event.TitleChange:
+		session.addTitle(e.Time, e.Title)
+	case event.RecordFileOpen:
+		session.addTitle(e.Time, e.Title)
+		session.Files = append(session.Files, File{Path: e.File, Quality: e.Quality, Open: e.Time})
+		if e.Quality != "" {
+			session.Quality = e.Quality
+		}
+	case event.RecordFileClose:
+		file := session.file(e.File, e.Time)
+		closed := e.Time
+		file.Close = &closed
+		file.Size = e.Size
+		session.Size = 0
+		for _, f := range session.Files {
+			session.Size += f.Size
+		}
+	case event.Error:
+		session.Errors++
+		session.LastError = e.Error
+	case event.RecordStop:
+		session.end(e.Time, e.Reason)
+		session.Danmaku = e.Danmaku
+		if string(active.Get([]byte(e.MonitorID))) == id {
+			if err := active.Delete([]byte(e.MonitorID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return put(tx, key, session)
+}
+
+// addTitle append title if changed
+func (s *Session) addTitle(t time.Time, title string) {
+	if n := len(s.Titles); title == "" || (n > 0 && s.Titles[n-1].Title == title) {
+		return
+	}
+	s.Titles = append(s.Titles, Title{Time: t, Title: title})
+}
+
+// file return the file of path, added if not opened in the session
+func (s *Session) file(path string, t time.Time) *File {
+	for i := range s.Files {
+		if s.Files[i].Path == path {
+			return &s.Files[i]
+		}
+	}
+	s.Files = append(s.Files, File{Path: path, Open: t})
+	return &s.Files[len(s.Files)-1]
+}
+
+// end the session at t
+func (s *Session) end(t time.Time, reason string) {
+	s.End = &t
+	s.Duration = t.Sub(s.Start).Seconds()
+	s.Reason = reason
+}
+
+// Recover end sessions left recording by an unclean exit at the last file time,
+// return files of those sessions
+func (s *Store) Recover() ([]string, error) {
+	files := []string{}
+	err := s.update(func(tx *bolt.Tx) error {
+		active := tx.Bucket(activeBucket)
+		ids := []string{}
+		active.ForEach(func(k, v []byte) error {
+			ids = append(ids, string(v))
+			return nil
+		})
+
+		for _, id := range ids {
+			session, key, err := get(tx, id)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			last := session.Start
+			for _, file := range session.Files {
+				files = append(files, file.Path)
+				if file.Open.After(last) {
+					last = file.Open
+				}
+				if file.Close != nil && file.Close.After(last) {
+					last = *file.Close
+				}
+			}
+			session.end(last, ReasonInterrupted)
+			if err := put(tx, key, session); err != nil {
+				return err
+			}
+		}
+
+		return tx.DeleteBucket(activeBucket)
+	})
+	return files, err
+}
+
+// Sessions return sessions matching query, newest first
+func (s *Store) Sessions(query Query) ([]Session, error) {
+	sessions := []Session{}
+	author := strings.ToLower(query.Author)
+
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(sessionBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			session := Session{}
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+
+			if !query.Since.IsZero() && session.Start.Before(query.Since) {
+				break
+			}
+			if !query.Until.IsZero() && !session.Start.Before(query.Until) {
+				continue
+			}
+			if query.MonitorID != "" && session.MonitorID != query.MonitorID {
+				continue
+			}
+			if author != "" && !strings.Contains(strings.ToLower(session.Author), author) {
+				continue
+			}
+
+			sessions = append(sessions, session)
+			if query.Limit > 0 && len(sessions) >= query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+
+	return sessions, err
+}
+
+// Session return the session of id
+func (s *Store) Session(id string) (Session, error) {
+	session := Session{}
+	found := false
+	err := s.view(func(tx *bolt.Tx) error {
+		v, _, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+		session, found = *v, true
+		return nil
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+
+	return session, err
+}
+
+// get return the session of id and its key
+func get(tx *bolt.Tx, id string) (*Session, []byte, error) {
+	key := tx.Bucket(indexBucket).Get([]byte(id))
+	if key == nil {
+		return nil, nil, ErrNotFound
+	}
+	data := tx.Bucket(sessionBucket).Get(key)
+	if data == nil {
+		return nil, nil, ErrNotFound
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, nil, err
+	}
+	return session, append([]byte(nil), key...), nil
+}
+
+// put save session at key and index it
+func put(tx *bolt.Tx, key []byte, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(sessionBucket).Put(key, data); err != nil {
+		return err
+	}
+	return tx.Bucket(indexBucket).Put([]byte(session.ID), key)
+}
+
+// sessionKey order sessions by start time, the id keep keys unique
+func sessionKey(session *Session) []byte {
+	key := make([]byte, 8, 8+len(session.ID))
+	binary.BigEndian.PutUint64(key, uint64(session.Start.UnixNano()))
+	return append(key, session.ID...)
+}
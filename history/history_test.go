@@ -0,0 +1,133 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/event"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := New(filepath.Join(dir, "sub", "history.db"))
+
+	// nothing written yet
+	if sessions, err := s.Sessions(Query{}); err != nil || len(sessions) != 0 {
+		t.Fatalf("empty sessions = %v %v", sessions, err)
+	}
+
+	start := time.Date(2020, 1, 2, 20, 0, 0, 0, time.UTC)
+	at := func(minute int) time.Time {
+		return start.Add(time.Duration(minute) * time.Minute)
+	}
+	publish := func(e event.Event) {
+		if e.MonitorID == "" {
+			e.MonitorID = "a"
+		}
+		e.Platform = "哔哩哔哩"
+		if e.Author == "" {
+			e.Author = "Alice"
+		}
+		s.Handle(&e)
+	}
+
+	publish(event.Event{Type: event.RecordStart, Time: at(0), Session: "a-1", Title: "one"})
+	publish(event.Event{Type: event.RecordFileOpen, Time: at(0), Session: "a-1", Title: "one", File: "1.flv", Quality: "原画"})
+	publish(event.Event{Type: event.TitleChange, Time: at(10), Title: "two"})
+	publish(event.Event{Type: event.Error, Time: at(11), Session: "a-1", Error: "oops"})
+	publish(event.Event{Type: event.RecordFileClose, Time: at(20), Session: "a-1", File: "1.flv", Size: 100})
+	publish(event.Event{Type: event.RecordFileOpen, Time: at(20), Session: "a-1", Title: "two", File: "2.flv", Quality: "高清"})
+	publish(event.Event{Type: event.RecordFileClose, Time: at(30), Session: "a-1", File: "2.flv", Size: 50})
+	publish(event.Event{Type: event.RecordStop, Time: at(30), Session: "a-1", Danmaku: 42, Reason: event.ReasonLiveEnd})
+	// after the session, not recorded
+	publish(event.Event{Type: event.TitleChange, Time: at(40), Title: "three"})
+
+	session, err := s.Session("a-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.End == nil || session.Duration != 1800 || session.Size != 150 || session.Danmaku != 42 ||
+		session.Reason != event.ReasonLiveEnd || session.Quality != "高清" || session.Errors != 1 || session.LastError != "oops" {
+		t.Errorf("session = %+v", session)
+	}
+	if len(session.Titles) != 2 || session.Titles[0].Title != "one" || session.Titles[1].Title != "two" || !session.Titles[1].Time.Equal(at(10)) {
+		t.Errorf("titles = %+v", session.Titles)
+	}
+	if len(session.Files) != 2 || session.Files[0].Size != 100 || session.Files[0].Quality != "原画" || session.Files[1].Close == nil {
+		t.Errorf("files = %+v", session.Files)
+	}
+	if _, err := s.Session("x"); err != ErrNotFound {
+		t.Errorf("unknown session err = %v", err)
+	}
+
+	// left recording by a crash
+	publish(event.Event{Type: event.RecordStart, Time: at(60), Session: "b-1", MonitorID: "b", Author: "Bob", Title: "bob"})
+	publish(event.Event{Type: event.RecordFileOpen, Time: at(61), Session: "b-1", MonitorID: "b", Author: "Bob", File: "3.flv"})
+	publish(event.Event{Type: event.RecordStart, Time: at(120), Session: "a-2", Title: "again"})
+	files, err := s.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "3.flv" {
+		t.Errorf("recovered files = %v", files)
+	}
+	session, _ = s.Session("b-1")
+	if session.End == nil || !session.End.Equal(at(61)) || session.Reason != ReasonInterrupted {
+		t.Errorf("recovered session = %+v", session)
+	}
+	publish(event.Event{Type: event.TitleChange, Time: at(130), Title: "dropped"})
+	if session, _ = s.Session("a-2"); len(session.Titles) != 1 || session.Reason != ReasonInterrupted {
+		t.Errorf("recovered session = %+v", session)
+	}
+
+	tests := []struct {
+		query Query
+		want  []string
+	}{
+		{Query{}, []string{"a-2", "b-1", "a-1"}},
+		{Query{Limit: 2}, []string{"a-2", "b-1"}},
+		{Query{MonitorID: "a"}, []string{"a-2", "a-1"}},
+		{Query{Author: "bo"}, []string{"b-1"}},
+		{Query{Since: at(30)}, []string{"a-2", "b-1"}},
+		{Query{Until: at(60)}, []string{"a-1"}},
+	}
+	for _, test := range tests {
+		sessions, err := s.Sessions(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, session := range sessions {
+			ids = append(ids, session.ID)
+		}
+		if len(ids) != len(test.want) {
+			t.Errorf("sessions %+v = %v, want %v", test.query, ids, test.want)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.want[i] {
+				t.Errorf("sessions %+v = %v, want %v", test.query, ids, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	if got, err := ParseTime("2020-01-02T03:04:05Z"); err != nil || !got.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("rfc3339 = %v %v", got, err)
+	}
+	if got, err := ParseTime("2020-01-02"); err != nil || !got.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("date = %v %v", got, err)
+	}
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Error("bad time parsed")
+	}
+}
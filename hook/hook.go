@@ -0,0 +1,191 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+	"go.uber.org/zap"
+)
+
+// default timeout of a command
+const defaultTimeout = 60 * time.Second
+
+// Runner run shell commands on events
+type Runner struct {
+	lock   sync.RWMutex
+	global commandSet
+	// rooms with their own hooks by live url
+	rooms     map[string]commandSet
+	waitGroup *sync.WaitGroup
+}
+
+// commandSet is the commands of events and their timeout
+type commandSet struct {
+	commands map[event.Type][]string
+	timeout  time.Duration
+}
+
+func newCommandSet(conf configs.HookConfig) commandSet {
+	timeout := time.Duration(conf.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return commandSet{
+		commands: map[event.Type][]string{
+			event.LiveStart:       conf.LiveStart,
+			event.RecordStart:     conf.RecordStart,
+			event.RecordFileOpen:  conf.RecordFileOpen,
+			event.RecordFileClose: conf.RecordFileClose,
+			event.RecordStop:      conf.RecordStop,
+			event.LiveEnd:         conf.LiveEnd,
+			event.Error:           conf.Error,
+		},
+		timeout: timeout,
+	}
+}
+
+// New return a runner, running commands are added to waitGroup
+func New(conf configs.HookConfig, waitGroup *sync.WaitGroup) *Runner {
+	r := &Runner{waitGroup: waitGroup}
+	r.SetConfig(conf)
+
+	return r
+}
+
+// SetConfig replace commands, running commands are not affected
+func (r *Runner) SetConfig(conf configs.HookConfig) {
+	set := newCommandSet(conf)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.global = set
+}
+
+// SetRooms replace hooks of rooms by live url, other rooms use the global hooks
+func (r *Runner) SetRooms(rooms map[string]configs.HookConfig) {
+	sets := make(map[string]commandSet, len(rooms))
+	for liveURL, conf := range rooms {
+		sets[liveURL] = newCommandSet(conf)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rooms = sets
+}
+
+// set return the commands for the room of e
+func (r *Runner) set(e *event.Event) commandSet {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if set, ok := r.rooms[e.URL]; ok {
+		return set
+	}
+	return r.global
+}
+
+// Handle run commands of the event in order, subscribed to the event bus
+func (r *Runner) Handle(e *event.Event) {
+	commands := r.set(e).commands[e.Type]
+	if len(commands) == 0 {
+		return
+	}
+
+	r.waitGroup.Add(1)
+	go func() {
+		defer r.waitGroup.Done()
+		for _, command := range commands {
+			output, err := r.run(command, e)
+			if err != nil {
+				zap.L().Error("Hook",
+					zap.String("Id", e.MonitorID),
+					zap.String("Event", string(e.Type)),
+					zap.String("Command", command),
+					zap.String("Output", output),
+					zap.String("Err", err.Error()),
+				)
+				continue
+			}
+
+			zap.L().Info("Hook",
+				zap.String("Id", e.MonitorID),
+				zap.String("Event", string(e.Type)),
+				zap.String("Command", command),
+				zap.String("Output", output),
+			)
+		}
+	}()
+}
+
+// run command with event as env and json on stdin, return stdout and stderr
+func (r *Runner) run(command string, e *event.Event) (string, error) {
+	timeout := r.set(e).timeout
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	// output go to a file, a killed shell never wait for its children holding a pipe
+	output, err := ioutil.TempFile("", "dd-hook")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env(e, payload)...)
+	cmd.Stdin = bytes.NewReader(append(payload, '\n'))
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+
+	data, _ := ioutil.ReadFile(output.Name())
+	return strings.TrimSpace(string(data)), err
+}
+
+// env return environment variables describing e
+func env(e *event.Event, payload []byte) []string {
+	return []string{
+		"DD_HOOK_EVENT=" + string(e.Type),
+		"DD_HOOK_TIME=" + e.Time.Format(time.RFC3339),
+		"DD_HOOK_MONITOR_ID=" + e.MonitorID,
+		"DD_HOOK_URL=" + e.URL,
+		"DD_HOOK_PLATFORM=" + e.Platform,
+		"DD_HOOK_AUTHOR=" + e.Author,
+		"DD_HOOK_TITLE=" + e.Title,
+		"DD_HOOK_SESSION=" + e.Session,
+		"DD_HOOK_FILE=" + e.File,
+		"DD_HOOK_ERROR=" + e.Error,
+		"DD_HOOK_QUALITY=" + e.Quality,
+		"DD_HOOK_SIZE=" + strconv.FormatInt(e.Size, 10),
+		"DD_HOOK_DANMAKU=" + strconv.FormatInt(e.Danmaku, 10),
+		"DD_HOOK_REASON=" + e.Reason,
+		"DD_HOOK_PAYLOAD=" + string(payload),
+	}
+}
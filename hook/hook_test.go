@@ -0,0 +1,129 @@
+package hook
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+)
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh not available")
+	}
+
+	r := New(configs.HookConfig{}, &sync.WaitGroup{})
+	e := &event.Event{
+		Type:   event.RecordFileClose,
+		Time:   time.Now(),
+		Author: "author",
+		Title:  "it's a title",
+		File:   "/tmp/a b.flv",
+	}
+
+	output, err := r.run(`echo "$DD_HOOK_EVENT|$DD_HOOK_TITLE|$DD_HOOK_FILE"; cat; echo oops >&2`, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) != 3 || lines[0] != "record_file_close|it's a title|/tmp/a b.flv" || lines[2] != "oops" {
+		t.Fatalf("unexpected output %q", output)
+	}
+	if !strings.Contains(lines[1], `"author":"author"`) || !strings.Contains(lines[1], `"file":"/tmp/a b.flv"`) {
+		t.Errorf("unexpected payload %s", lines[1])
+	}
+
+	if _, err := r.run("exit 3", e); err == nil {
+		t.Error("want error for exit code")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh not available")
+	}
+
+	r := New(configs.HookConfig{}, &sync.WaitGroup{})
+	r.global.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := r.run("sleep 5 & sleep 5", &event.Event{Type: event.LiveEnd})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("want timeout error, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("timeout not enforced, took %s", time.Since(start))
+	}
+}
+
+func TestHandle(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh not available")
+	}
+
+	wg := &sync.WaitGroup{}
+	r := New(configs.HookConfig{LiveStart: []string{"true", "true"}}, wg)
+	r.Handle(&event.Event{Type: event.LiveStart})
+	r.Handle(&event.Event{Type: event.LiveEnd})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("hooks not finished")
+	}
+}
+
+func TestRoomHooks(t *testing.T) {
+	r := New(configs.HookConfig{LiveStart: []string{"global"}}, &sync.WaitGroup{})
+	r.SetRooms(map[string]configs.HookConfig{
+		"https://live.bilibili.com/1": {Timeout: 5, LiveStart: []string{"room"}},
+	})
+
+	tests := []struct {
+		url     string
+		command string
+		timeout time.Duration
+	}{
+		{"https://live.bilibili.com/1", "room", 5 * time.Second},
+		{"https://live.bilibili.com/2", "global", defaultTimeout},
+	}
+	for _, test := range tests {
+		set := r.set(&event.Event{Type: event.LiveStart, URL: test.url})
+		if commands := set.commands[event.LiveStart]; len(commands) != 1 || commands[0] != test.command || set.timeout != test.timeout {
+			t.Errorf("%s: commands %v timeout %s, want %s %s", test.url, commands, set.timeout, test.command, test.timeout)
+		}
+	}
+}
+
+func TestEnvConfig(t *testing.T) {
+	e := &event.Event{
+		Type:    event.LiveEnd,
+		Time:    time.Now(),
+		URL:     "https://live.bilibili.com/1",
+		Title:   "title",
+		Quality: "原画",
+		Danmaku: 0,
+		Reason:  event.ReasonLiveEnd,
+	}
+
+	// dd-recorder run by a hook load the config with the event in env
+	config, err := configs.Load("", append(env(e, []byte("{}")), "DD_INTERVAL=20"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := configs.Default()
+	want.Interval = 20
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+}
@@ -3,6 +3,7 @@ package instance
 import (
 	"context"
 	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
 	"sync"
 )
 
@@ -11,8 +12,40 @@ const InstanceKey string = "meaqua"
 
 // Instance struct
 type Instance struct {
-	WaitGroup *sync.WaitGroup
-	Config    *configs.Config
+	WaitGroup  *sync.WaitGroup
+	Events     *event.Bus
+	configLock sync.RWMutex
+	config     *configs.Config
+}
+
+// New return an instance of config
+func New(config *configs.Config) *Instance {
+	return &Instance{
+		WaitGroup: &sync.WaitGroup{},
+		Events:    event.NewBus(),
+		config:    config,
+	}
+}
+
+// GetConfig return the current config, it must not be modified
+func (i *Instance) GetConfig() *configs.Config {
+	i.configLock.RLock()
+	defer i.configLock.RUnlock()
+	return i.config
+}
+
+// GetRoomConfig return the room of live url and the config with its overrides
+func (i *Instance) GetRoomConfig(liveURL string) (configs.Room, *configs.Config) {
+	config := i.GetConfig()
+	room := config.Room(liveURL)
+	return room, config.ForRoom(room)
+}
+
+// SetConfig replace the config on reload
+func (i *Instance) SetConfig(config *configs.Config) {
+	i.configLock.Lock()
+	defer i.configLock.Unlock()
+	i.config = config
 }
 
 // GetInstance get ctx instance
@@ -2,43 +2,525 @@ package manager
 
 import (
 	"context"
+	"fmt"
 	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/danmaku"
+	"github.com/lintmx/dd-recorder/event"
+	"github.com/lintmx/dd-recorder/history"
+	"github.com/lintmx/dd-recorder/hook"
 	"github.com/lintmx/dd-recorder/instance"
+	"github.com/lintmx/dd-recorder/metrics"
 	"github.com/lintmx/dd-recorder/monitor"
+	"github.com/lintmx/dd-recorder/postprocess"
+	"github.com/lintmx/dd-recorder/server"
 	"github.com/lintmx/dd-recorder/utils"
+	"github.com/lintmx/dd-recorder/webhook"
 	"go.uber.org/zap"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// DD start
-func DD(ctx context.Context) {
+// recent events kept in memory
+const eventBufferSize = 200
+
+// ErrNotFound is returned for an unknown monitor id
+var ErrNotFound = fmt.Errorf("monitor not found")
+
+// Manager own the monitors, they can be added and removed at runtime
+type Manager struct {
+	ctx      context.Context
+	lock     sync.RWMutex
+	monitors map[string]*entry
+	// ids in adding order
+	order   []string
+	events  *event.Buffer
+	hooks   *hook.Runner
+	webhook *webhook.Sender
+	history *history.Store
+	// reloadLock serialize reloads
+	reloadLock sync.Mutex
+	// ready is 1 once rooms of the config are started
+	ready int32
+}
+
+type entry struct {
+	monitor *monitor.Monitor
+	cancel  context.CancelFunc
+	// fromConfig monitor is retired when its room leave the config
+	fromConfig bool
+}
+
+// DD start services and monitors of config rooms, return the manager
+func DD(ctx context.Context) *Manager {
 	inst := instance.GetInstance(ctx)
+	config := inst.GetConfig()
+
+	m := New(ctx)
+	inst.Events.Subscribe(m.events.Handle)
+	m.history = startHistory(ctx)
+	if m.history == nil {
+		// files left open are unknown, repair danmaku written before start in background
+		before := time.Now().Truncate(time.Second)
+		inst.WaitGroup.Add(1)
+		go func() {
+			defer inst.WaitGroup.Done()
+			for _, outPath := range outPaths(config) {
+				danmaku.RepairXMLFiles(outPath, before)
+			}
+		}()
+	}
+
+	if len(config.PostProcess.Steps) > 0 {
+		startPostProcess(ctx)
+	}
+	m.hooks = hook.New(config.Hooks, inst.WaitGroup)
+	m.hooks.SetRooms(roomHooks(config))
+	inst.Events.Subscribe(m.hooks.Handle)
+	if len(config.Webhooks) > 0 {
+		m.webhook = startWebhook(ctx)
+	}
+	if config.HTTP.Listen != "" {
+		startServer(ctx, m)
+	}
 
 	// run monitor with room
-	for _, room := range inst.Config.Rooms {
-		u, err := url.Parse(room)
+	for _, room := range config.Rooms {
+		if !room.IsEnabled() {
+			continue
+		}
+		if _, err := m.add(room.URL, true); err != nil {
+			zap.L().Error("Room Init Error",
+				zap.String("url", room.URL),
+				zap.String("Err", err.Error()),
+			)
+		}
+	}
+	atomic.StoreInt32(&m.ready, 1)
 
-		if err != nil {
-			zap.S().Error("Room Url Parse Error", zap.String("url", room))
+	return m
+}
+
+// New return a manager without monitors
+func New(ctx context.Context) *Manager {
+	return &Manager{
+		ctx:      ctx,
+		monitors: make(map[string]*entry),
+		events:   event.NewBuffer(eventBufferSize),
+	}
+}
+
+// roomID parse room url and return the monitor id
+func roomID(room string) (string, *url.URL, error) {
+	u, err := url.Parse(room)
+	if err != nil || u.Host == "" {
+		return "", nil, fmt.Errorf("room url %q invalid", room)
+	}
+	if api.Match(u) == nil {
+		return "", nil, fmt.Errorf("room %s not support", room)
+	}
+
+	return utils.BKDRHash64(u.String()), u, nil
+}
+
+// Add start a monitor of room url
+func (m *Manager) Add(room string) (monitor.Status, error) {
+	return m.add(room, false)
+}
+
+func (m *Manager) add(room string, fromConfig bool) (monitor.Status, error) {
+	id, u, err := roomID(room)
+	if err != nil {
+		return monitor.Status{}, err
+	}
+
+	m.lock.RLock()
+	_, ok := m.monitors[id]
+	m.lock.RUnlock()
+	if ok {
+		return monitor.Status{}, fmt.Errorf("room %s already exists", room)
+	}
+
+	live := api.Check(u)
+	if live == nil {
+		return monitor.Status{}, fmt.Errorf("room %s init failed", room)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.monitors[id]; ok {
+		return monitor.Status{}, fmt.Errorf("room %s already exists", room)
+	}
+	if m.ctx.Err() != nil {
+		return monitor.Status{}, fmt.Errorf("manager stopped")
+	}
+
+	mon := monitor.New(id, live)
+	ctx, cancel := context.WithCancel(m.ctx)
+	e := &entry{monitor: mon, cancel: cancel, fromConfig: fromConfig}
+	m.monitors[id] = e
+	m.order = append(m.order, id)
+
+	zap.L().Info("Monitor Init",
+		zap.String("Id", mon.MonitorID),
+		zap.String("Author", live.GetAuthor()),
+		zap.String("Platform", live.GetPlatformName()),
+	)
+	instance.GetInstance(ctx).WaitGroup.Add(1)
+	go mon.Run(ctx)
+
+	// forget a retired monitor
+	go func() {
+		<-mon.Done()
+		cancel()
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if m.monitors[id] == e {
+			m.remove(id)
+		}
+	}()
+
+	return mon.Status(), nil
+}
+
+// Remove stop the monitor and its recording
+func (m *Manager) Remove(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.monitors[id]
+	if !ok {
+		return ErrNotFound
+	}
+	e.cancel()
+	m.remove(id)
+
+	zap.L().Info("Monitor Remove", zap.String("Id", id))
+	return nil
+}
+
+// remove forget monitor id, lock held
+func (m *Manager) remove(id string) {
+	delete(m.monitors, id)
+	for i, item := range m.order {
+		if item == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Manager) get(id string) (*monitor.Monitor, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	e, ok := m.monitors[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e.monitor, nil
+}
+
+// List return status of monitors in adding order
+func (m *Manager) List() []monitor.Status {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	list := make([]monitor.Status, 0, len(m.order))
+	for _, id := range m.order {
+		list = append(list, m.monitors[id].monitor.Status())
+	}
+	return list
+}
+
+// History return recorded sessions matching query, newest first
+func (m *Manager) History(query history.Query) ([]history.Session, error) {
+	if m.history == nil {
+		return nil, fmt.Errorf("history disabled")
+	}
+	return m.history.Sessions(query)
+}
+
+// HistorySession return a recorded session
+func (m *Manager) HistorySession(id string) (history.Session, error) {
+	if m.history == nil {
+		return history.Session{}, fmt.Errorf("history disabled")
+	}
+	return m.history.Session(id)
+}
+
+// Ready return true once rooms of the config are started
+func (m *Manager) Ready() bool {
+	return atomic.LoadInt32(&m.ready) == 1
+}
+
+// collectMetrics set room gauges from the monitors, removed rooms are dropped
+func (m *Manager) collectMetrics() {
+	for _, gauge := range []*metrics.Gauge{metrics.RoomLive, metrics.RoomRecording, metrics.RoomFileSize, metrics.RoomBitrate} {
+		gauge.Reset()
+	}
+
+	for _, status := range m.List() {
+		labels := []string{status.ID, status.Platform, status.Author}
+		metrics.RoomLive.Set(metrics.Bool(status.Live), labels...)
+		metrics.RoomRecording.Set(metrics.Bool(status.Recording), labels...)
+		metrics.RoomFileSize.Set(float64(status.Size), labels...)
+		metrics.RoomBitrate.Set(status.Bitrate, labels...)
+	}
+}
+
+// Status return status of a monitor
+func (m *Manager) Status(id string) (monitor.Status, error) {
+	mon, err := m.get(id)
+	if err != nil {
+		return monitor.Status{}, err
+	}
+	return mon.Status(), nil
+}
+
+// Pause stop refreshing and recording a monitor
+func (m *Manager) Pause(id string) error {
+	return m.control(id, (*monitor.Monitor).Pause)
+}
+
+// Resume a paused monitor
+func (m *Manager) Resume(id string) error {
+	return m.control(id, (*monitor.Monitor).Resume)
+}
+
+// StartRecord force a monitor to record
+func (m *Manager) StartRecord(id string) error {
+	return m.control(id, (*monitor.Monitor).StartRecord)
+}
+
+// StopRecord stop the recording of a monitor until the next live
+func (m *Manager) StopRecord(id string) error {
+	return m.control(id, (*monitor.Monitor).StopRecord)
+}
+
+func (m *Manager) control(id string, f func(*monitor.Monitor) error) error {
+	mon, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	return f(mon)
+}
+
+// Events return recent events, newest first
+func (m *Manager) Events(monitorID string, limit int) []event.Event {
+	return m.events.Events(monitorID, limit)
+}
+
+// Reload apply a new config. Monitors of new rooms are started, monitors of removed
+// rooms retire after their recordings finish, rooms added by api are kept.
+// Recording settings take effect from the next recording.
+func (m *Manager) Reload(config *configs.Config) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	inst := instance.GetInstance(m.ctx)
+	warnRestart(inst.GetConfig(), config)
+	inst.SetConfig(config)
+
+	if m.hooks != nil {
+		m.hooks.SetConfig(config.Hooks)
+		m.hooks.SetRooms(roomHooks(config))
+	}
+	if m.webhook != nil {
+		m.webhook.SetHooks(config.Webhooks)
+	} else if len(config.Webhooks) > 0 {
+		m.webhook = startWebhook(m.ctx)
+	}
+
+	wanted := make(map[string]bool)
+	for _, room := range config.Rooms {
+		if !room.IsEnabled() {
 			continue
 		}
+		if id, _, err := roomID(room.URL); err == nil {
+			wanted[id] = true
+		}
+	}
 
-		api := api.Check(u)
-		if api == nil {
-			zap.S().Error("Room not support", zap.String("host", u.Host))
-		} else {
-			inst.WaitGroup.Add(1)
-			m := monitor.Monitor{
-				MonitorID: utils.BKDRHash64(u.String()),
-				LiveAPI:   api,
-			}
+	m.lock.Lock()
+	entries := make(map[string]*entry, len(m.monitors))
+	for id, e := range m.monitors {
+		entries[id] = e
+		if wanted[id] {
+			e.fromConfig = true
+		}
+	}
+	m.lock.Unlock()
+
+	for id, e := range entries {
+		var err error
+		switch {
+		case wanted[id] && e.monitor.Status().Retiring:
+			err = e.monitor.Unretire()
+		case !wanted[id] && e.fromConfig:
+			zap.L().Info("Monitor Retire", zap.String("Id", id))
+			err = e.monitor.Retire()
+		default:
+			err = e.monitor.Reload()
+		}
+		if err != nil {
+			zap.L().Debug("Monitor Reload", zap.String("Id", id), zap.String("Err", err.Error()))
+		}
+	}
 
-			zap.L().Info("Monitor Init",
-				zap.String("Id", m.MonitorID),
-				zap.String("Author", m.LiveAPI.GetAuthor()),
-				zap.String("Platform", m.LiveAPI.GetPlatformName()),
+	for _, room := range config.Rooms {
+		if !room.IsEnabled() {
+			continue
+		}
+		if id, _, err := roomID(room.URL); err == nil && entries[id] != nil {
+			continue
+		}
+		if _, err := m.add(room.URL, true); err != nil {
+			zap.L().Error("Room Init Error",
+				zap.String("url", room.URL),
+				zap.String("Err", err.Error()),
 			)
-			go m.Run(ctx)
 		}
 	}
+
+	zap.L().Info("Config Reload", zap.Int("Rooms", len(config.Rooms)))
+}
+
+// roomHooks return hooks of rooms having their own, by live url
+func roomHooks(config *configs.Config) map[string]configs.HookConfig {
+	hooks := make(map[string]configs.HookConfig)
+	for _, room := range config.Rooms {
+		if reflect.DeepEqual(room.Hooks, configs.HookConfig{}) {
+			continue
+		}
+		if _, u, err := roomID(room.URL); err == nil {
+			hooks[u.String()] = config.ForRoom(room).Hooks
+		}
+	}
+	return hooks
+}
+
+// outPaths return the global output path and those of rooms
+func outPaths(config *configs.Config) []string {
+	paths := []string{config.OutPath}
+	for _, room := range config.Rooms {
+		if room.OutPath != "" && room.OutPath != config.OutPath {
+			paths = append(paths, room.OutPath)
+		}
+	}
+	return paths
+}
+
+// warnRestart log settings which only take effect after restart
+func warnRestart(old, config *configs.Config) {
+	changed := []string{}
+	if old.Debug != config.Debug {
+		changed = append(changed, "debug")
+	}
+	if old.LogPath != config.LogPath {
+		changed = append(changed, "log_path")
+	}
+	// the dashboard serve output paths of rooms at start
+	if !reflect.DeepEqual(outPaths(old), outPaths(config)) {
+		changed = append(changed, "out_path")
+	}
+	if !reflect.DeepEqual(old.PostProcess, config.PostProcess) {
+		changed = append(changed, "postprocess")
+	}
+	if old.WebhookQueue != config.WebhookQueue {
+		changed = append(changed, "webhook_queue")
+	}
+	if old.HTTP != config.HTTP {
+		changed = append(changed, "http")
+	}
+	if old.History != config.History {
+		changed = append(changed, "history")
+	}
+
+	if len(changed) > 0 {
+		zap.L().Warn("Config Reload",
+			zap.Strings("Restart Required", changed),
+		)
+	}
+}
+
+// startPostProcess run post process of finished files
+func startPostProcess(ctx context.Context) {
+	inst := instance.GetInstance(ctx)
+	config := inst.GetConfig()
+
+	// the queue is kept in the global output path, jobs of every room share it
+	for _, outPath := range outPaths(config) {
+		os.MkdirAll(outPath, os.ModePerm)
+	}
+	p, err := postprocess.New(config.PostProcess, config.OutPath, danmaku.NewASSOptions(config.ASS))
+	if err != nil {
+		zap.L().Error("Post Process Init", zap.String("Err", err.Error()))
+		return
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil && p.NeedFFmpeg() {
+		zap.L().Error("Post Process Init", zap.String("Err", "ffmpeg not found"))
+		return
+	}
+
+	inst.Events.Subscribe(p.Handle)
+	inst.WaitGroup.Add(1)
+	go p.Run(ctx)
+}
+
+// startHistory record sessions and files in the history database
+func startHistory(ctx context.Context) *history.Store {
+	inst := instance.GetInstance(ctx)
+	config := inst.GetConfig()
+
+	s := history.New(history.Path(config))
+	files, err := s.Recover()
+	if err != nil {
+		zap.L().Error("History Init", zap.String("Err", err.Error()))
+		return nil
+	}
+	// danmaku of sessions left recording by an unclean exit
+	danmaku.RepairVideoXML(files)
+
+	inst.Events.Subscribe(s.Handle)
+	return s
+}
+
+// startWebhook send events to webhooks
+func startWebhook(ctx context.Context) *webhook.Sender {
+	inst := instance.GetInstance(ctx)
+	config := inst.GetConfig()
+
+	dir := config.WebhookQueue
+	if dir == "" {
+		dir = filepath.Join(config.OutPath, ".webhook")
+	}
+	s, err := webhook.New(config.Webhooks, dir)
+	if err != nil {
+		zap.L().Error("Webhook Init", zap.String("Err", err.Error()))
+		return nil
+	}
+
+	inst.Events.Subscribe(s.Handle)
+	inst.WaitGroup.Add(1)
+	go s.Run(ctx)
+
+	return s
+}
+
+// startServer serve the control api
+func startServer(ctx context.Context, m *Manager) {
+	inst := instance.GetInstance(ctx)
+	config := inst.GetConfig()
+
+	metrics.OnScrape(m.collectMetrics)
+	s := server.New(config.HTTP, outPaths(config), m)
+	inst.WaitGroup.Add(1)
+	go s.Run(ctx)
 }
@@ -0,0 +1,215 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+	"github.com/lintmx/dd-recorder/instance"
+	"github.com/lintmx/dd-recorder/monitor"
+)
+
+// fakeLive is a room whose status is set by the test
+type fakeLive struct {
+	*api.BaseAPI
+}
+
+// live status of fake rooms by url
+var fakeRooms sync.Map
+
+func (f *fakeLive) RefreshLiveInfo() error {
+	live, _ := fakeRooms.Load(f.GetLiveURL())
+	f.SetLiveStatus(live == true)
+	f.SetTitle("title")
+	f.SetAuthor("author")
+	return nil
+}
+
+func (f *fakeLive) GetStreamURLs() ([]api.StreamURL, error) {
+	return nil, fmt.Errorf("no stream")
+}
+
+func (f *fakeLive) GetDanmaku(chan struct{}) (<-chan *api.DanmakuMessage, error) {
+	return nil, fmt.Errorf("no danmaku")
+}
+
+func init() {
+	api.Register(&api.Platform{
+		Name:  "Fake",
+		Hosts: []string{"fake.test"},
+		New: func(base *api.BaseAPI) api.LiveAPI {
+			return &fakeLive{BaseAPI: base}
+		},
+	})
+}
+
+func TestManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inst := instance.New(&configs.Config{Interval: 60, OutPath: dir})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), instance.InstanceKey, inst))
+	m := New(ctx)
+	inst.Events.Subscribe(m.events.Handle)
+	fakeRooms.Store("https://fake.test/1", false)
+
+	status, err := m.Add("https://fake.test/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := status.ID
+	if _, err := m.Add("https://fake.test/1"); err == nil {
+		t.Error("add a room twice")
+	}
+	if _, err := m.Add("https://unknown.test/1"); err == nil {
+		t.Error("add an unsupported room")
+	}
+
+	check := func(step string, err error, want monitor.Status) {
+		if err != nil {
+			t.Fatalf("%s: %s", step, err.Error())
+		}
+		got, _ := m.Status(id)
+		if got.Live != want.Live || got.Recording != want.Recording || got.Paused != want.Paused {
+			t.Errorf("%s: live %v recording %v paused %v, want %v %v %v", step,
+				got.Live, got.Recording, got.Paused, want.Live, want.Recording, want.Paused)
+		}
+	}
+
+	check("pause", m.Pause(id), monitor.Status{Paused: true})
+	fakeRooms.Store("https://fake.test/1", true)
+	check("resume", m.Resume(id), monitor.Status{Live: true, Recording: true})
+	check("stop", m.StopRecord(id), monitor.Status{Live: true})
+	check("resume not paused", m.Resume(id), monitor.Status{Live: true})
+	check("start", m.StartRecord(id), monitor.Status{Live: true, Recording: true})
+	check("pause recording", m.Pause(id), monitor.Status{Live: true, Paused: true})
+	check("start paused", m.StartRecord(id), monitor.Status{Live: true, Recording: true, Paused: true})
+
+	if list := m.List(); len(list) != 1 || list[0].Author != "author" {
+		t.Errorf("list %+v", list)
+	}
+
+	if err := m.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Pause(id); err != ErrNotFound {
+		t.Errorf("pause removed monitor = %v", err)
+	}
+	if len(m.List()) != 0 {
+		t.Errorf("list %+v after remove", m.List())
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		inst.WaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("manager not stopped")
+	}
+
+	// the room went live once and was recorded three times
+	count := map[event.Type]int{}
+	for _, e := range m.Events(id, 0) {
+		count[e.Type]++
+	}
+	if count[event.LiveStart] != 1 || count[event.RecordStart] != 3 {
+		t.Errorf("%d live start and %d record start events, want 1 and 3", count[event.LiveStart], count[event.RecordStart])
+	}
+}
+
+func TestManagerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inst := instance.New(&configs.Config{Interval: 60, OutPath: dir})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), instance.InstanceKey, inst))
+	m := New(ctx)
+
+	roomA, roomB, roomC := "https://fake.test/reload/a", "https://fake.test/reload/b", "https://fake.test/reload/c"
+	idA, _, _ := roomID(roomA)
+	fakeRooms.Store(roomA, false)
+	rooms := func(want ...string) {
+		var got []string
+		for i := 0; i < 100; i++ {
+			got = []string{}
+			for _, status := range m.List() {
+				got = append(got, status.URL)
+			}
+			if fmt.Sprint(got) == fmt.Sprint(want) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("rooms %v, want %v", got, want)
+	}
+
+	// a is recording
+	fakeRooms.Store(roomA, true)
+	m.Reload(&configs.Config{Interval: 60, OutPath: dir, Rooms: configs.Rooms([]string{roomA, roomB})})
+	if _, err := m.Add(roomC); err != nil {
+		t.Fatal(err)
+	}
+	rooms(roomA, roomB, roomC)
+	for i := 0; i < 100; i++ {
+		if status, _ := m.Status(idA); status.Recording {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a retire after the live, c is added by api and kept
+	m.Reload(&configs.Config{Interval: 30, OutPath: dir, Rooms: configs.Rooms([]string{roomB})})
+	if inst.GetConfig().Interval != 30 {
+		t.Errorf("interval %d, want 30", inst.GetConfig().Interval)
+	}
+	status, _ := m.Status(idA)
+	if !status.Retiring || !status.Recording {
+		t.Errorf("a retiring %v recording %v, want both", status.Retiring, status.Recording)
+	}
+	rooms(roomA, roomB, roomC)
+
+	fakeRooms.Store(roomA, false)
+	m.Pause(idA)
+	rooms(roomB, roomC)
+
+	// back again
+	m.Reload(&configs.Config{Interval: 30, OutPath: dir, Rooms: configs.Rooms([]string{roomB, roomA})})
+	rooms(roomB, roomC, roomA)
+
+	// disabled rooms are retired too
+	disabled := false
+	m.Reload(&configs.Config{Interval: 30, OutPath: dir, Rooms: []configs.Room{
+		{URL: roomA, Enabled: &disabled},
+		{URL: roomB, Enabled: &disabled},
+	}})
+	rooms(roomC)
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		inst.WaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("manager not stopped")
+	}
+}
@@ -0,0 +1,278 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// labels of room metrics
+var roomLabels = []string{"monitor_id", "platform", "author"}
+
+// DefBuckets of latency histograms in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics of the recorder, room gauges are set before each scrape
+var (
+	RoomLive          = NewGauge("dd_room_live", "Whether the room is live.", roomLabels...)
+	RoomRecording     = NewGauge("dd_room_recording", "Whether the room is recording.", roomLabels...)
+	RoomFileSize      = NewGauge("dd_room_file_size_bytes", "Size of the current recording file.", roomLabels...)
+	RoomBitrate       = NewGauge("dd_room_bitrate_bits_per_second", "Bitrate of the recording stream.", roomLabels...)
+	BytesWritten      = NewCounter("dd_bytes_written_total", "Bytes of stream written to files.", roomLabels...)
+	DanmakuReceived   = NewCounter("dd_danmaku_received_total", "Danmaku received by type.", append(roomLabels, "type")...)
+	DanmakuReconnects = NewCounter("dd_danmaku_reconnects_total", "Reconnections of the danmaku source.", roomLabels...)
+	FFmpegRestarts    = NewCounter("dd_ffmpeg_restarts_total", "Restarts of ffmpeg after it exited.", roomLabels...)
+	APIErrors         = NewCounter("dd_api_errors_total", "Failed requests to platform apis by endpoint.", "platform", "endpoint")
+	RefreshDuration   = NewHistogram("dd_refresh_duration_seconds", "Latency of refreshing live info.", DefBuckets, roomLabels...)
+)
+
+// metric types
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+var (
+	registryLock sync.Mutex
+	registry     []*vec
+	collectors   []func()
+	// scrapeLock serialize scrapes, gauges are reset by collectors
+	scrapeLock sync.Mutex
+)
+
+// OnScrape add a function called before each scrape, to set gauges
+func OnScrape(collect func()) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	collectors = append(collectors, collect)
+}
+
+// vec is a metric family, series are keyed by label values
+type vec struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*series
+}
+
+// series of a label set, counts are used by histograms only
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newVec(name, help, typ string, buckets []float64, labels []string) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, v)
+	return v
+}
+
+// with call f with the series of values, lock held
+func (v *vec) with(values []string, f func(s *series)) {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s want %d labels, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if v.typ == typeHistogram {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	f(s)
+}
+
+// Reset remove all series
+func (v *vec) Reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.series = make(map[string]*series)
+}
+
+// Counter only go up
+type Counter struct{ *vec }
+
+// NewCounter register a counter with label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newVec(name, help, typeCounter, nil, labels)}
+}
+
+// Add v to the series of label values, v must not be negative
+func (c *Counter) Add(v float64, values ...string) {
+	c.with(values, func(s *series) {
+		s.value += v
+	})
+}
+
+// Inc add 1 to the series of label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct{ *vec }
+
+// NewGauge register a gauge with label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newVec(name, help, typeGauge, nil, labels)}
+}
+
+// Set the series of label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	g.with(values, func(s *series) {
+		s.value = v
+	})
+}
+
+// Histogram count observations in buckets
+type Histogram struct{ *vec }
+
+// NewHistogram register a histogram with upper bounds of buckets in ascending order
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{newVec(name, help, typeHistogram, buckets, labels)}
+}
+
+// Observe add v to the series of label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.with(values, func(s *series) {
+		for i, bound := range h.buckets {
+			if v <= bound {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += v
+	})
+}
+
+// Bool return 1 for true, for gauges of a state
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Handler serve metrics in the prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write all metrics in the prometheus text format
+func Write(w io.Writer) error {
+	scrapeLock.Lock()
+	defer scrapeLock.Unlock()
+
+	registryLock.Lock()
+	vecs := registry
+	collects := collectors
+	registryLock.Unlock()
+
+	for _, collect := range collects {
+		collect()
+	}
+
+	for _, v := range vecs {
+		if _, err := io.WriteString(w, v.text()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// text return the family in the text format
+func (v *vec) text() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, escape(v.help, false))
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.typ != typeHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", v.name, v.labelText(s.values, ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, bound := range v.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelText(s.values, formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelText(s.values, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, v.labelText(s.values, ""), formatFloat(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, v.labelText(s.values, ""), s.count)
+	}
+	return b.String()
+}
+
+// labelText return {name="value",...}, le is added if not empty
+func (v *vec) labelText(values []string, le string) string {
+	pairs := []string{}
+	for i, name := range v.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(values[i], true)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape backslash and newline, and double quote in label values
+func escape(s string, quote bool) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	if quote {
+		replacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	}
+	return replacer.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
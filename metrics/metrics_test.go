@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	counter := NewCounter("test_total", "Test counter.", "room", "type")
+	counter.Inc("b", "chat")
+	counter.Add(2.5, "a", `say "hi"`)
+	counter.Inc("b", "chat")
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{room="a",type="say \"hi\""} 2.5
+test_total{room="b",type="chat"} 2
+`
+	if got := counter.text(); got != want {
+		t.Errorf("counter:\n%s\nwant:\n%s", got, want)
+	}
+
+	histogram := NewHistogram("test_seconds", "Test histogram.", []float64{0.1, 1}, "room")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(3, "a")
+
+	want = `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{room="a",le="0.1"} 1
+test_seconds_bucket{room="a",le="1"} 2
+test_seconds_bucket{room="a",le="+Inf"} 3
+test_seconds_sum{room="a"} 3.55
+test_seconds_count{room="a"} 3
+`
+	if got := histogram.text(); got != want {
+		t.Errorf("histogram:\n%s\nwant:\n%s", got, want)
+	}
+
+	// gauges are set by collectors before a scrape
+	gauge := NewGauge("test_live", "Test gauge.", "room")
+	gauge.Set(1, "removed")
+	OnScrape(func() {
+		gauge.Reset()
+		gauge.Set(Bool(true), "a")
+	})
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE dd_refresh_duration_seconds histogram\n",
+		"test_total{room=\"b\",type=\"chat\"} 2\n",
+		"# TYPE test_live gauge\ntest_live{room=\"a\"} 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "removed") {
+		t.Error("reset series scraped")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong label count not panic")
+		}
+	}()
+	counter.Inc("a")
+}
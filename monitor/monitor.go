@@ -2,10 +2,17 @@ package monitor
 
 import (
 	"context"
+	"fmt"
 	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/event"
 	"github.com/lintmx/dd-recorder/instance"
+	"github.com/lintmx/dd-recorder/metrics"
 	"github.com/lintmx/dd-recorder/record"
 	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,32 +21,145 @@ type Monitor struct {
 	MonitorID  string
 	LiveAPI    api.LiveAPI
 	LiveStatus bool
+	Title      string
 	StopChan   chan struct{}
 	rec        *record.Record
+	// control run commands in the monitor goroutine
+	control chan func(ctx context.Context)
+	exited  chan struct{}
+	paused  bool
+	// force keep recording whatever the live status
+	force bool
+	// skip the rest of the live stopped by hand
+	skip bool
+	// retiring monitor exit once not recording
+	retiring bool
+	// name of the room in config
+	name       string
+	statusLock sync.RWMutex
+	status     Status
+}
+
+// Status is a snapshot of a monitor
+type Status struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Name      string `json:"name,omitempty"`
+	Platform  string `json:"platform"`
+	Author    string `json:"author"`
+	Title     string `json:"title"`
+	Live      bool   `json:"live"`
+	Recording bool   `json:"recording"`
+	Paused    bool   `json:"paused"`
+	Retiring  bool   `json:"retiring,omitempty"`
+	// File is the output file without extension
+	File string `json:"file,omitempty"`
+	// Size of the recording video file in bytes
+	Size int64 `json:"size,omitempty"`
+	// Bitrate of the recording stream in bits per second
+	Bitrate    float64    `json:"bitrate,omitempty"`
+	RecordTime *time.Time `json:"record_time,omitempty"`
+	// LastWrite and LastDanmaku of the recording, nil if nothing received
+	LastWrite   *time.Time `json:"last_write,omitempty"`
+	LastDanmaku *time.Time `json:"last_danmaku,omitempty"`
+	// Stalled parts of the recording, stream or danmaku
+	Stalled []string `json:"stalled,omitempty"`
+}
+
+// stalled parts of a recording
+const (
+	StalledStream  = "stream"
+	StalledDanmaku = "danmaku"
+)
+
+// New return a monitor of live
+func New(monitorID string, liveAPI api.LiveAPI) *Monitor {
+	m := &Monitor{
+		MonitorID: monitorID,
+		LiveAPI:   liveAPI,
+		rec:       record.New(monitorID, liveAPI),
+		control:   make(chan func(ctx context.Context)),
+		exited:    make(chan struct{}),
+	}
+	m.update()
+
+	return m
 }
 
 // Run a dd monitor
 func (m *Monitor) Run(ctx context.Context) {
 	inst := instance.GetInstance(ctx)
 	defer inst.WaitGroup.Done()
+	defer close(m.exited)
 	timer := time.NewTimer(0)
-	m.rec = record.New(m.MonitorID, m.LiveAPI)
+	interval := m.applyConfig(ctx)
+	m.update()
 
 	for {
 		select {
 		case <-ctx.Done(): // Exit Signal
-			m.rec.Stop()
+			m.rec.Stop(event.ReasonShutdown)
 			return
+		case f := <-m.control:
+			f(ctx)
+			// apply a reloaded interval
+			d := m.applyConfig(ctx)
+			m.update()
+			if d != interval {
+				interval = d
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(interval)
+			}
 		case <-timer.C:
-			m.refresh(ctx)
-			timer.Reset(time.Duration(inst.Config.Interval) * time.Second)
+			if !m.paused {
+				m.refresh(ctx)
+			}
+			interval = m.applyConfig(ctx)
+			m.update()
+			timer.Reset(interval)
+		}
+
+		if m.retiring && !m.rec.Recording() {
+			zap.L().Info("Monitor Retired", zap.String("Id", m.MonitorID))
+			return
 		}
 	}
 }
 
+// applyConfig read settings of the room, return the refresh interval
+func (m *Monitor) applyConfig(ctx context.Context) time.Duration {
+	room, config := instance.GetInstance(ctx).GetRoomConfig(m.LiveAPI.GetLiveURL())
+	m.name = room.Name
+
+	return time.Duration(config.Interval) * time.Second
+}
+
+// titleChanged log and publish a title change while live, it is marked in the danmaku of the recording,
+// the recording is cut if split_on_title is set for the room
+func (m *Monitor) titleChanged(ctx context.Context, title string) {
+	inst := instance.GetInstance(ctx)
+	zap.L().Info("Title Change",
+		zap.String("Id", m.MonitorID),
+		zap.String("From", m.Title),
+		zap.String("To", title),
+	)
+	inst.Events.Publish(event.New(event.TitleChange, m.MonitorID, m.LiveAPI))
+	m.rec.TitleChanged(title)
+	if _, config := inst.GetRoomConfig(m.LiveAPI.GetLiveURL()); config.SplitOnTitle {
+		m.rec.Split()
+	}
+}
+
 // Refresh live status
 func (m *Monitor) refresh(ctx context.Context) {
+	start := time.Now()
 	err := m.LiveAPI.RefreshLiveInfo()
+	metrics.RefreshDuration.Observe(time.Since(start).Seconds(), api.MetricLabels(m.LiveAPI)...)
 
 	if err != nil {
 		zap.L().Error("Refresh Live Info",
@@ -49,14 +169,214 @@ func (m *Monitor) refresh(ctx context.Context) {
 		return
 	}
 
-	if m.LiveStatus != m.LiveAPI.GetLiveStatus() {
-		m.LiveStatus = m.LiveAPI.GetLiveStatus()
+	title := m.LiveAPI.GetTitle()
+	if m.LiveStatus && m.Title != "" && title != m.Title {
+		m.titleChanged(ctx, title)
+	}
+	m.Title = title
+
+	live := m.LiveAPI.GetLiveStatus()
+	if m.LiveStatus && !live {
+		// the live is over, so is the hand control
+		m.force = false
+		m.skip = false
+	}
+	if live != m.LiveStatus {
+		m.liveChanged(ctx, live)
+	}
+	m.LiveStatus = live
+	m.sync(ctx)
+}
+
+// liveChanged publish the live status of the room changed, whether recorded or not
+func (m *Monitor) liveChanged(ctx context.Context, live bool) {
+	t := event.LiveEnd
+	if live {
+		t = event.LiveStart
+	}
+	instance.GetInstance(ctx).Events.Publish(event.New(t, m.MonitorID, m.LiveAPI))
+}
+
+// sync start or stop the record to match the state
+func (m *Monitor) sync(ctx context.Context) {
+	if m.force || (!m.paused && m.LiveStatus && !m.skip) {
+		m.rec.Start(ctx)
+	} else {
+		m.rec.Stop(m.stopReason())
+	}
+}
+
+// stopReason return why the record is not wanted
+func (m *Monitor) stopReason() string {
+	switch {
+	case m.retiring:
+		return event.ReasonRemoved
+	case m.paused:
+		return event.ReasonPaused
+	case m.skip:
+		return event.ReasonStopped
+	case !m.LiveStatus:
+		return event.ReasonLiveEnd
+	}
+	return event.ReasonStopped
+}
+
+// update the status snapshot
+func (m *Monitor) update() {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+
+	m.status = Status{
+		ID:        m.MonitorID,
+		URL:       m.LiveAPI.GetLiveURL(),
+		Name:      m.name,
+		Platform:  m.LiveAPI.GetPlatformName(),
+		Author:    m.LiveAPI.GetAuthor(),
+		Title:     m.LiveAPI.GetTitle(),
+		Live:      m.LiveStatus,
+		Recording: m.rec.Recording(),
+		Paused:    m.paused,
+		Retiring:  m.retiring,
+		File:      m.rec.OutFile(),
+	}
+	if m.status.Recording {
+		recordTime := m.rec.RecordTime()
+		m.status.RecordTime = &recordTime
+	}
+}
 
-		if m.LiveStatus {
-			instance.GetInstance(ctx).WaitGroup.Add(1)
-			go m.rec.Start(ctx)
-		} else {
-			m.rec.Stop()
+// Status return the status of the last refresh or command, with the current file
+func (m *Monitor) Status() Status {
+	m.statusLock.RLock()
+	status := m.status
+	m.statusLock.RUnlock()
+
+	if status.Recording {
+		status.File = m.rec.OutFile()
+		status.Size = videoSize(status.File)
+		status.Bitrate = m.rec.Bitrate()
+
+		health := m.rec.Health()
+		if !health.LastWrite.IsZero() {
+			status.LastWrite = &health.LastWrite
+		}
+		if !health.LastDanmaku.IsZero() {
+			status.LastDanmaku = &health.LastDanmaku
+		}
+		if health.StreamStalled {
+			status.Stalled = append(status.Stalled, StalledStream)
+		}
+		if health.DanmakuStalled {
+			status.Stalled = append(status.Stalled, StalledDanmaku)
+		}
+	}
+	return status
+}
+
+// videoSize return the size of the video named base, danmaku files are not counted
+func videoSize(base string) int64 {
+	if base == "" {
+		return 0
+	}
+
+	files, _ := filepath.Glob(globEscape(base) + ".*")
+	var size int64
+	for _, file := range files {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".xml", ".ass", ".jsonl":
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			size += info.Size()
 		}
 	}
+	return size
+}
+
+// globEscape escape glob meta characters in a path
+func globEscape(path string) string {
+	replacer := strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]")
+	return replacer.Replace(path)
+}
+
+// do run f in the monitor goroutine and wait for it
+func (m *Monitor) do(f func(ctx context.Context)) error {
+	done := make(chan struct{})
+	select {
+	case m.control <- func(ctx context.Context) {
+		f(ctx)
+		close(done)
+	}:
+	case <-m.exited:
+		return fmt.Errorf("monitor %s stopped", m.MonitorID)
+	}
+
+	<-done
+	return nil
+}
+
+// Pause stop refreshing and recording
+func (m *Monitor) Pause() error {
+	return m.do(func(ctx context.Context) {
+		m.paused = true
+		m.force = false
+		m.sync(ctx)
+	})
+}
+
+// Resume refresh and record again
+func (m *Monitor) Resume() error {
+	return m.do(func(ctx context.Context) {
+		if !m.paused {
+			return
+		}
+		m.paused = false
+		m.refresh(ctx)
+	})
+}
+
+// StartRecord record now until stopped by hand or the live end, even if offline or paused
+func (m *Monitor) StartRecord() error {
+	return m.do(func(ctx context.Context) {
+		m.force = true
+		m.skip = false
+		m.sync(ctx)
+	})
+}
+
+// StopRecord stop recording, the rest of the current live is skipped
+func (m *Monitor) StopRecord() error {
+	return m.do(func(ctx context.Context) {
+		m.force = false
+		m.skip = m.LiveStatus
+		// a forced recording of an offline room too
+		m.rec.Stop(event.ReasonStopped)
+		m.sync(ctx)
+	})
+}
+
+// Reload apply the current config, the refresh interval change at once
+func (m *Monitor) Reload() error {
+	return m.do(func(ctx context.Context) {})
+}
+
+// Retire exit the monitor once the recording finished, forced recording stop now
+func (m *Monitor) Retire() error {
+	return m.do(func(ctx context.Context) {
+		m.retiring = true
+		m.force = false
+		m.sync(ctx)
+	})
+}
+
+// Unretire keep a retiring monitor running
+func (m *Monitor) Unretire() error {
+	return m.do(func(ctx context.Context) {
+		m.retiring = false
+	})
+}
+
+// Done return a channel closed when the monitor exit
+func (m *Monitor) Done() <-chan struct{} {
+	return m.exited
 }
@@ -0,0 +1,383 @@
+package postprocess
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/danmaku"
+	"github.com/lintmx/dd-recorder/event"
+	"github.com/lintmx/dd-recorder/instance"
+	"go.uber.org/zap"
+)
+
+// job status
+const (
+	statusPending = "pending"
+	// wait for other files of the session to concat
+	statusWaiting = "waiting"
+)
+
+// Job is the processing of recorded files
+type Job struct {
+	ID        string `json:"id"`
+	MonitorID string `json:"monitor_id"`
+	Session   string `json:"session"`
+	// Sources are the recorded files
+	Sources []string `json:"sources"`
+	// Inputs are the files for the next step
+	Inputs []string `json:"inputs"`
+	// Temps are files made by a step and replaced by a later one
+	Temps []string `json:"temps,omitempty"`
+	// Step is the index of the next step
+	Step    int       `json:"step"`
+	Status  string    `json:"status"`
+	Merged  bool      `json:"merged,omitempty"`
+	Created time.Time `json:"created"`
+	running bool
+}
+
+// queueFile is the content of the job queue file
+type queueFile struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+// Processor run jobs in a bounded worker pool, unfinished jobs survive restarts
+type Processor struct {
+	steps      []string
+	workers    int
+	queuePath  string
+	assOptions danmaku.ASSOptions
+	lock       sync.Mutex
+	jobs       []*Job
+	ended      map[string]bool
+	notify     chan struct{}
+	seq        int
+	// run ffmpeg and ffprobe, replaced in tests
+	ffmpeg   func(ctx context.Context, args ...string) error
+	duration func(ctx context.Context, path string) (time.Duration, error)
+}
+
+// New check steps and load the job queue
+func New(conf configs.PostProcessConfig, outPath string, assOptions danmaku.ASSOptions) (*Processor, error) {
+	for _, step := range conf.Steps {
+		switch step {
+		case configs.StepFixFLV, configs.StepRemuxMP4, configs.StepRemuxMKV,
+			configs.StepConcat, configs.StepASS, configs.StepDeleteSource:
+		default:
+			return nil, fmt.Errorf("unknown post process step %s", step)
+		}
+	}
+
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	queuePath := conf.Queue
+	if queuePath == "" {
+		queuePath = filepath.Join(outPath, ".postprocess.json")
+	}
+
+	p := &Processor{
+		steps:      conf.Steps,
+		workers:    workers,
+		queuePath:  queuePath,
+		assOptions: assOptions,
+		ended:      make(map[string]bool),
+		notify:     make(chan struct{}, workers),
+		ffmpeg:     runFFmpeg,
+		duration:   probeDuration,
+	}
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// load jobs left by the last run, their sessions are over
+func (p *Processor) load() error {
+	data, err := ioutil.ReadFile(p.queuePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	queue := queueFile{}
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return fmt.Errorf("post process queue %s broken - %s", p.queuePath, err.Error())
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.jobs = queue.Jobs
+	for _, job := range p.jobs {
+		p.ended[job.Session] = true
+	}
+	for session := range p.ended {
+		p.tryConcat(session)
+	}
+
+	return nil
+}
+
+// Handle add a job for a finished file, subscribed to the event bus
+func (p *Processor) Handle(e *event.Event) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch e.Type {
+	case event.RecordFileClose:
+		p.seq++
+		p.jobs = append(p.jobs, &Job{
+			ID:        fmt.Sprintf("%d-%d", time.Now().UnixNano(), p.seq),
+			MonitorID: e.MonitorID,
+			Session:   e.Session,
+			Sources:   []string{e.File},
+			Inputs:    []string{e.File},
+			Status:    statusPending,
+			Created:   e.Time,
+		})
+		p.signal()
+	case event.RecordStop:
+		if !p.hasStep(configs.StepConcat) {
+			return
+		}
+		p.ended[e.Session] = true
+		p.tryConcat(e.Session)
+	default:
+		return
+	}
+
+	p.save()
+}
+
+// NeedFFmpeg return true if a step run ffmpeg
+func (p *Processor) NeedFFmpeg() bool {
+	return p.hasStep(configs.StepRemuxMP4) || p.hasStep(configs.StepRemuxMKV) || p.hasStep(configs.StepConcat)
+}
+
+func (p *Processor) hasStep(step string) bool {
+	for _, s := range p.steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Jobs return a copy of unfinished jobs
+func (p *Processor) Jobs() []Job {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	jobs := make([]Job, len(p.jobs))
+	for i, job := range p.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// Run start workers and block until ctx done
+func (p *Processor) Run(ctx context.Context) {
+	inst := instance.GetInstance(ctx)
+	defer inst.WaitGroup.Done()
+
+	p.run(ctx)
+}
+
+func (p *Processor) run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.worker(ctx)
+		}()
+	}
+	wg.Wait()
+
+	p.lock.Lock()
+	p.save()
+	p.lock.Unlock()
+}
+
+func (p *Processor) worker(ctx context.Context) {
+	for {
+		job, snapshot := p.take()
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.notify:
+				continue
+			}
+		}
+
+		p.process(ctx, job, snapshot)
+	}
+}
+
+// take mark the first pending job running, return it with a snapshot
+func (p *Processor) take() (*Job, Job) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, job := range p.jobs {
+		if job.Status == statusPending && !job.running {
+			job.running = true
+			return job, *job
+		}
+	}
+	return nil, Job{}
+}
+
+// process run the remaining steps of job
+func (p *Processor) process(ctx context.Context, job *Job, snapshot Job) {
+	for snapshot.Step < len(p.steps) {
+		step := p.steps[snapshot.Step]
+		if step == configs.StepConcat && !snapshot.Merged {
+			p.lock.Lock()
+			job.running = false
+			job.Status = statusWaiting
+			p.tryConcat(job.Session)
+			p.save()
+			p.lock.Unlock()
+			return
+		}
+
+		inputs, temps, err := p.runStep(ctx, step, snapshot)
+		if ctx.Err() != nil {
+			// resume on next start
+			p.lock.Lock()
+			job.running = false
+			p.lock.Unlock()
+			return
+		}
+		if err != nil {
+			zap.L().Error("Post Process",
+				zap.String("Id", job.MonitorID),
+				zap.String("Step", step),
+				zap.Strings("Files", snapshot.Inputs),
+				zap.String("Err", err.Error()),
+			)
+			p.remove(job)
+			return
+		}
+
+		p.lock.Lock()
+		job.Inputs = inputs
+		job.Temps = temps
+		job.Step++
+		snapshot = *job
+		p.save()
+		p.lock.Unlock()
+	}
+
+	zap.L().Info("Post Process Done",
+		zap.String("Id", job.MonitorID),
+		zap.Strings("Files", snapshot.Inputs),
+	)
+	p.remove(job)
+}
+
+// tryConcat merge jobs of an ended session once they all wait for concat, lock held
+func (p *Processor) tryConcat(session string) {
+	if !p.ended[session] {
+		return
+	}
+
+	jobs := []*Job{}
+	for _, job := range p.jobs {
+		if job.Session != session {
+			continue
+		}
+		if job.Status != statusWaiting {
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		// nothing left of the session to merge
+		delete(p.ended, session)
+		return
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+
+	merged := &Job{
+		ID:        jobs[0].ID,
+		MonitorID: jobs[0].MonitorID,
+		Session:   session,
+		Step:      jobs[0].Step,
+		Status:    statusPending,
+		Merged:    true,
+		Created:   jobs[0].Created,
+	}
+	for _, job := range jobs {
+		merged.Sources = append(merged.Sources, job.Sources...)
+		merged.Inputs = append(merged.Inputs, job.Inputs...)
+		merged.Temps = append(merged.Temps, job.Temps...)
+	}
+
+	remain := []*Job{}
+	for _, job := range p.jobs {
+		if job.Session != session {
+			remain = append(remain, job)
+		}
+	}
+	p.jobs = append(remain, merged)
+	delete(p.ended, session)
+	p.signal()
+}
+
+// remove a finished or failed job, the rest of its session may be merged now
+func (p *Processor) remove(job *Job) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, j := range p.jobs {
+		if j == job {
+			p.jobs = append(p.jobs[:i], p.jobs[i+1:]...)
+			break
+		}
+	}
+	p.tryConcat(job.Session)
+	p.save()
+}
+
+// signal wake a worker, lock held
+func (p *Processor) signal() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// save write the queue file atomically, lock held
+func (p *Processor) save() {
+	data, err := json.MarshalIndent(&queueFile{Jobs: p.jobs}, "", "  ")
+	if err == nil {
+		tmp := p.queuePath + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, p.queuePath)
+		}
+	}
+
+	if err != nil {
+		zap.L().Error("Save Post Process Queue",
+			zap.String("Path", p.queuePath),
+			zap.String("Err", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,214 @@
+package postprocess
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/danmaku"
+	"github.com/lintmx/dd-recorder/event"
+)
+
+// fakeFFmpeg copy the input to the output, concat join inputs of the list
+func fakeFFmpeg(ctx context.Context, args ...string) error {
+	var input string
+	concat := false
+	for i, arg := range args {
+		if arg == "-i" {
+			input = args[i+1]
+		} else if arg == "concat" {
+			concat = true
+		}
+	}
+	output := args[len(args)-1]
+
+	var data []byte
+	if concat {
+		list, _ := ioutil.ReadFile(input)
+		for _, line := range strings.Split(strings.TrimSpace(string(list)), "\n") {
+			part, err := ioutil.ReadFile(strings.Trim(strings.TrimPrefix(line, "file "), "'"))
+			if err != nil {
+				return err
+			}
+			data = append(data, part...)
+		}
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(input); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(output, data, 0644)
+}
+
+func newTestProcessor(t *testing.T, dir string, steps ...string) *Processor {
+	p, err := New(configs.PostProcessConfig{Workers: 2, Steps: steps}, dir, danmaku.DefaultASSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ffmpeg = fakeFFmpeg
+	p.duration = func(ctx context.Context, path string) (time.Duration, error) {
+		return 10 * time.Second, nil
+	}
+	return p
+}
+
+func writeTestXML(t *testing.T, path, content string) {
+	writer, err := danmaku.NewXMLWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(&api.DanmakuMessage{Type: api.DanmakuTypeChat, Content: content}, time.Second)
+	writer.Close()
+}
+
+// runUntilDone run p until no job left
+func runUntilDone(t *testing.T, p *Processor) {
+	ctx, cancel := context.WithCancel(context.Background())
+	exit := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(exit)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Jobs()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-exit
+
+	if jobs := p.Jobs(); len(jobs) > 0 {
+		t.Fatalf("jobs not finished %+v", jobs)
+	}
+}
+
+func TestProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postprocess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestProcessor(t, dir,
+		configs.StepRemuxMP4, configs.StepConcat, configs.StepASS, configs.StepDeleteSource)
+
+	start := time.Now()
+	for i, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name+".ts")
+		ioutil.WriteFile(path, []byte(strings.ToUpper(name)), 0644)
+		writeTestXML(t, filepath.Join(dir, name+".xml"), name)
+		p.Handle(&event.Event{
+			Type:    event.RecordFileClose,
+			Time:    start.Add(time.Duration(i) * time.Second),
+			Session: "s1",
+			File:    path,
+		})
+	}
+	p.Handle(&event.Event{Type: event.RecordStop, Session: "s1"})
+
+	runUntilDone(t, p)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a (full).mp4"))
+	if err != nil || string(data) != "AB" {
+		t.Errorf("concat output %q %v", data, err)
+	}
+
+	ass, _ := ioutil.ReadFile(filepath.Join(dir, "a (full).ass"))
+	if !strings.Contains(string(ass), "0:00:01.00,0:00:11.00") || !strings.Contains(string(ass), "0:00:11.00,0:00:21.00") {
+		t.Errorf("danmaku of the second file not delayed\n%s", ass)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if strings.Join(names, ",") != ".postprocess.json,a (full).ass,a (full).mp4,a.xml,b.xml" {
+		t.Errorf("unexpected files %v", names)
+	}
+}
+
+func TestProcessorResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postprocess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	steps := []string{configs.StepConcat, configs.StepRemuxMKV}
+	p := newTestProcessor(t, dir, steps...)
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name+".flv")
+		ioutil.WriteFile(path, []byte(name), 0644)
+		p.Handle(&event.Event{Type: event.RecordFileClose, Time: time.Now(), Session: "s1", File: path})
+	}
+	// exit before processing, the session never end
+	if len(p.Jobs()) != 2 {
+		t.Fatalf("want 2 jobs, got %d", len(p.Jobs()))
+	}
+
+	p = newTestProcessor(t, dir, steps...)
+	if len(p.Jobs()) != 2 {
+		t.Fatalf("want 2 jobs loaded, got %d", len(p.Jobs()))
+	}
+	runUntilDone(t, p)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a (full).mkv"))
+	if err != nil || string(data) != "ab" {
+		t.Errorf("output %q %v", data, err)
+	}
+	for _, name := range []string{"a.flv", "b.flv", "a (full).flv"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s should be kept without delete_source", name)
+		}
+	}
+}
+
+func TestProcessorUnknownStep(t *testing.T) {
+	if _, err := New(configs.PostProcessConfig{Steps: []string{"transcode"}}, "", danmaku.DefaultASSOptions()); err == nil {
+		t.Error("want error for unknown step")
+	}
+}
+
+func TestProcessorFailedJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postprocess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestProcessor(t, dir, configs.StepRemuxMP4, configs.StepConcat)
+	// b is gone, its remux fail
+	ioutil.WriteFile(filepath.Join(dir, "a.flv"), []byte("a"), 0644)
+	for i, name := range []string{"a", "b"} {
+		p.Handle(&event.Event{
+			Type:    event.RecordFileClose,
+			Time:    time.Now().Add(time.Duration(i) * time.Second),
+			Session: "s1",
+			File:    filepath.Join(dir, name+".flv"),
+		})
+	}
+	p.Handle(&event.Event{Type: event.RecordStop, Session: "s1"})
+	// a session without files
+	p.Handle(&event.Event{Type: event.RecordStop, Session: "s2"})
+
+	// a is merged alone once b failed
+	runUntilDone(t, p)
+
+	if _, err := os.Stat(filepath.Join(dir, "a.mp4")); err != nil {
+		t.Error(err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.ended) != 0 {
+		t.Errorf("ended sessions left %v", p.ended)
+	}
+}
@@ -0,0 +1,220 @@
+package postprocess
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/danmaku"
+	"github.com/lintmx/dd-recorder/record"
+	"go.uber.org/zap"
+)
+
+// runStep return the inputs of the next step and the temporary files
+func (p *Processor) runStep(ctx context.Context, step string, job Job) ([]string, []string, error) {
+	switch step {
+	case configs.StepFixFLV:
+		return job.Inputs, job.Temps, fixFLV(job.Inputs)
+	case configs.StepRemuxMP4:
+		return p.remux(ctx, job, ".mp4", "-movflags", "+faststart")
+	case configs.StepRemuxMKV:
+		return p.remux(ctx, job, ".mkv")
+	case configs.StepConcat:
+		return p.concat(ctx, job)
+	case configs.StepASS:
+		return job.Inputs, job.Temps, p.ass(ctx, job)
+	case configs.StepDeleteSource:
+		return job.Inputs, nil, deleteSource(job)
+	}
+
+	return nil, nil, fmt.Errorf("unknown step %s", step)
+}
+
+// fixFLV rewrite flv files with complete onMetaData
+func fixFLV(inputs []string) error {
+	for _, input := range inputs {
+		if !strings.EqualFold(filepath.Ext(input), ".flv") {
+			continue
+		}
+
+		tmp := input + ".fix"
+		if err := record.FixFLV(input, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, input); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remux copy streams into a new container
+func (p *Processor) remux(ctx context.Context, job Job, ext string, args ...string) ([]string, []string, error) {
+	inputs := []string{}
+	temps := job.Temps
+
+	for _, input := range job.Inputs {
+		output := trimExt(input) + ext
+		if output == input {
+			inputs = append(inputs, input)
+			continue
+		}
+
+		ffmpegArgs := append([]string{"-y", "-i", input, "-map", "0", "-c", "copy"}, args...)
+		if err := p.ffmpeg(ctx, append(ffmpegArgs, output)...); err != nil {
+			return nil, nil, err
+		}
+
+		inputs = append(inputs, output)
+		if !contains(job.Sources, input) {
+			temps = append(temps, input)
+		}
+	}
+
+	return inputs, temps, nil
+}
+
+// concat join inputs of a session into one file
+func (p *Processor) concat(ctx context.Context, job Job) ([]string, []string, error) {
+	if len(job.Inputs) <= 1 {
+		return job.Inputs, job.Temps, nil
+	}
+
+	first := job.Inputs[0]
+	list := trimExt(first) + ".concat.txt"
+	output := trimExt(first) + " (full)" + filepath.Ext(first)
+
+	content := &bytes.Buffer{}
+	for _, input := range job.Inputs {
+		path, err := filepath.Abs(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(content, "file '%s'\n", strings.Replace(path, "'", `'\''`, -1))
+	}
+	if err := ioutil.WriteFile(list, content.Bytes(), 0644); err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(list)
+
+	if err := p.ffmpeg(ctx, "-y", "-f", "concat", "-safe", "0", "-i", list, "-map", "0", "-c", "copy", output); err != nil {
+		return nil, nil, err
+	}
+
+	temps := job.Temps
+	for _, input := range job.Inputs {
+		if !contains(job.Sources, input) {
+			temps = append(temps, input)
+		}
+	}
+
+	return []string{output}, temps, nil
+}
+
+// ass generate ass beside outputs from danmaku xml of sources
+func (p *Processor) ass(ctx context.Context, job Job) error {
+	// every output has its own source
+	if len(job.Inputs) == len(job.Sources) {
+		for i, source := range job.Sources {
+			xml := trimExt(source) + ".xml"
+			if _, err := os.Stat(xml); err != nil {
+				continue
+			}
+			if _, err := danmaku.ConvertXMLToASS(xml, trimExt(job.Inputs[i])+".ass", p.assOptions); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// sources are concatenated, delay danmaku by durations of the previous files
+	xmls := []string{}
+	offsets := []time.Duration{}
+	var offset time.Duration
+	for _, source := range job.Sources {
+		xml := trimExt(source) + ".xml"
+		if _, err := os.Stat(xml); err == nil {
+			xmls = append(xmls, xml)
+			offsets = append(offsets, offset)
+		}
+
+		duration, err := p.duration(ctx, source)
+		if err != nil {
+			return err
+		}
+		offset += duration
+	}
+	if len(xmls) == 0 {
+		return nil
+	}
+
+	_, err := danmaku.ConvertXMLsToASS(xmls, offsets, trimExt(job.Inputs[0])+".ass", p.assOptions)
+	return err
+}
+
+// deleteSource remove recorded and temporary files except the outputs
+func deleteSource(job Job) error {
+	for _, file := range append(append([]string{}, job.Sources...), job.Temps...) {
+		if contains(job.Inputs, file) {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		zap.L().Debug("Delete Source", zap.String("Path", file))
+	}
+
+	return nil
+}
+
+func runFFmpeg(ctx context.Context, args ...string) error {
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-loglevel", "error"}, args...)...)
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg exit - %s - %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func probeDuration(ctx context.Context, path string) (time.Duration, error) {
+	output, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe %s - %s", path, err.Error())
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe %s - bad duration %q", path, output)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func trimExt(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
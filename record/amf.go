@@ -0,0 +1,234 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// amf0 data type marker
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+	amf0Date        = 0x0b
+	amf0LongString  = 0x0c
+)
+
+// amfProperty is a key value pair of amf object
+type amfProperty struct {
+	Key   string
+	Value interface{}
+}
+
+// amfObject keep the order of properties
+type amfObject []amfProperty
+
+// amfLongString always encode as long string
+type amfLongString string
+
+// amfECMAArray is an associative array, encode same as object with a count
+type amfECMAArray []amfProperty
+
+// Get return value of key
+func (o amfObject) Get(key string) (interface{}, bool) {
+	for _, p := range o {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// amfEncode write value into buffer
+// support float64, int, int64, bool, string, amfLongString, nil, amfObject, amfECMAArray, []interface{} and []float64
+func amfEncode(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(amf0Null)
+	case float64:
+		buf.WriteByte(amf0Number)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case int:
+		return amfEncode(buf, float64(v))
+	case int64:
+		return amfEncode(buf, float64(v))
+	case bool:
+		buf.WriteByte(amf0Boolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		if len(v) > math.MaxUint16 {
+			buf.WriteByte(amf0LongString)
+			binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		} else {
+			buf.WriteByte(amf0String)
+			binary.Write(buf, binary.BigEndian, uint16(len(v)))
+		}
+		buf.WriteString(v)
+	case amfLongString:
+		buf.WriteByte(amf0LongString)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.WriteString(string(v))
+	case amfObject:
+		buf.WriteByte(amf0Object)
+		return amfEncodeProperties(buf, v)
+	case amfECMAArray:
+		buf.WriteByte(amf0ECMAArray)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		return amfEncodeProperties(buf, amfObject(v))
+	case []float64:
+		buf.WriteByte(amf0StrictArray)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		for _, f := range v {
+			amfEncode(buf, f)
+		}
+	case []interface{}:
+		buf.WriteByte(amf0StrictArray)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		for _, item := range v {
+			if err := amfEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("amf0 unsupported type %T", value)
+	}
+
+	return nil
+}
+
+func amfEncodeProperties(buf *bytes.Buffer, props amfObject) error {
+	for _, p := range props {
+		binary.Write(buf, binary.BigEndian, uint16(len(p.Key)))
+		buf.WriteString(p.Key)
+		if err := amfEncode(buf, p.Value); err != nil {
+			return err
+		}
+	}
+	buf.Write([]byte{0x00, 0x00, amf0ObjectEnd})
+
+	return nil
+}
+
+// amfDecode read a value from reader
+func amfDecode(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker {
+	case amf0Number, amf0Date:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		if marker == amf0Date {
+			// skip time zone
+			if _, err := r.Seek(2, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+		return math.Float64frombits(bits), nil
+	case amf0Boolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amf0String:
+		return amfDecodeString(r, false)
+	case amf0LongString:
+		return amfDecodeString(r, true)
+	case amf0Null, amf0Undefined:
+		return nil, nil
+	case amf0Object:
+		return amfDecodeProperties(r)
+	case amf0ECMAArray:
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		props, err := amfDecodeProperties(r)
+		return amfECMAArray(props), err
+	case amf0StrictArray:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		if int64(count) > int64(r.Len()) {
+			return nil, fmt.Errorf("amf0 strict array too long")
+		}
+		items := make([]interface{}, 0, count)
+		for i := uint32(0); i < count; i++ {
+			item, err := amfDecode(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("amf0 unsupported marker 0x%02x", marker)
+}
+
+func amfDecodeString(r *bytes.Reader, long bool) (string, error) {
+	var length uint32
+	if long {
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return "", err
+		}
+	} else {
+		var short uint16
+		if err := binary.Read(r, binary.BigEndian, &short); err != nil {
+			return "", err
+		}
+		length = uint32(short)
+	}
+
+	if int64(length) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func amfDecodeProperties(r *bytes.Reader) (amfObject, error) {
+	props := amfObject{}
+	for {
+		key, err := amfDecodeString(r, false)
+		if err != nil {
+			return props, err
+		}
+
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return props, err
+			}
+			if marker == amf0ObjectEnd {
+				return props, nil
+			}
+			r.UnreadByte()
+		}
+
+		value, err := amfDecode(r)
+		if err != nil {
+			return props, err
+		}
+		props = append(props, amfProperty{Key: key, Value: value})
+	}
+}
@@ -0,0 +1,162 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/configs"
+)
+
+// downloader save a live stream into file
+type downloader interface {
+	// Download block until stream end, done closed or error,
+	// output files are named by seg
+	Download(streamURL api.StreamURL, seg *segmenter, done <-chan struct{}) error
+}
+
+// newDownloader select a downloader for stream, fallback to ffmpeg
+func newDownloader(name string, streamURL api.StreamURL) downloader {
+	if name != configs.DownloaderFFmpeg {
+		switch streamURL.Protocol {
+		case api.ProtocolHLS:
+			return newHLSDownloader()
+		case api.ProtocolFLV:
+			return newFLVDownloader()
+		}
+	}
+
+	return &ffmpegDownloader{}
+}
+
+// ffmpegDownloader save stream by ffmpeg subprocess
+type ffmpegDownloader struct{}
+
+// Download run ffmpeg remuxing into a pipe and kill it when done closed.
+// The output is cut by the native writers at keyframes, ffmpeg is never restarted for a segment.
+func (f *ffmpegDownloader) Download(streamURL api.StreamURL, seg *segmenter, done <-chan struct{}) error {
+	format := "mpegts"
+	if streamURL.FileType == "flv" {
+		format = "flv"
+	}
+	args := []string{
+		"-loglevel", "error",
+		"-timeout", "30000000",
+		"-i", streamURL.PlayURL.String(),
+		"-c", "copy",
+		"-f", format,
+		"pipe:1",
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("ffmpeg start failed - %s", err.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("ffmpeg start failed - %s", err.Error())
+	}
+
+	exitChan := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			cmd.Process.Kill()
+		case <-exitChan:
+		}
+	}()
+
+	if format == "flv" {
+		err = writeFLV(stdout, seg, streamURL.FileType)
+	} else {
+		err = writeTS(stdout, seg, streamURL.FileType)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+	}
+	// ffmpeg block on a full pipe
+	io.Copy(ioutil.Discard, stdout)
+	exitErr := cmd.Wait()
+	close(exitChan)
+
+	select {
+	case <-done:
+		return nil
+	default:
+	}
+	if err != nil {
+		return err
+	}
+	if exitErr != nil {
+		return fmt.Errorf("ffmpeg exit - %s - %s", exitErr.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// writeFLV cut flv from r into segments until r end, only errors of writing are returned
+func writeFLV(r io.Reader, seg *segmenter, ext string) error {
+	writer := newFLVSegmentWriter(seg, ext)
+	reader := newFLVReader(r)
+	if err := reader.ReadHeader(); err != nil {
+		return writer.Close()
+	}
+
+	for {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			return writer.Close()
+		}
+		if err := writer.WriteTag(tag); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+}
+
+// writeTS cut mpeg-ts from r into segments until r end
+func writeTS(r io.Reader, seg *segmenter, ext string) error {
+	writer := newTSSegmentWriter(seg, ext)
+	_, err := io.Copy(writer, r)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lazyFile create file on the first write, a failed stream leave nothing on disk
+type lazyFile struct {
+	path string
+	// name return path when the file created, if path is empty
+	name func() string
+	file *os.File
+}
+
+func (l *lazyFile) Write(p []byte) (int, error) {
+	if l.file == nil {
+		if l.path == "" && l.name != nil {
+			l.path = l.name()
+		}
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+		l.file = file
+	}
+
+	return l.file.Write(p)
+}
+
+// Close close file if created
+func (l *lazyFile) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
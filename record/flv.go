@@ -0,0 +1,636 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+	"go.uber.org/zap"
+)
+
+// flv tag type
+const (
+	flvTagAudio  = 8
+	flvTagVideo  = 9
+	flvTagScript = 18
+)
+
+const (
+	flvHeaderLen    = 9
+	flvTagHeaderLen = 11
+	flvMaxTagSize   = 16 * 1024 * 1024
+	// space reserved at the file head to rewrite onMetaData on close
+	flvMetadataReserve = 128 * 1024
+	// timestamp gap inserted between two connections
+	flvReconnectGap = 40
+	// a backward jump larger than this is treated as a new stream
+	flvTimestampJump = 5000
+)
+
+// flvTag is a tag in flv body
+type flvTag struct {
+	Type      uint8
+	Timestamp int64
+	Data      []byte
+}
+
+// IsKeyframe return true if tag is a video keyframe
+func (t *flvTag) IsKeyframe() bool {
+	return t.Type == flvTagVideo && len(t.Data) > 0 && t.Data[0]>>4 == 1
+}
+
+// IsSequenceHeader return true if tag is an avc or aac sequence header
+func (t *flvTag) IsSequenceHeader() bool {
+	switch t.Type {
+	case flvTagVideo:
+		return len(t.Data) > 1 && t.Data[0]&0x0f == 7 && t.Data[1] == 0
+	case flvTagAudio:
+		return len(t.Data) > 1 && t.Data[0]>>4 == 10 && t.Data[1] == 0
+	}
+	return false
+}
+
+// flvReader read and validate flv stream
+type flvReader struct {
+	r *bufio.Reader
+}
+
+func newFLVReader(r io.Reader) *flvReader {
+	return &flvReader{
+		r: bufio.NewReaderSize(r, 64*1024),
+	}
+}
+
+// ReadHeader read flv header and the first PreviousTagSize
+func (f *flvReader) ReadHeader() error {
+	header := make([]byte, flvHeaderLen)
+	if _, err := io.ReadFull(f.r, header); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header[:3], []byte("FLV")) {
+		return fmt.Errorf("flv header signature invalid")
+	} else if header[3] != 1 {
+		return fmt.Errorf("flv header version %d not support", header[3])
+	}
+
+	offset := binary.BigEndian.Uint32(header[5:9])
+	if offset < flvHeaderLen {
+		return fmt.Errorf("flv header data offset %d invalid", offset)
+	}
+	if _, err := f.r.Discard(int(offset - flvHeaderLen)); err != nil {
+		return err
+	}
+
+	// PreviousTagSize0 is always zero
+	var size uint32
+	if err := binary.Read(f.r, binary.BigEndian, &size); err != nil {
+		return err
+	} else if size != 0 {
+		return fmt.Errorf("flv first previous tag size %d invalid", size)
+	}
+
+	return nil
+}
+
+// ReadTag read next tag and check the tag boundary
+func (f *flvReader) ReadTag() (*flvTag, error) {
+	header := make([]byte, flvTagHeaderLen)
+	if _, err := io.ReadFull(f.r, header); err != nil {
+		return nil, err
+	}
+
+	tagType := header[0]
+	if tagType&0x20 != 0 {
+		return nil, fmt.Errorf("flv encrypted tag not support")
+	}
+	tagType &= 0x1f
+	if tagType != flvTagAudio && tagType != flvTagVideo && tagType != flvTagScript {
+		return nil, fmt.Errorf("flv tag type %d invalid", tagType)
+	}
+
+	dataSize := uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+	if dataSize > flvMaxTagSize {
+		return nil, fmt.Errorf("flv tag size %d too large", dataSize)
+	}
+	timestamp := int64(uint32(header[7])<<24 | uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6]))
+
+	data := make([]byte, dataSize)
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		return nil, err
+	}
+
+	var size uint32
+	if err := binary.Read(f.r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size != dataSize+flvTagHeaderLen {
+		return nil, fmt.Errorf("flv previous tag size mismatch, want %d got %d", dataSize+flvTagHeaderLen, size)
+	}
+
+	return &flvTag{
+		Type:      tagType,
+		Timestamp: timestamp,
+		Data:      data,
+	}, nil
+}
+
+// flvKeyframe is an entry of onMetaData keyframes
+type flvKeyframe struct {
+	Position int64
+	Time     float64
+}
+
+// flvWriter write tags into file and fix onMetaData on close
+type flvWriter struct {
+	path string
+	// name return path when the file created, if path is empty
+	name        func() string
+	file        *os.File
+	size        int64
+	metadataPos int64
+	metadata    amfECMAArray
+	headers     []*flvTag
+	keyframes   []flvKeyframe
+	tsBase      int64
+	lastTS      int64
+	rebase      bool
+	started     bool
+}
+
+// newFLVWriter return a writer, file is created on the first tag
+func newFLVWriter(path string) *flvWriter {
+	return &flvWriter{
+		path:   path,
+		rebase: true,
+	}
+}
+
+// open create file with flv header and a placeholder onMetaData
+func (w *flvWriter) open() error {
+	if w.path == "" && w.name != nil {
+		w.path = w.name()
+	}
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+
+	header := []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, flvHeaderLen, 0, 0, 0, 0}
+	if err := w.write(header); err != nil {
+		return err
+	}
+
+	w.metadataPos = w.size
+	payload, err := w.metadataPayload()
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeTag(flvTagScript, 0, payload); err != nil {
+		return err
+	}
+
+	// a new segment start with the sequence headers of the stream
+	for _, tag := range w.headers {
+		if err := w.writeTag(tag.Type, 0, tag.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Split close current file and return a writer of the next segment,
+// the next tag should be a keyframe.
+func (w *flvWriter) Split(path string) (*flvWriter, error) {
+	next := newFLVWriter(path)
+	next.name = w.name
+	next.metadata = w.metadata
+	next.headers = w.headers
+
+	return next, w.Close()
+}
+
+// Duration return the media duration written
+func (w *flvWriter) Duration() time.Duration {
+	return time.Duration(w.lastTS) * time.Millisecond
+}
+
+// SetSourceMetadata keep properties of source onMetaData
+func (w *flvWriter) SetSourceMetadata(tag *flvTag) {
+	r := bytes.NewReader(tag.Data)
+	if name, err := amfDecode(r); err != nil || name != "onMetaData" {
+		return
+	}
+
+	value, err := amfDecode(r)
+	if err != nil {
+		return
+	}
+
+	var props amfObject
+	switch v := value.(type) {
+	case amfECMAArray:
+		props = amfObject(v)
+	case amfObject:
+		props = v
+	default:
+		return
+	}
+
+	w.metadata = amfECMAArray{}
+	for _, p := range props {
+		switch p.Key {
+		case "duration", "filesize", "keyframes", "lasttimestamp", "lastkeyframetimestamp", "lastkeyframelocation", "_padding":
+			continue
+		}
+		w.metadata = append(w.metadata, p)
+	}
+}
+
+// Discontinuity mark the next tag as the start of a new connection
+func (w *flvWriter) Discontinuity() {
+	w.rebase = true
+}
+
+// WriteTag write an audio or video tag with fixed timestamp
+func (w *flvWriter) WriteTag(tag *flvTag) error {
+	if tag.Type == flvTagScript {
+		w.SetSourceMetadata(tag)
+		return nil
+	}
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	if !w.rebase && tag.Timestamp+w.tsBase < w.lastTS-flvTimestampJump {
+		w.rebase = true
+	}
+
+	var timestamp int64
+	// sequence header of a new stream usually carry timestamp 0, not a base
+	header := w.rebase && tag.IsSequenceHeader()
+	if header {
+		timestamp = w.nextTimestamp()
+	} else {
+		if w.rebase {
+			w.tsBase = w.nextTimestamp() - tag.Timestamp
+			w.rebase = false
+		}
+		timestamp = tag.Timestamp + w.tsBase
+		if timestamp < 0 {
+			timestamp = 0
+		}
+	}
+
+	if tag.IsSequenceHeader() {
+		w.setHeader(tag)
+	}
+	if tag.IsKeyframe() && !tag.IsSequenceHeader() {
+		w.keyframes = append(w.keyframes, flvKeyframe{
+			Position: w.size,
+			Time:     float64(timestamp) / 1000,
+		})
+	}
+
+	if err := w.writeTag(tag.Type, timestamp, tag.Data); err != nil {
+		return err
+	}
+
+	if !header {
+		w.started = true
+		if timestamp > w.lastTS {
+			w.lastTS = timestamp
+		}
+	}
+
+	return nil
+}
+
+// setHeader keep the latest sequence header of each tag type
+func (w *flvWriter) setHeader(tag *flvTag) {
+	for i, h := range w.headers {
+		if h.Type == tag.Type {
+			w.headers[i] = tag
+			return
+		}
+	}
+	w.headers = append(w.headers, tag)
+}
+
+// nextTimestamp return the timestamp for the first tag of a new stream
+func (w *flvWriter) nextTimestamp() int64 {
+	if !w.started {
+		return 0
+	}
+	return w.lastTS + flvReconnectGap
+}
+
+// Size return bytes written
+func (w *flvWriter) Size() int64 {
+	return w.size
+}
+
+// Close rewrite onMetaData and close file
+func (w *flvWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	payload, err := w.metadataPayload()
+	if err == nil {
+		_, err = w.file.WriteAt(payload, w.metadataPos+flvTagHeaderLen)
+	}
+
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// metadataPayload build onMetaData with a fixed size of flvMetadataReserve
+func (w *flvWriter) metadataPayload() ([]byte, error) {
+	// the padding property need 2 + 8 bytes key, 5 bytes long string header
+	const paddingOverhead = 15
+	keyframes := w.keyframes
+
+	for {
+		positions := make([]float64, len(keyframes))
+		times := make([]float64, len(keyframes))
+		for i, k := range keyframes {
+			positions[i] = float64(k.Position)
+			times[i] = k.Time
+		}
+
+		meta := append(amfECMAArray{}, w.metadata...)
+		meta = append(meta,
+			amfProperty{"duration", float64(w.lastTS) / 1000},
+			amfProperty{"filesize", float64(w.size)},
+			amfProperty{"lasttimestamp", float64(w.lastTS) / 1000},
+			amfProperty{"keyframes", amfObject{
+				{"filepositions", positions},
+				{"times", times},
+			}},
+		)
+
+		buf := &bytes.Buffer{}
+		amfEncode(buf, "onMetaData")
+		if err := amfEncode(buf, meta); err != nil {
+			return nil, err
+		}
+
+		if padding := flvMetadataReserve - buf.Len() - paddingOverhead; padding >= 0 {
+			meta = append(meta, amfProperty{"_padding", amfLongString(strings.Repeat(" ", padding))})
+
+			buf.Reset()
+			amfEncode(buf, "onMetaData")
+			amfEncode(buf, meta)
+			return buf.Bytes(), nil
+		}
+
+		if len(keyframes) == 0 {
+			return nil, fmt.Errorf("flv metadata too large")
+		}
+		keyframes = thinKeyframes(keyframes)
+	}
+}
+
+// thinKeyframes drop every other keyframe, keep the first one
+func thinKeyframes(keyframes []flvKeyframe) []flvKeyframe {
+	result := make([]flvKeyframe, 0, len(keyframes)/2+1)
+	for i := 0; i < len(keyframes); i += 2 {
+		result = append(result, keyframes[i])
+	}
+	return result
+}
+
+func (w *flvWriter) writeTag(tagType uint8, timestamp int64, data []byte) error {
+	buf := make([]byte, flvTagHeaderLen, flvTagHeaderLen+len(data)+4)
+	size := len(data)
+	buf[0] = tagType
+	buf[1], buf[2], buf[3] = byte(size>>16), byte(size>>8), byte(size)
+	buf[4], buf[5], buf[6], buf[7] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp), byte(timestamp>>24)
+	buf = append(buf, data...)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(size+flvTagHeaderLen))
+
+	return w.write(buf)
+}
+
+func (w *flvWriter) write(data []byte) error {
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+// flvSegmentWriter cut the output into segments at keyframes
+type flvSegmentWriter struct {
+	*flvWriter
+	seg *segmenter
+}
+
+// newFLVSegmentWriter return a writer, a segment is named when its file created
+func newFLVSegmentWriter(seg *segmenter, ext string) *flvSegmentWriter {
+	writer := newFLVWriter("")
+	writer.name = func() string {
+		return seg.Next(ext)
+	}
+	return &flvSegmentWriter{
+		flvWriter: writer,
+		seg:       seg,
+	}
+}
+
+// WriteTag write tag into the current segment, start a new one before a keyframe if needed
+func (s *flvSegmentWriter) WriteTag(tag *flvTag) error {
+	if tag.IsKeyframe() && !tag.IsSequenceHeader() && s.seg.Split(s.Duration(), s.Size()) {
+		next, err := s.Split("")
+		s.seg.Closed(s.path)
+		s.flvWriter = next
+		if err != nil {
+			return err
+		}
+	}
+
+	created := s.file == nil
+	size := s.Size()
+	err := s.flvWriter.WriteTag(tag)
+	s.seg.Wrote(s.Size() - size)
+	if created && s.file != nil {
+		s.seg.Opened(s.path)
+	}
+
+	return err
+}
+
+// Close close current segment
+func (s *flvSegmentWriter) Close() error {
+	err := s.flvWriter.Close()
+	s.seg.Closed(s.path)
+	return err
+}
+
+// flvDownloader is a native http-flv client
+type flvDownloader struct {
+	client *http.Client
+	retry  int
+	delay  time.Duration
+}
+
+func newFLVDownloader() *flvDownloader {
+	return &flvDownloader{
+		// no timeout for a live body
+		client: &http.Client{},
+		retry:  3,
+		delay:  time.Second,
+	}
+}
+
+// Download save http-flv stream, reconnect on broken connection
+func (f *flvDownloader) Download(streamURL api.StreamURL, seg *segmenter, done <-chan struct{}) error {
+	writer := newFLVSegmentWriter(seg, streamURL.FileType)
+	defer writer.Close()
+
+	written := false
+	failures := 0
+	for {
+		err := f.download(streamURL, writer, done)
+		if writer.Size() > 0 {
+			written = true
+		}
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+
+		// reconnecting not help a failed disk
+		if _, ok := err.(*flvWriteError); ok {
+			return err
+		}
+		if err == errFLVNoData {
+			failures++
+		} else {
+			failures = 0
+		}
+		if failures >= f.retry {
+			// stream end after some data written
+			if written {
+				return nil
+			}
+			return err
+		}
+
+		zap.L().Debug("FLV Reconnect",
+			zap.String("Url", streamURL.PlayURL.String()),
+			zap.String("Err", err.Error()),
+		)
+		writer.Discontinuity()
+		if !sleepWithDone(f.delay, done) {
+			return nil
+		}
+	}
+}
+
+var errFLVNoData = fmt.Errorf("flv stream no data")
+
+// flvWriteError is an error of writing the output, not of the stream
+type flvWriteError struct {
+	err error
+}
+
+func (e *flvWriteError) Error() string {
+	return e.err.Error()
+}
+
+// download read one connection, return errFLVNoData if nothing written,
+// or a flvWriteError if the output failed
+func (f *flvDownloader) download(streamURL api.StreamURL, writer *flvSegmentWriter, done <-chan struct{}) error {
+	response, err := f.client.Get(streamURL.PlayURL.String())
+	if err != nil {
+		return errFLVNoData
+	}
+	defer response.Body.Close()
+
+	// close body when done, unblock reader
+	exitChan := make(chan struct{})
+	defer close(exitChan)
+	go func() {
+		select {
+		case <-done:
+			response.Body.Close()
+		case <-exitChan:
+		}
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		return errFLVNoData
+	}
+
+	reader := newFLVReader(response.Body)
+	if err := reader.ReadHeader(); err != nil {
+		return errFLVNoData
+	}
+
+	written := false
+	for {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			if !written {
+				return errFLVNoData
+			}
+			return err
+		}
+
+		if err := writer.WriteTag(tag); err != nil {
+			return &flvWriteError{err}
+		}
+		written = true
+	}
+}
+
+// FixFLV rewrite src into dst with onMetaData of duration and keyframes,
+// a truncated tail is dropped.
+func FixFLV(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	reader := newFLVReader(in)
+	if err := reader.ReadHeader(); err != nil {
+		return err
+	}
+
+	writer := newFLVWriter(dst)
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			writer.Close()
+			return err
+		}
+
+		if err := writer.WriteTag(tag); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,420 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+var (
+	testAVCHeader  = []byte{0x17, 0x00, 0x00, 0x00, 0x00}
+	testAACHeader  = []byte{0xaf, 0x00, 0x12, 0x10}
+	testKeyframe   = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xaa}
+	testInterFrame = []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xbb}
+	testAudio      = []byte{0xaf, 0x01, 0xcc}
+)
+
+func encodeTestTag(buf *bytes.Buffer, tagType uint8, timestamp uint32, data []byte) {
+	size := len(data)
+	buf.Write([]byte{
+		tagType,
+		byte(size >> 16), byte(size >> 8), byte(size),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24),
+		0, 0, 0,
+	})
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, uint32(size+flvTagHeaderLen))
+}
+
+// buildTestFLV return a small stream start at timestamp base
+func buildTestFLV(base uint32) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0})
+
+	meta := &bytes.Buffer{}
+	amfEncode(meta, "onMetaData")
+	amfEncode(meta, amfECMAArray{
+		{"width", 1920.0},
+		{"height", 1080.0},
+		{"duration", 0.0},
+	})
+	encodeTestTag(buf, flvTagScript, 0, meta.Bytes())
+	encodeTestTag(buf, flvTagVideo, 0, testAVCHeader)
+	encodeTestTag(buf, flvTagAudio, 0, testAACHeader)
+	for i := uint32(0); i < 10; i++ {
+		ts := base + i*100
+		if i%5 == 0 {
+			encodeTestTag(buf, flvTagVideo, ts, testKeyframe)
+		} else {
+			encodeTestTag(buf, flvTagVideo, ts, testInterFrame)
+		}
+		encodeTestTag(buf, flvTagAudio, ts+10, testAudio)
+	}
+
+	return buf.Bytes()
+}
+
+func readTestFLV(t *testing.T, path string) (amfECMAArray, []*flvTag, []int64) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	data, _ := ioutil.ReadAll(file)
+	reader := newFLVReader(bytes.NewReader(data))
+	if err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		meta      amfECMAArray
+		tags      []*flvTag
+		positions []int64
+	)
+	position := int64(13)
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if tag.Type == flvTagScript {
+			r := bytes.NewReader(tag.Data)
+			amfDecode(r)
+			value, err := amfDecode(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta = value.(amfECMAArray)
+		} else {
+			tags = append(tags, tag)
+			positions = append(positions, position)
+		}
+		position += int64(len(tag.Data)) + flvTagHeaderLen + 4
+	}
+
+	if position != int64(len(data)) {
+		t.Errorf("tags end at %d, file size %d", position, len(data))
+	}
+
+	return meta, tags, positions
+}
+
+func TestFLVReaderValidate(t *testing.T) {
+	data := buildTestFLV(0)
+
+	reader := newFLVReader(bytes.NewReader([]byte("FLX\x01\x05\x00\x00\x00\x09\x00\x00\x00\x00")))
+	if err := reader.ReadHeader(); err == nil {
+		t.Error("want error for bad signature")
+	}
+
+	// break the PreviousTagSize of the first tag
+	broken := append([]byte{}, data...)
+	metaSize := int(broken[14])<<16 | int(broken[15])<<8 | int(broken[16])
+	broken[13+flvTagHeaderLen+metaSize+3]++
+
+	reader = newFLVReader(bytes.NewReader(broken))
+	if err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadTag(); err == nil {
+		t.Error("want error for mismatch tag size")
+	}
+}
+
+func TestFLVWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.flv")
+
+	writer := newFLVWriter(path)
+
+	// second connection restart with a different timestamp base
+	for i, base := range []uint32{5000, 0} {
+		if i > 0 {
+			writer.Discontinuity()
+		}
+		reader := newFLVReader(bytes.NewReader(buildTestFLV(base)))
+		if err := reader.ReadHeader(); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			tag, err := reader.ReadTag()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.WriteTag(tag); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, tags, positions := readTestFLV(t, path)
+
+	// timestamps never go backward except sequence headers
+	var last int64
+	for _, tag := range tags {
+		if tag.IsSequenceHeader() {
+			continue
+		}
+		if tag.Timestamp < last-10 {
+			t.Errorf("timestamp go backward %d -> %d", last, tag.Timestamp)
+		}
+		if tag.Timestamp > last {
+			last = tag.Timestamp
+		}
+	}
+	// 910ms + 40ms gap + 910ms
+	if last != 1860 {
+		t.Errorf("last timestamp %d, want 1860", last)
+	}
+
+	stat, _ := os.Stat(path)
+	values := amfObject(meta)
+	if v, _ := values.Get("duration"); v != 1.86 {
+		t.Errorf("duration %v, want 1.86", v)
+	}
+	if v, _ := values.Get("filesize"); v != float64(stat.Size()) {
+		t.Errorf("filesize %v, want %d", v, stat.Size())
+	}
+	if v, _ := values.Get("width"); v != 1920.0 {
+		t.Errorf("width %v, want source metadata kept", v)
+	}
+
+	keyframes, _ := values.Get("keyframes")
+	filepositions, _ := keyframes.(amfObject).Get("filepositions")
+	if len(filepositions.([]interface{})) != 4 {
+		t.Fatalf("want 4 keyframes, got %d", len(filepositions.([]interface{})))
+	}
+	for _, pos := range filepositions.([]interface{}) {
+		found := false
+		for i, p := range positions {
+			if float64(p) == pos.(float64) && tags[i].IsKeyframe() {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("keyframe position %v not point to a keyframe", pos)
+		}
+	}
+}
+
+func TestFLVDownload(t *testing.T) {
+	var lock sync.Mutex
+	connections := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		connections++
+		if connections > 2 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buildTestFLV(uint32(connections * 1000)))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.flv")
+	seg := &segmenter{next: func() string { return filepath.Join(dir, "out") }}
+
+	playURL, _ := url.Parse(server.URL + "/live.flv")
+	d := newFLVDownloader()
+	d.delay = 10 * time.Millisecond
+	if err := d.Download(api.StreamURL{PlayURL: *playURL, FileType: "flv"}, seg, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+
+	_, tags, _ := readTestFLV(t, path)
+	if len(tags) != 44 {
+		t.Errorf("want 44 tags from two connections, got %d", len(tags))
+	}
+}
+
+func TestFLVDownloadWriteError(t *testing.T) {
+	var lock sync.Mutex
+	connections := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		connections++
+		w.Write(buildTestFLV(0))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// parent directory missing, every open fail
+	seg := &segmenter{next: func() string { return filepath.Join(dir, "missing", "out") }}
+
+	playURL, _ := url.Parse(server.URL + "/live.flv")
+	d := newFLVDownloader()
+	d.delay = 10 * time.Millisecond
+	err = d.Download(api.StreamURL{PlayURL: *playURL, FileType: "flv"}, seg, make(chan struct{}))
+	if _, ok := err.(*flvWriteError); !ok {
+		t.Fatalf("want write error, got %v", err)
+	}
+	if connections != 1 {
+		t.Errorf("want no reconnect on write error, got %d connections", connections)
+	}
+}
+
+func TestFLVSegmentWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	var written int64
+	seg := &segmenter{
+		duration: 400 * time.Millisecond,
+		next: func() string {
+			paths = append(paths, filepath.Join(dir, fmt.Sprintf("out%d", len(paths))))
+			return paths[len(paths)-1]
+		},
+		onWrite: func(n int64) {
+			written += n
+		},
+	}
+	writer := newFLVSegmentWriter(seg, "flv")
+
+	reader := newFLVReader(bytes.NewReader(buildTestFLV(3000)))
+	if err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keyframes at 0ms and 500ms, cut before the second one
+	if len(paths) != 2 {
+		t.Fatalf("want 2 segments, got %d", len(paths))
+	}
+	var size int64
+	for _, path := range paths {
+		if info, err := os.Stat(path + ".flv"); err == nil {
+			size += info.Size()
+		}
+	}
+	if written != size {
+		t.Errorf("reported %d bytes written, files have %d", written, size)
+	}
+	for _, path := range paths {
+		meta, tags, _ := readTestFLV(t, path+".flv")
+		if len(tags) != 12 {
+			t.Errorf("%s: want 12 tags, got %d", path, len(tags))
+			continue
+		}
+		if !tags[0].IsSequenceHeader() || !tags[1].IsSequenceHeader() {
+			t.Errorf("%s: segment not start with sequence headers", path)
+		}
+		if !tags[2].IsKeyframe() || tags[2].Timestamp != 0 {
+			t.Errorf("%s: first frame %+v, want keyframe at 0", path, tags[2])
+		}
+		if v, _ := amfObject(meta).Get("duration"); v != 0.41 {
+			t.Errorf("%s: duration %v, want 0.41", path, v)
+		}
+		if v, _ := amfObject(meta).Get("width"); v != 1920.0 {
+			t.Errorf("%s: width %v, want source metadata kept", path, v)
+		}
+	}
+}
+
+func TestFixFLV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src.flv")
+	dst := filepath.Join(dir, "dst.flv")
+
+	// recorded by ffmpeg and killed in the middle of a tag
+	data := buildTestFLV(0)
+	ioutil.WriteFile(src, data[:len(data)-5], 0644)
+
+	if err := FixFLV(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, tags, _ := readTestFLV(t, dst)
+	if len(tags) != 21 {
+		t.Errorf("want 21 tags, got %d", len(tags))
+	}
+	if v, _ := amfObject(meta).Get("duration"); v != 0.9 {
+		t.Errorf("duration %v, want 0.9", v)
+	}
+
+	// fixed again, the metadata written by the writer is not carried over
+	again := filepath.Join(dir, "again.flv")
+	if err := FixFLV(dst, again); err != nil {
+		t.Fatal(err)
+	}
+	metaAgain, _, _ := readTestFLV(t, again)
+	padding := 0
+	for _, p := range metaAgain {
+		if p.Key == "_padding" {
+			padding++
+		}
+	}
+	if padding != 1 {
+		t.Errorf("want 1 _padding, got %d", padding)
+	}
+	if want, got := testKeyframes(meta), testKeyframes(metaAgain); got != want {
+		t.Errorf("want %d keyframes, got %d", want, got)
+	}
+}
+
+// testKeyframes return the number of keyframes in meta
+func testKeyframes(meta amfECMAArray) int {
+	keyframes, _ := amfObject(meta).Get("keyframes")
+	obj, _ := keyframes.(amfObject)
+	positions, _ := obj.Get("filepositions")
+	list, _ := positions.([]interface{})
+	return len(list)
+}
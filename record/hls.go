@@ -0,0 +1,398 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/api"
+	"go.uber.org/zap"
+)
+
+// hlsSegment is a media segment in playlist
+type hlsSegment struct {
+	Sequence uint64
+	Duration float64
+	URL      *url.URL
+}
+
+// hlsVariant is a variant stream in master playlist
+type hlsVariant struct {
+	Bandwidth int64
+	URL       *url.URL
+}
+
+// hlsPlaylist store a parsed master or media playlist
+type hlsPlaylist struct {
+	Variants       []hlsVariant
+	Segments       []hlsSegment
+	TargetDuration float64
+	MediaSequence  uint64
+	EndList        bool
+}
+
+// IsMaster return true if playlist is a master playlist
+func (p *hlsPlaylist) IsMaster() bool {
+	return len(p.Variants) > 0
+}
+
+// parseHLSPlaylist parse m3u8 content, relative uri resolve with base
+func parseHLSPlaylist(base *url.URL, content io.Reader) (*hlsPlaylist, error) {
+	playlist := &hlsPlaylist{}
+	scanner := bufio.NewScanner(content)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, fmt.Errorf("hls playlist missing #EXTM3U")
+	}
+
+	var (
+		duration   float64
+		bandwidth  int64
+		isSegment  bool
+		isVariant  bool
+		segmentSeq uint64
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			playlist.TargetDuration, _ = strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64)
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			seq, err := strconv.ParseUint(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("hls playlist bad media sequence - %s", line)
+			}
+			playlist.MediaSequence = seq
+			segmentSeq = seq
+		case strings.HasPrefix(line, "#EXT-X-ENDLIST"):
+			playlist.EndList = true
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.Index(value, ","); i >= 0 {
+				value = value[:i]
+			}
+			duration, _ = strconv.ParseFloat(value, 64)
+			isSegment = true
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			isVariant = true
+		case strings.HasPrefix(line, "#"):
+			// ignore unknown tags and comments
+			continue
+		default:
+			uri, err := base.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("hls playlist bad uri - %s", line)
+			}
+
+			if isVariant {
+				playlist.Variants = append(playlist.Variants, hlsVariant{
+					Bandwidth: bandwidth,
+					URL:       uri,
+				})
+			} else if isSegment {
+				playlist.Segments = append(playlist.Segments, hlsSegment{
+					Sequence: segmentSeq,
+					Duration: duration,
+					URL:      uri,
+				})
+				segmentSeq++
+			}
+			isVariant, isSegment = false, false
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return playlist, nil
+}
+
+// parseHLSAttributes parse attribute list like `BANDWIDTH=1280000,CODECS="a,b"`
+func parseHLSAttributes(line string) map[string]string {
+	attrs := make(map[string]string)
+
+	for len(line) > 0 {
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(line[:eq])
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			end := strings.Index(line[1:], "\"")
+			if end < 0 {
+				value, line = line[1:], ""
+			} else {
+				value, line = line[1:end+1], line[end+2:]
+			}
+		} else if comma := strings.Index(line, ","); comma >= 0 {
+			value, line = line[:comma], line[comma:]
+		} else {
+			value, line = line, ""
+		}
+		attrs[key] = value
+		line = strings.TrimPrefix(line, ",")
+	}
+
+	return attrs
+}
+
+// hlsDownloader is a native hls client
+type hlsDownloader struct {
+	client  *http.Client
+	workers int
+	retry   int
+}
+
+func newHLSDownloader() *hlsDownloader {
+	return &hlsDownloader{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		workers: 3,
+		retry:   3,
+	}
+}
+
+// Download save hls stream until stream end or done closed
+func (h *hlsDownloader) Download(streamURL api.StreamURL, seg *segmenter, done <-chan struct{}) error {
+	file := newSegmentFile(seg, streamURL.FileType)
+	defer file.Close()
+
+	return h.download(&streamURL.PlayURL, file, done)
+}
+
+func (h *hlsDownloader) download(playlistURL *url.URL, w io.Writer, done <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	mediaURL, err := h.selectVariant(ctx, playlistURL)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	var (
+		lastSequence uint64
+		started      bool
+		failures     int
+	)
+
+	for {
+		playlist, err := h.fetchPlaylist(ctx, mediaURL)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			failures++
+			if failures >= h.retry {
+				return err
+			}
+			if !sleepWithDone(time.Second, done) {
+				return nil
+			}
+			continue
+		}
+		failures = 0
+
+		// a sequence gone backwards is a restarted stream, its segments are all new
+		if n := len(playlist.Segments); started && n > 0 && playlist.Segments[n-1].Sequence < lastSequence {
+			zap.L().Info("HLS Sequence Reset",
+				zap.Uint64("From", lastSequence),
+				zap.Uint64("To", playlist.Segments[n-1].Sequence),
+			)
+			started = false
+		}
+
+		segments := []hlsSegment{}
+		for _, segment := range playlist.Segments {
+			if !started || segment.Sequence > lastSequence {
+				segments = append(segments, segment)
+			}
+		}
+
+		if err := h.downloadSegments(ctx, segments, w); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if len(segments) > 0 {
+			started = true
+			lastSequence = segments[len(segments)-1].Sequence
+		}
+
+		if playlist.EndList {
+			return nil
+		}
+
+		// reload after target duration, half of it if playlist not changed
+		wait := time.Duration(playlist.TargetDuration * float64(time.Second))
+		if len(segments) == 0 {
+			wait /= 2
+		}
+		if wait <= 0 {
+			wait = time.Second
+		}
+		if !sleepWithDone(wait, done) {
+			return nil
+		}
+	}
+}
+
+// selectVariant return the highest bandwidth media playlist url
+func (h *hlsDownloader) selectVariant(ctx context.Context, playlistURL *url.URL) (*url.URL, error) {
+	playlist, err := h.fetchPlaylist(ctx, playlistURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if !playlist.IsMaster() {
+		return playlistURL, nil
+	}
+
+	selected := playlist.Variants[0]
+	for _, variant := range playlist.Variants[1:] {
+		if variant.Bandwidth > selected.Bandwidth {
+			selected = variant
+		}
+	}
+
+	return selected.URL, nil
+}
+
+func (h *hlsDownloader) fetchPlaylist(ctx context.Context, playlistURL *url.URL) (*hlsPlaylist, error) {
+	body, err := h.fetch(ctx, playlistURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseHLSPlaylist(playlistURL, bytes.NewReader(body))
+}
+
+// hlsCutter is a writer can be cut between segments, every segment start with a keyframe
+type hlsCutter interface {
+	Cut(duration time.Duration) error
+}
+
+// downloadSegments fetch segments concurrently and write them in order
+func (h *hlsDownloader) downloadSegments(ctx context.Context, segments []hlsSegment, w io.Writer) error {
+	cutter, _ := w.(hlsCutter)
+
+	results := make([]chan []byte, len(segments))
+	for i := range results {
+		results[i] = make(chan []byte, 1)
+	}
+
+	go func() {
+		sem := make(chan struct{}, h.workers)
+		for i, segment := range segments {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(segment hlsSegment, result chan<- []byte) {
+				defer func() { <-sem }()
+				var data []byte
+				var err error
+				for attempt := 1; attempt <= h.retry; attempt++ {
+					if data, err = h.fetch(ctx, segment.URL); err == nil || ctx.Err() != nil {
+						break
+					}
+					if !sleepWithDone(time.Duration(attempt)*500*time.Millisecond, ctx.Done()) {
+						break
+					}
+				}
+				if err != nil && ctx.Err() == nil {
+					zap.L().Warn("HLS Segment Download",
+						zap.Uint64("Sequence", segment.Sequence),
+						zap.String("Url", segment.URL.String()),
+						zap.String("Err", err.Error()),
+					)
+				}
+				result <- data
+			}(segment, results[i])
+		}
+	}()
+
+	for i, result := range results {
+		select {
+		case <-ctx.Done():
+			return nil
+		case data := <-result:
+			if len(data) == 0 {
+				continue
+			}
+			if cutter != nil {
+				if err := cutter.Cut(time.Duration(segments[i].Duration * float64(time.Second))); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (h *hlsDownloader) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	request, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := h.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Http Error - %s - %s", u.String(), response.Status)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// sleepWithDone return false if done closed before d
+func sleepWithDone(d time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
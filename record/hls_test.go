@@ -0,0 +1,166 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseHLSPlaylist(t *testing.T) {
+	base, _ := url.Parse("https://example.com/live/master.m3u8")
+	master := `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=1280x720
+720p/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=640000,RESOLUTION=640x360
+https://cdn.example.com/360p/index.m3u8
+`
+	playlist, err := parseHLSPlaylist(base, strings.NewReader(master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !playlist.IsMaster() || len(playlist.Variants) != 2 {
+		t.Fatalf("want 2 variants, got %d", len(playlist.Variants))
+	}
+	if playlist.Variants[0].Bandwidth != 1280000 || playlist.Variants[0].URL.String() != "https://example.com/live/720p/index.m3u8" {
+		t.Errorf("bad variant %+v", playlist.Variants[0])
+	}
+	if playlist.Variants[1].URL.String() != "https://cdn.example.com/360p/index.m3u8" {
+		t.Errorf("bad variant %+v", playlist.Variants[1])
+	}
+
+	media := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:5
+#EXT-X-MEDIA-SEQUENCE:42
+#EXTINF:5.005,
+seg42.ts
+#EXTINF:4.9,title
+seg43.ts
+#EXT-X-ENDLIST
+`
+	playlist, err = parseHLSPlaylist(base, strings.NewReader(media))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist.IsMaster() || !playlist.EndList || playlist.TargetDuration != 5 {
+		t.Errorf("bad media playlist %+v", playlist)
+	}
+	if len(playlist.Segments) != 2 || playlist.Segments[1].Sequence != 43 || playlist.Segments[0].Duration != 5.005 {
+		t.Errorf("bad segments %+v", playlist.Segments)
+	}
+
+	if _, err := parseHLSPlaylist(base, strings.NewReader("seg.ts\n")); err == nil {
+		t.Error("want error for missing #EXTM3U")
+	}
+}
+
+func TestHLSDownload(t *testing.T) {
+	var lock sync.Mutex
+	reloads := 0
+	failed := map[string]bool{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900\nhigh.m3u8\n")
+	})
+	mux.HandleFunc("/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("low bandwidth variant selected")
+	})
+	mux.HandleFunc("/high.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		reloads++
+		// live window slides forward, the last reload ends the stream
+		switch reloads {
+		case 1:
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1,\n0.ts\n#EXTINF:1,\n1.ts\n#EXTINF:1,\n2.ts\n")
+		case 2:
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:1,\n1.ts\n#EXTINF:1,\n2.ts\n#EXTINF:1,\n3.ts\n")
+		default:
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0\n#EXT-X-MEDIA-SEQUENCE:3\n#EXTINF:1,\n3.ts\n#EXTINF:1,\n4.ts\n#EXT-X-ENDLIST\n")
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		// every segment fails once to exercise retry
+		if !failed[r.URL.Path] {
+			failed[r.URL.Path] = true
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "[%s]", strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".ts"))
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	playlistURL, _ := url.Parse(server.URL + "/master.m3u8")
+	out := &bytes.Buffer{}
+	h := newHLSDownloader()
+
+	if err := h.download(playlistURL, out, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "[0][1][2][3][4]" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestHLSDownloadSequenceReset(t *testing.T) {
+	var lock sync.Mutex
+	reloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			fmt.Fprintf(w, "[%s]", strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".ts"))
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		reloads++
+		// the variant is selected by the first load, the stream restart from sequence 0 after
+		switch reloads {
+		case 1, 2:
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:1,\n5.ts\n#EXTINF:1,\n6.ts\n")
+		default:
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1,\n0.ts\n#EXTINF:1,\n1.ts\n#EXT-X-ENDLIST\n")
+		}
+	}))
+	defer server.Close()
+
+	playlistURL, _ := url.Parse(server.URL + "/index.m3u8")
+	out := &bytes.Buffer{}
+	if err := newHLSDownloader().download(playlistURL, out, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "[5][6][0][1]" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestHLSDownloadDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:10,\n0.ts\n")
+	}))
+	defer server.Close()
+
+	playlistURL, _ := url.Parse(server.URL + "/index.m3u8")
+	done := make(chan struct{})
+	exit := make(chan error)
+
+	go func() {
+		exit <- newHLSDownloader().download(playlistURL, &bytes.Buffer{}, done)
+	}()
+	close(done)
+
+	if err := <-exit; err != nil {
+		t.Errorf("want nil error after done, got %s", err.Error())
+	}
+}
@@ -3,84 +3,255 @@ package record
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lintmx/dd-recorder/api"
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/danmaku"
+	"github.com/lintmx/dd-recorder/event"
 	"github.com/lintmx/dd-recorder/instance"
+	"github.com/lintmx/dd-recorder/metrics"
 	"github.com/lintmx/dd-recorder/utils"
 	"go.uber.org/zap"
 )
 
+// startTimeout is the wait of Start for the last recording to finish
+const startTimeout = 10 * time.Second
+
 // Record struct
 type Record struct {
 	MonitorID    string
 	RecordID     string
 	RecordStatus bool
+	lock         sync.Mutex
 	doneChan     chan struct{}
+	// finished is closed when the recording goroutines exit
+	finished     chan struct{}
 	LiveAPI      api.LiveAPI
 	outPath      string
 	outFile      string
 	startTime    time.Time
-	cmd          *exec.Cmd
+	recordTime   time.Time
+	session      string
+	events       *event.Bus
+	fileLock     sync.RWMutex
+	pathTemplate *utils.PathTemplate
+	fileIndex    int
+	stream       api.StreamURL
+	// name of the room in config, default the author
+	name       string
+	downloader string
+	quality    int64
+	cdn        string
+	// danmakuEnabled false if danmaku is disabled for the room
+	danmakuEnabled bool
+	danmaku        []string
+	assOptions     danmaku.ASSOptions
+	segment        segmenter
+	// rate of the stream written
+	rate rateMeter
+	// unix nano of the last write and danmaku, 0 if none in the session
+	lastWrite   int64
+	lastDanmaku int64
+	// watchdog restart the stream not grown for stallTimeout, 0 to disable
+	stallTimeout   time.Duration
+	danmakuTimeout time.Duration
+	restart        chan struct{}
+	// titles changed while recording, marked among danmaku
+	titles chan string
+	// danmakuCount received in the session, stopReason is set by Stop
+	danmakuCount int64
+	stopReason   string
 	waitGroup    *sync.WaitGroup
 }
 
+// Health of a recording, times are zero if nothing received
+type Health struct {
+	LastWrite      time.Time
+	LastDanmaku    time.Time
+	StreamStalled  bool
+	DanmakuStalled bool
+}
+
 // New and return a Record
 func New(monitorID string, liveAPI api.LiveAPI) *Record {
 	record := Record{
 		MonitorID: monitorID,
 		LiveAPI:   liveAPI,
+		rate:      rateMeter{window: 5 * time.Second},
 		waitGroup: &sync.WaitGroup{},
 	}
 
 	return &record
 }
 
-// Start Record
+// Start Record in background, the last stopped recording is waited to finish for startTimeout
 func (r *Record) Start(ctx context.Context) {
 	inst := instance.GetInstance(ctx)
-	defer inst.WaitGroup.Done()
-	r.doneChan = make(chan struct{})
+	room, config := inst.GetRoomConfig(r.LiveAPI.GetLiveURL())
+	r.lock.Lock()
+	if r.RecordStatus {
+		r.lock.Unlock()
+		return
+	}
+	finished := r.finished
+	r.lock.Unlock()
+	// wait outside the lock, status of the record is still readable.
+	// A record not finished in time is started again by the next refresh
+	if finished != nil {
+		timer := time.NewTimer(startTimeout)
+		defer timer.Stop()
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			zap.L().Warn("Record Not Stopped",
+				zap.String("Id", r.MonitorID),
+			)
+			return
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.RecordStatus {
 		return
 	}
 	r.RecordStatus = true
 	r.doneChan = make(chan struct{})
-	r.outPath = filepath.Join(inst.Config.OutPath,
-		utils.FilterInvalidCharacters(r.LiveAPI.GetPlatformName()),
-		utils.FilterInvalidCharacters(r.LiveAPI.GetAuthor()),
-		time.Now().Format("2006-01-02"),
-	)
-	os.MkdirAll(r.outPath, os.ModePerm)
+	r.finished = make(chan struct{})
+	r.downloader = config.Downloader
+	r.quality = config.Quality
+	r.cdn = config.CDN
+	r.name = room.Name
+	r.danmakuEnabled = room.DanmakuEnabled()
+	r.danmaku = config.Danmaku
+	r.assOptions = danmaku.NewASSOptions(config.ASS)
+	r.segment = segmenter{
+		duration: time.Duration(config.SegmentDuration) * time.Second,
+		size:     config.SegmentSize * 1024 * 1024,
+		next:     r.nextFile,
+		onOpen: func(path string) {
+			e := r.event(event.RecordFileOpen, path, nil)
+			e.Quality = streamQuality(r.stream)
+			r.events.Publish(e)
+		},
+		onClose: func(path string) {
+			e := r.event(event.RecordFileClose, path, nil)
+			e.Quality = streamQuality(r.stream)
+			if info, err := os.Stat(path); err == nil {
+				e.Size = info.Size()
+			}
+			r.events.Publish(e)
+		},
+		onWrite: func(n int64) {
+			metrics.BytesWritten.Add(float64(n), api.MetricLabels(r.LiveAPI)...)
+			now := time.Now()
+			r.rate.Add(n, now)
+			atomic.StoreInt64(&r.lastWrite, now.UnixNano())
+		},
+	}
+	r.rate.Reset()
+	atomic.StoreInt64(&r.lastWrite, 0)
+	atomic.StoreInt64(&r.lastDanmaku, 0)
+	atomic.StoreInt64(&r.danmakuCount, 0)
+	r.stopReason = ""
+	r.stallTimeout = time.Duration(config.Watchdog.StallTimeout) * time.Second
+	r.danmakuTimeout = time.Duration(config.Watchdog.DanmakuTimeout) * time.Second
+	r.restart = make(chan struct{}, 1)
+	r.titles = make(chan string, 4)
+	r.outPath = config.OutPath
+	r.recordTime = time.Now()
+	r.session = fmt.Sprintf("%s-%d", r.MonitorID, r.recordTime.Unix())
+	r.events = inst.Events
+	r.fileIndex = 0
+	pathTemplate, err := utils.NewPathTemplate(config.DirTemplate, config.FileTemplate)
+	if err != nil {
+		pathTemplate, _ = utils.NewPathTemplate(configs.DefaultDirTemplate, configs.DefaultFileTemplate)
+	}
+	r.pathTemplate = pathTemplate
+
+	inst.WaitGroup.Add(1)
+	go r.run(inst.WaitGroup, r.finished)
+}
+
+// run record until stopped
+func (r *Record) run(waitGroup *sync.WaitGroup, finished chan struct{}) {
+	defer waitGroup.Done()
+	defer close(finished)
 
 	zap.L().Info("Record Start",
 		zap.String("Id", r.MonitorID),
 		zap.String("Author", r.LiveAPI.GetAuthor()),
 		zap.String("Title", r.LiveAPI.GetTitle()),
 	)
+	r.publish(event.RecordStart, "", nil)
 
 	r.waitGroup.Add(1)
 	go r.recordStream()
-	r.waitGroup.Add(1)
-	go r.recordDanmaku()
+	if r.danmakuEnabled {
+		r.waitGroup.Add(1)
+		go r.recordDanmaku()
+	}
+	if r.stallTimeout > 0 {
+		r.waitGroup.Add(1)
+		go r.watch(r.recordTime)
+	}
 	r.waitGroup.Wait()
-	r.RecordStatus = false
-	r.outPath = ""
-	r.outFile = ""
+	r.setFile("", time.Time{})
 
 	zap.L().Info("Record Stop",
 		zap.String("Id", r.MonitorID),
 		zap.String("Author", r.LiveAPI.GetAuthor()),
 		zap.String("Title", r.LiveAPI.GetTitle()),
 	)
+	e := r.event(event.RecordStop, "", nil)
+	e.Danmaku = atomic.LoadInt64(&r.danmakuCount)
+	// set before doneChan closed
+	e.Reason = r.stopReason
+	r.events.Publish(e)
+}
+
+// publish send an event of the recording session
+func (r *Record) publish(t event.Type, file string, err error) {
+	r.events.Publish(r.event(t, file, err))
+}
+
+// event return an event of the recording session
+func (r *Record) event(t event.Type, file string, err error) *event.Event {
+	e := event.New(t, r.MonitorID, r.LiveAPI)
+	e.Session = r.session
+	e.File = file
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	return e
+}
+
+// streamQuality return the quality name of stream, or the number if no name
+func streamQuality(stream api.StreamURL) string {
+	if stream.QualityName != "" {
+		return stream.QualityName
+	}
+	if stream.Quality != 0 {
+		return strconv.FormatInt(stream.Quality, 10)
+	}
+	return ""
 }
 
 func (r *Record) recordStream() {
 	defer r.waitGroup.Done()
+	// ffmpeg started again in the session is a restart
+	ffmpegStarted := false
 	for {
 		select {
 		case <-r.doneChan:
@@ -88,46 +259,199 @@ func (r *Record) recordStream() {
 		default:
 			streamURLs, err := r.LiveAPI.GetStreamURLs()
 			if err != nil {
-				time.Sleep(3 * time.Second)
+				zap.L().Error("Get Stream Urls",
+					zap.String("Id", r.MonitorID),
+					zap.String("Err", err.Error()),
+				)
+				sleepWithDone(3*time.Second, r.doneChan)
 				continue
 			}
 
-			streamURL := api.StreamURL{}
-			for _, stream := range streamURLs {
-				// TODO: Stream Url Select
-				streamURL = stream
-				break
+			streamURLs = sortStreamURLs(streamURLs, r.quality, r.cdn)
+			if len(streamURLs) == 0 {
+				sleepWithDone(3*time.Second, r.doneChan)
+				continue
+			}
+
+			// fallback to the next stream when failed
+			failed := true
+			for _, streamURL := range streamURLs {
+				r.stream = streamURL
+				d := newDownloader(r.downloader, streamURL)
+				if _, ok := d.(*ffmpegDownloader); ok {
+					if ffmpegStarted {
+						metrics.FFmpegRestarts.Inc(api.MetricLabels(r.LiveAPI)...)
+					}
+					ffmpegStarted = true
+				}
+				done, stop := r.attempt()
+				err = d.Download(streamURL, &r.segment, done)
+				stop()
+				if err == nil {
+					failed = false
+					break
+				}
+
+				zap.L().Error("Record Stream",
+					zap.String("Id", r.MonitorID),
+					zap.Int64("Quality", streamURL.Quality),
+					zap.String("Host", streamURL.PlayURL.Host),
+					zap.String("Err", err.Error()),
+				)
+				r.publish(event.Error, "", err)
+
+				select {
+				case <-r.doneChan:
+					return
+				default:
+				}
+			}
+
+			if failed {
+				sleepWithDone(3*time.Second, r.doneChan)
 			}
+		}
+	}
+}
+
+// attempt return a channel closed when the recording stop or the watchdog restart the stream,
+// stop is called once the download returned. A restart requested before is dropped.
+func (r *Record) attempt() (<-chan struct{}, func()) {
+	select {
+	case <-r.restart:
+	default:
+	}
 
-			if streamURL == (api.StreamURL{}) {
-				time.Sleep(3 * time.Second)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-r.doneChan:
+			close(done)
+		case <-r.restart:
+			close(done)
+		case <-stopped:
+		}
+	}()
+	return done, func() { close(stopped) }
+}
+
+// watch request a restart of the stream when its output has not grown for the stall timeout,
+// again every timeout until it grow, since is the start of the recording
+func (r *Record) watch(since time.Time) {
+	defer r.waitGroup.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var restarted time.Time
+	for {
+		select {
+		case <-r.doneChan:
+			return
+		case now := <-ticker.C:
+			last := lastTime(&r.lastWrite, since)
+			if !stalled(last, now, r.stallTimeout) || !stalled(restarted, now, r.stallTimeout) {
 				continue
 			}
-			t := time.Now()
-
-			r.startTime = t
-			r.outFile = filepath.Join(r.outPath,
-				fmt.Sprintf("[%s][%s][%s] %s",
-					t.Format("2006-01-02 15-04-05"),
-					utils.FilterInvalidCharacters(r.LiveAPI.GetPlatformName()),
-					utils.FilterInvalidCharacters(r.LiveAPI.GetAuthor()),
-					utils.FilterInvalidCharacters(r.LiveAPI.GetTitle()),
-				),
-			)
+			restarted = now
 
-			r.cmd = exec.Command("ffmpeg",
-				"-loglevel", "warning",
-				"-y",
-				"-timeout", "30000000",
-				"-i", streamURL.PlayURL.String(),
-				"-c", "copy",
-				fmt.Sprintf("%s.%s", r.outFile, streamURL.FileType),
+			err := fmt.Errorf("stream not grown for %s, restarting", now.Sub(last).Truncate(time.Second))
+			zap.L().Warn("Record Stalled",
+				zap.String("Id", r.MonitorID),
+				zap.String("Err", err.Error()),
 			)
+			r.publish(event.Error, "", err)
+			select {
+			case r.restart <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
 
-			r.cmd.Start()
-			r.cmd.Wait()
+// lastTime return the time stored at last, or since if none
+func lastTime(last *int64, since time.Time) time.Time {
+	if n := atomic.LoadInt64(last); n != 0 {
+		return time.Unix(0, n)
+	}
+	return since
+}
+
+// stalled return true if nothing happened for timeout since last
+func stalled(last, now time.Time, timeout time.Duration) bool {
+	return now.Sub(last) >= timeout
+}
+
+// nextFile start a new output file, return the path without extension
+func (r *Record) nextFile() string {
+	t := time.Now()
+	r.fileIndex++
+	author := r.LiveAPI.GetAuthor()
+	roomName := r.name
+	if roomName == "" {
+		roomName = author
+	}
+	name, err := r.pathTemplate.Render(utils.PathData{
+		Platform:    r.LiveAPI.GetPlatformName(),
+		Author:      author,
+		Name:        roomName,
+		RoomID:      r.LiveAPI.GetRoomID(),
+		LiveID:      r.LiveAPI.GetLiveID(),
+		Title:       r.LiveAPI.GetTitle(),
+		Time:        t,
+		RecordTime:  r.recordTime,
+		Segment:     r.fileIndex,
+		Quality:     r.stream.Quality,
+		QualityName: r.stream.QualityName,
+	})
+	if err != nil {
+		zap.L().Error("Render File Name",
+			zap.String("Id", r.MonitorID),
+			zap.String("Err", err.Error()),
+		)
+		name = t.Format("2006-01-02 15-04-05")
+	}
+	base := filepath.Join(r.outPath, name)
+	os.MkdirAll(filepath.Dir(base), os.ModePerm)
+
+	// never overwrite, the name may not change between files
+	outFile := base
+	for i := 2; fileExists(outFile); i++ {
+		outFile = fmt.Sprintf("%s (%d)", base, i)
+	}
+
+	r.setFile(outFile, t)
+	return outFile
+}
+
+// fileExists return true if any file named base with an extension exists
+func fileExists(base string) bool {
+	files, err := ioutil.ReadDir(filepath.Dir(base))
+	if err != nil {
+		return false
+	}
+
+	prefix := filepath.Base(base) + "."
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), prefix) {
+			return true
 		}
 	}
+	return false
+}
+
+func (r *Record) setFile(outFile string, startTime time.Time) {
+	r.fileLock.Lock()
+	defer r.fileLock.Unlock()
+	r.outFile = outFile
+	r.startTime = startTime
+}
+
+// currentFile return the output file without extension and its start time
+func (r *Record) currentFile() (string, time.Time) {
+	r.fileLock.RLock()
+	defer r.fileLock.RUnlock()
+	return r.outFile, r.startTime
 }
 
 func (r *Record) recordDanmaku() {
@@ -136,61 +460,160 @@ func (r *Record) recordDanmaku() {
 	if err != nil {
 		return
 	}
-	for r.outFile == "" {
-		time.Sleep(500 * time.Millisecond)
-	}
 
-	file, err := os.OpenFile(
-		fmt.Sprintf("%s.%s", r.outFile, "xml"),
-		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
-		0755,
+	var (
+		writer    danmaku.Writer
+		outFile   string
+		startTime time.Time
+		title     string
 	)
-	if err != nil {
-		return
+	// roll over in lockstep with the video, offsets start from the segment
+	rollover := func() {
+		file, start := r.currentFile()
+		if file == outFile || file == "" {
+			return
+		}
+		first := writer == nil
+		if writer != nil {
+			writer.Close()
+		}
+		outFile, startTime = file, start
+		writer = r.openDanmaku(outFile)
+		if first {
+			// the recording itself is logged among danmaku, platforms like youtube send no live events
+			title = r.LiveAPI.GetTitle()
+			writer.Mark(danmaku.MarkerRecordStart, title, time.Now().Sub(startTime))
+		}
 	}
 
-	lastFileName := r.outFile
-	file.WriteString(
-		"<?xml version=\"1.0\" encoding=\"UTF-8\"?><i><chatserver>chat.bilibili.com</chatserver><chatid>0</chatid><mission>0</mission><maxlimit>0</maxlimit><source>k-v</source>\n",
-	)
-	for m := range msg {
-		if lastFileName != r.outFile {
-			file.WriteString("</i>")
-			file.Close()
-			file, err = os.OpenFile(
-				fmt.Sprintf("%s.%s", r.outFile, "xml"),
-				os.O_CREATE|os.O_WRONLY|os.O_APPEND,
-				0666,
-			)
-			if err != nil {
+	// msg is read until closed even without a video file, the source never block on sending
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case m, ok := <-msg:
+			if !ok {
+				if writer != nil {
+					// set before doneChan closed
+					writer.Mark(danmaku.MarkerRecordStop, r.stopReason, time.Now().Sub(startTime))
+					writer.Close()
+				}
+				return
+			}
+			atomic.StoreInt64(&r.lastDanmaku, time.Now().UnixNano())
+			atomic.AddInt64(&r.danmakuCount, 1)
+			metrics.DanmakuReceived.Inc(append(api.MetricLabels(r.LiveAPI), m.Type.String())...)
+			if m.Type == api.DanmakuTypeRoomChange {
+				// the change is recorded once, by whichever of the platform and the monitor is first
+				if m.Content == title {
+					continue
+				}
+				title = m.Content
+			}
+			rollover()
+			if writer != nil {
+				writer.Write(m, time.Now().Sub(startTime))
+			}
+		case t := <-r.titles:
+			if t == title {
 				continue
 			}
-			lastFileName = r.outFile
-			file.WriteString(
-				"<?xml version=\"1.0\" encoding=\"UTF-8\"?><i><chatserver>chat.bilibili.com</chatserver><chatid>0</chatid><mission>0</mission><maxlimit>0</maxlimit><source>k-v</source>\n",
-			)
+			title = t
+			rollover()
+			if writer != nil {
+				writer.Mark(danmaku.MarkerTitleChange, title, time.Now().Sub(startTime))
+			}
+		case <-ticker.C:
+			rollover()
 		}
+	}
+}
 
-		// TODO: fix negative number
-		file.WriteString(
-			fmt.Sprintf(
-				"<d p=\"%.3f,1,25,16777215,%d,0,%s,0\">%s</d>\n",
-				time.Now().Sub(r.startTime).Seconds(),
-				m.SendTime,
-				m.UserName,
-				m.Content,
-			),
+// openDanmaku create danmaku writers for outFile
+func (r *Record) openDanmaku(outFile string) danmaku.Writer {
+	writer, err := danmaku.Open(outFile, r.danmaku, r.assOptions)
+	if err != nil {
+		zap.L().Error("Record Danmaku",
+			zap.String("Id", r.MonitorID),
+			zap.String("Err", err.Error()),
 		)
 	}
-	file.WriteString("</i>")
-	file.Close()
+
+	return writer
+}
+
+// TitleChanged mark the new title among danmaku of the recording
+func (r *Record) TitleChanged(title string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.RecordStatus || !r.danmakuEnabled {
+		return
+	}
+	select {
+	case r.titles <- title:
+	default:
+	}
+}
+
+// Split cut the recording into a new file at the next keyframe
+func (r *Record) Split() {
+	if r.Recording() {
+		r.segment.RequestCut()
+	}
+}
+
+// Recording return true if the record is started and not stopped
+func (r *Record) Recording() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.RecordStatus
+}
+
+// RecordTime return the start time of the recording session
+func (r *Record) RecordTime() time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.recordTime
+}
+
+// OutFile return the current output file without extension, empty if none
+func (r *Record) OutFile() string {
+	outFile, _ := r.currentFile()
+	return outFile
+}
+
+// Health return the watchdog state of the recording, zero if not recording
+func (r *Record) Health() Health {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.RecordStatus {
+		return Health{}
+	}
+
+	now := time.Now()
+	health := Health{
+		LastWrite:   lastTime(&r.lastWrite, time.Time{}),
+		LastDanmaku: lastTime(&r.lastDanmaku, time.Time{}),
+	}
+	health.StreamStalled = r.stallTimeout > 0 &&
+		stalled(lastTime(&r.lastWrite, r.recordTime), now, r.stallTimeout)
+	health.DanmakuStalled = r.danmakuEnabled && r.danmakuTimeout > 0 &&
+		stalled(lastTime(&r.lastDanmaku, r.recordTime), now, r.danmakuTimeout)
+	return health
+}
+
+// Bitrate return bits per second of the stream written, 0 if stalled
+func (r *Record) Bitrate() float64 {
+	return r.rate.Rate(time.Now())
 }
 
-// Stop record
-func (r *Record) Stop() {
+// Stop record, reason is reported in the record_stop event
+func (r *Record) Stop(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.RecordStatus {
+		r.stopReason = reason
 		close(r.doneChan)
-		r.cmd.Process.Kill()
 		r.RecordStatus = false
 	}
 }
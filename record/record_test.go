@@ -0,0 +1,63 @@
+package record
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttempt(t *testing.T) {
+	r := &Record{doneChan: make(chan struct{}), restart: make(chan struct{}, 1)}
+	closed := func(done <-chan struct{}) bool {
+		select {
+		case <-done:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	// a restart requested before the attempt is dropped
+	r.restart <- struct{}{}
+	done, stop := r.attempt()
+	if closed(done) {
+		t.Error("attempt closed by an old restart")
+	}
+	r.restart <- struct{}{}
+	if !closed(done) {
+		t.Error("attempt not closed by restart")
+	}
+	stop()
+
+	// a finished attempt leave restarts to the next
+	_, stop = r.attempt()
+	stop()
+	time.Sleep(10 * time.Millisecond)
+	r.restart <- struct{}{}
+	if len(r.restart) != 1 {
+		t.Error("restart taken by a finished attempt")
+	}
+
+	<-r.restart
+	done, stop = r.attempt()
+	defer stop()
+	close(r.doneChan)
+	if !closed(done) {
+		t.Error("attempt not closed by stop")
+	}
+}
+
+func TestStalled(t *testing.T) {
+	now := time.Now()
+	var last int64
+	if !stalled(lastTime(&last, now.Add(-time.Minute)), now, time.Minute) {
+		t.Error("session without write not stalled")
+	}
+
+	last = now.Add(-30 * time.Second).UnixNano()
+	if stalled(lastTime(&last, now.Add(-time.Hour)), now, time.Minute) {
+		t.Error("stalled after a recent write")
+	}
+	if !stalled(lastTime(&last, now.Add(-time.Hour)), now, 10*time.Second) {
+		t.Error("not stalled after the timeout")
+	}
+}
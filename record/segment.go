@@ -0,0 +1,185 @@
+package record
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// segmenter decide when a recording is cut into a new file.
+// Downloaders only cut at keyframe boundaries.
+type segmenter struct {
+	duration time.Duration
+	size     int64
+	// next return the path of a new file without extension
+	next func() string
+	// called when a file created and finished
+	onOpen  func(path string)
+	onClose func(path string)
+	// called with bytes written to files
+	onWrite func(n int64)
+	// 1 if a cut is requested
+	cut int32
+}
+
+// Next start a new segment and return its path with ext
+func (s *segmenter) Next(ext string) string {
+	atomic.StoreInt32(&s.cut, 0)
+	return fmt.Sprintf("%s.%s", s.next(), ext)
+}
+
+// RequestCut cut the current segment at the next keyframe
+func (s *segmenter) RequestCut() {
+	atomic.StoreInt32(&s.cut, 1)
+}
+
+// Cutting return true if a cut is requested
+func (s *segmenter) Cutting() bool {
+	return atomic.LoadInt32(&s.cut) == 1
+}
+
+// Split return true if a segment with duration and size should be cut
+func (s *segmenter) Split(duration time.Duration, size int64) bool {
+	if s == nil || size == 0 {
+		return false
+	}
+
+	return s.Cutting() ||
+		(s.duration > 0 && duration >= s.duration) ||
+		(s.size > 0 && size >= s.size)
+}
+
+// Opened report a file created
+func (s *segmenter) Opened(path string) {
+	if s.onOpen != nil {
+		s.onOpen(path)
+	}
+}
+
+// Closed report a file finished, nothing reported if the file not created
+func (s *segmenter) Closed(path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if s.onClose != nil {
+		s.onClose(path)
+	}
+}
+
+// Wrote report n bytes written to the current file
+func (s *segmenter) Wrote(n int64) {
+	if n > 0 && s.onWrite != nil {
+		s.onWrite(n)
+	}
+}
+
+// Enabled return true if a limit is set
+func (s *segmenter) Enabled() bool {
+	return s != nil && (s.duration > 0 || s.size > 0)
+}
+
+// segmentFile is a writer roll over to a new lazyFile when cut,
+// a segment is named when its file created
+type segmentFile struct {
+	seg      *segmenter
+	ext      string
+	file     *lazyFile
+	duration time.Duration
+	size     int64
+}
+
+func newSegmentFile(seg *segmenter, ext string) *segmentFile {
+	return &segmentFile{
+		seg:  seg,
+		ext:  ext,
+		file: newSegmentLazyFile(seg, ext),
+	}
+}
+
+func newSegmentLazyFile(seg *segmenter, ext string) *lazyFile {
+	return &lazyFile{
+		name: func() string {
+			return seg.Next(ext)
+		},
+	}
+}
+
+func (s *segmentFile) Write(p []byte) (int, error) {
+	created := s.file.file == nil
+	n, err := s.file.Write(p)
+	if created && s.file.file != nil {
+		s.seg.Opened(s.file.path)
+	}
+	s.size += int64(n)
+	s.seg.Wrote(int64(n))
+	return n, err
+}
+
+// Cut is called before a chunk start with a keyframe, duration is the length of it
+func (s *segmentFile) Cut(duration time.Duration) error {
+	if s.seg.Split(s.duration, s.size) {
+		if err := s.Close(); err != nil {
+			return err
+		}
+		s.file = newSegmentLazyFile(s.seg, s.ext)
+		s.duration, s.size = 0, 0
+	}
+
+	s.duration += duration
+	return nil
+}
+
+// Close close current file
+func (s *segmentFile) Close() error {
+	err := s.file.Close()
+	s.seg.Closed(s.file.path)
+	return err
+}
+
+// rateMeter measure the bitrate of writes in windows
+type rateMeter struct {
+	lock   sync.Mutex
+	window time.Duration
+	start  time.Time
+	last   time.Time
+	bytes  int64
+	rate   float64
+}
+
+// Add n bytes written at now
+func (m *rateMeter) Add(n int64, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.bytes += n
+	m.last = now
+	if d := now.Sub(m.start); d >= m.window {
+		m.rate = float64(m.bytes*8) / d.Seconds()
+		m.start, m.bytes = now, 0
+	}
+}
+
+// Rate return bits per second of the last window, 0 if nothing written for a window
+func (m *rateMeter) Rate(now time.Time) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if now.Sub(m.last) > m.window {
+		return 0
+	}
+	return m.rate
+}
+
+// Reset forget writes before
+func (m *rateMeter) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.start, m.last = time.Time{}, time.Time{}
+	m.bytes, m.rate = 0, 0
+}
@@ -0,0 +1,123 @@
+package record
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSegmentFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	count := 0
+	var written int64
+	seg := &segmenter{
+		duration: 4 * time.Second,
+		size:     6,
+		next: func() string {
+			count++
+			return filepath.Join(dir, fmt.Sprintf("%d", count))
+		},
+		onWrite: func(n int64) {
+			written += n
+		},
+	}
+
+	// cut when the duration or size limit reached before a chunk
+	file := newSegmentFile(seg, "ts")
+	for _, chunk := range []struct {
+		duration time.Duration
+		data     string
+	}{
+		{2 * time.Second, "a"},
+		{2 * time.Second, "b"},
+		{2 * time.Second, "c"},
+		{time.Second, "dddddd"},
+		{time.Second, "e"},
+	} {
+		if err := file.Cut(chunk.duration); err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(chunk.data))
+	}
+	file.Close()
+
+	want := map[string]string{"1.ts": "ab", "2.ts": "cdddddd", "3.ts": "e"}
+	if count != len(want) {
+		t.Errorf("want %d segments, got %d", len(want), count)
+	}
+	for name, content := range want {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+
+	if written != 10 {
+		t.Errorf("written %d bytes, want 10", written)
+	}
+
+	// no limit never cut
+	seg = &segmenter{next: seg.next}
+	if seg.Split(time.Hour, 1<<40) {
+		t.Error("split without limit")
+	}
+
+	// a requested cut apply once at the next chunk
+	count = 10
+	file = newSegmentFile(seg, "ts")
+	for i, data := range []string{"f", "g", "h"} {
+		if i == 1 {
+			seg.RequestCut()
+		}
+		file.Cut(time.Second)
+		file.Write([]byte(data))
+	}
+	file.Close()
+
+	want = map[string]string{"11.ts": "f", "12.ts": "gh"}
+	for name, content := range want {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+
+	// a failed attempt name no file
+	file = newSegmentFile(seg, "ts")
+	file.Cut(time.Second)
+	file.Close()
+	if count != 12 {
+		t.Errorf("named %d files without write", count-12)
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	m := &rateMeter{window: 2 * time.Second}
+	now := time.Unix(0, 0)
+
+	m.Add(1000, now)
+	if rate := m.Rate(now); rate != 0 {
+		t.Errorf("rate before a window = %f", rate)
+	}
+	m.Add(1000, now.Add(time.Second))
+	m.Add(2000, now.Add(2*time.Second))
+	if rate := m.Rate(now.Add(2 * time.Second)); rate != 16000 {
+		t.Errorf("rate = %f, want 16000", rate)
+	}
+	if rate := m.Rate(now.Add(5 * time.Second)); rate != 0 {
+		t.Errorf("rate of a stalled stream = %f", rate)
+	}
+
+	m.Reset()
+	if rate := m.Rate(now.Add(2 * time.Second)); rate != 0 {
+		t.Errorf("rate after reset = %f", rate)
+	}
+}
@@ -0,0 +1,41 @@
+package record
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+// sortStreamURLs order streams by preference, the first one should be tried first.
+// Streams with the preferred quality come first, then lower qualities from high
+// to low, then higher qualities from low to high. quality 0 means the best.
+// In the same quality, lines whose host contains cdn come first.
+func sortStreamURLs(streamURLs []api.StreamURL, quality int64, cdn string) []api.StreamURL {
+	sorted := append([]api.StreamURL{}, streamURLs...)
+
+	rank := func(s api.StreamURL) (bool, int64) {
+		if quality <= 0 || s.Quality <= quality {
+			return false, -s.Quality
+		}
+		return true, s.Quality
+	}
+	matchCDN := func(s api.StreamURL) bool {
+		return cdn != "" && strings.Contains(s.PlayURL.Host, cdn)
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		iAbove, iRank := rank(sorted[i])
+		jAbove, jRank := rank(sorted[j])
+
+		if iAbove != jAbove {
+			return !iAbove
+		} else if iRank != jRank {
+			return iRank < jRank
+		}
+
+		return matchCDN(sorted[i]) && !matchCDN(sorted[j])
+	})
+
+	return sorted
+}
@@ -0,0 +1,51 @@
+package record
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/lintmx/dd-recorder/api"
+)
+
+func TestSortStreamURLs(t *testing.T) {
+	streamURLs := []api.StreamURL{}
+	for _, qn := range []int64{10000, 400, 150} {
+		for _, host := range []string{"cn-gotcha01.bilivideo.com", "txy.live-play.acgvideo.com"} {
+			u, _ := url.Parse(fmt.Sprintf("https://%s/live/%d.flv", host, qn))
+			streamURLs = append(streamURLs, api.StreamURL{PlayURL: *u, Quality: qn})
+		}
+	}
+
+	tests := []struct {
+		quality int64
+		cdn     string
+		want    []string
+	}{
+		{0, "", []string{
+			"cn-gotcha01.bilivideo.com/10000", "txy.live-play.acgvideo.com/10000",
+			"cn-gotcha01.bilivideo.com/400", "txy.live-play.acgvideo.com/400",
+			"cn-gotcha01.bilivideo.com/150", "txy.live-play.acgvideo.com/150",
+		}},
+		{400, "txy", []string{
+			"txy.live-play.acgvideo.com/400", "cn-gotcha01.bilivideo.com/400",
+			"txy.live-play.acgvideo.com/150", "cn-gotcha01.bilivideo.com/150",
+			"txy.live-play.acgvideo.com/10000", "cn-gotcha01.bilivideo.com/10000",
+		}},
+		{250, "", []string{
+			"cn-gotcha01.bilivideo.com/150", "txy.live-play.acgvideo.com/150",
+			"cn-gotcha01.bilivideo.com/400", "txy.live-play.acgvideo.com/400",
+			"cn-gotcha01.bilivideo.com/10000", "txy.live-play.acgvideo.com/10000",
+		}},
+	}
+
+	for _, test := range tests {
+		sorted := sortStreamURLs(streamURLs, test.quality, test.cdn)
+		for i, s := range sorted {
+			got := fmt.Sprintf("%s/%d", s.PlayURL.Host, s.Quality)
+			if got != test.want[i] {
+				t.Errorf("quality %d cdn %q: [%d] = %s, want %s", test.quality, test.cdn, i, got, test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package record
+
+import (
+	"bytes"
+	"time"
+)
+
+// mpeg-ts constants
+const (
+	tsPacketLen = 188
+	tsSyncByte  = 0x47
+	tsPATPID    = 0
+	// pts is 33 bits of 90kHz
+	tsPTSMask  = 1<<33 - 1
+	tsPTSClock = 90000
+	// seconds between keyframes at most
+	tsMaxGOP = 60
+)
+
+// video stream types of pmt
+var tsVideoTypes = map[byte]bool{
+	0x01: true, // mpeg-1
+	0x02: true, // mpeg-2
+	0x10: true, // mpeg-4 part 2
+	0x1b: true, // h.264
+	0x24: true, // h.265
+}
+
+// tsSegmentWriter cut a mpeg-ts stream into segments before video keyframes,
+// a new segment start with the last PAT and PMT
+type tsSegmentWriter struct {
+	file *segmentFile
+	// incomplete packet of the last write
+	buf      []byte
+	pat      []byte
+	pmt      []byte
+	pmtPID   int
+	videoPID int
+	lastPTS  int64
+}
+
+func newTSSegmentWriter(seg *segmenter, ext string) *tsSegmentWriter {
+	return &tsSegmentWriter{
+		file:     newSegmentFile(seg, ext),
+		pmtPID:   -1,
+		videoPID: -1,
+		lastPTS:  -1,
+	}
+}
+
+// Write split p into packets, a broken packet is skipped to the next sync byte
+func (w *tsSegmentWriter) Write(p []byte) (int, error) {
+	data := append(w.buf, p...)
+	for len(data) >= tsPacketLen {
+		if data[0] != tsSyncByte {
+			i := bytes.IndexByte(data[1:], tsSyncByte)
+			if i < 0 {
+				data = data[:0]
+				break
+			}
+			data = data[i+1:]
+			continue
+		}
+
+		if err := w.writePacket(data[:tsPacketLen]); err != nil {
+			return 0, err
+		}
+		data = data[tsPacketLen:]
+	}
+	w.buf = append(w.buf[:0], data...)
+
+	return len(p), nil
+}
+
+func (w *tsSegmentWriter) writePacket(packet []byte) error {
+	pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+	start := packet[1]&0x40 != 0
+	payload := tsPayload(packet)
+
+	switch {
+	case pid == tsPATPID:
+		w.pat = append(w.pat[:0], packet...)
+		if start {
+			if pmtPID, ok := parsePAT(payload); ok {
+				w.pmtPID = pmtPID
+			}
+		}
+	case pid == w.pmtPID:
+		w.pmt = append(w.pmt[:0], packet...)
+		if start {
+			if videoPID, ok := parsePMT(payload); ok {
+				w.videoPID = videoPID
+			}
+		}
+	case pid == w.videoPID && start && tsRandomAccess(packet):
+		if err := w.cut(payload); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.file.Write(packet)
+	return err
+}
+
+// cut before a keyframe, the duration since the last one is added to the segment
+func (w *tsSegmentWriter) cut(pes []byte) error {
+	pts, ok := pesPTS(pes)
+	if !ok {
+		return nil
+	}
+	// a jump of pts is not counted
+	if elapsed := (pts - w.lastPTS) & tsPTSMask; w.lastPTS >= 0 && elapsed < tsMaxGOP*tsPTSClock {
+		w.file.duration += time.Duration(elapsed) * time.Second / tsPTSClock
+	}
+	w.lastPTS = pts
+
+	opened := w.file.file.file != nil
+	if err := w.file.Cut(0); err != nil {
+		return err
+	}
+	// a new segment need tables before any frame
+	if opened && w.file.file.file == nil && w.pmt != nil {
+		for _, table := range [][]byte{w.pat, w.pmt} {
+			if _, err := w.file.Write(table); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close close current segment
+func (w *tsSegmentWriter) Close() error {
+	return w.file.Close()
+}
+
+// tsPayload return payload of packet, nil if none
+func tsPayload(packet []byte) []byte {
+	control := packet[3] >> 4 & 0x3
+	offset := 4
+	if control&0x2 != 0 {
+		offset += 1 + int(packet[4])
+	}
+	if control&0x1 == 0 || offset >= len(packet) {
+		return nil
+	}
+	return packet[offset:]
+}
+
+// tsRandomAccess return true if the random access indicator of packet is set
+func tsRandomAccess(packet []byte) bool {
+	return packet[3]&0x20 != 0 && packet[4] > 0 && packet[5]&0x40 != 0
+}
+
+// psiSection return the section of a psi payload start
+func psiSection(payload []byte) []byte {
+	if len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 3 {
+		return nil
+	}
+	// crc is not included
+	end := 3 + (int(section[1]&0x0f)<<8 | int(section[2])) - 4
+	if end > len(section) {
+		end = len(section)
+	}
+	return section[:end]
+}
+
+// parsePAT return pid of the first program map
+func parsePAT(payload []byte) (int, bool) {
+	section := psiSection(payload)
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			return int(section[i+2]&0x1f)<<8 | int(section[i+3]), true
+		}
+	}
+	return 0, false
+}
+
+// parsePMT return pid of the first video stream
+func parsePMT(payload []byte) (int, bool) {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return 0, false
+	}
+	i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	for ; i+5 <= len(section); i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4])) {
+		if tsVideoTypes[section[i]] {
+			return int(section[i+1]&0x1f)<<8 | int(section[i+2]), true
+		}
+	}
+	return 0, false
+}
+
+// pesPTS return pts of a pes header
+func pesPTS(pes []byte) (int64, bool) {
+	if len(pes) < 14 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[7]&0x80 == 0 {
+		return 0, false
+	}
+	b := pes[9:14]
+	pts := int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+	return pts, true
+}
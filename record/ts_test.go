@@ -0,0 +1,127 @@
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTSPacket build a packet of pid with payload, padded by adaptation stuffing
+func testTSPacket(pid int, start, keyframe bool, payload []byte) []byte {
+	packet := []byte{tsSyncByte, byte(pid >> 8 & 0x1f), byte(pid), 0x10}
+	if start {
+		packet[1] |= 0x40
+	}
+
+	stuffing := tsPacketLen - 4 - len(payload)
+	if keyframe && stuffing < 2 {
+		stuffing = 2
+	}
+	if stuffing > 0 {
+		packet[3] |= 0x20
+		packet = append(packet, byte(stuffing-1))
+		if stuffing > 1 {
+			flags := byte(0)
+			if keyframe {
+				flags = 0x40
+			}
+			packet = append(packet, flags)
+			packet = append(packet, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+		}
+	}
+	return append(packet, payload...)
+}
+
+// testPSI build a section with a dummy crc after the pointer field
+func testPSI(tableID byte, body []byte) []byte {
+	length := len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(length>>8), byte(length)}
+	section = append(section, body...)
+	return append(section, 0, 0, 0, 0)
+}
+
+func testPES(pts int64) []byte {
+	return []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+		0x21 | byte(pts>>29&0x0e), byte(pts >> 22), 0x01 | byte(pts>>14&0xfe), byte(pts >> 7), 0x01 | byte(pts<<1&0xfe)}
+}
+
+func buildTestTS(keyframes int) []byte {
+	buf := &bytes.Buffer{}
+	// program 1 at pid 0x100, h.264 at 0x101 and aac at 0x102
+	buf.Write(testTSPacket(0, true, false, testPSI(0x00, []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xe1, 0x00})))
+	buf.Write(testTSPacket(0x100, true, false, testPSI(0x02, []byte{
+		0, 1, 0xc1, 0, 0, 0xe1, 0x01, 0xf0, 0,
+		0x1b, 0xe1, 0x01, 0xf0, 0,
+		0x0f, 0xe1, 0x02, 0xf0, 0,
+	})))
+	for i := 0; i < keyframes; i++ {
+		buf.Write(testTSPacket(0x101, true, true, testPES(int64(i)*tsPTSClock)))
+		buf.Write(testTSPacket(0x101, false, false, []byte{0xaa}))
+		buf.Write(testTSPacket(0x102, true, false, []byte{0xbb}))
+		buf.Write(testTSPacket(0x101, true, false, testPES(int64(i)*tsPTSClock+tsPTSClock/2)))
+	}
+	return buf.Bytes()
+}
+
+func TestTSSegmentWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	seg := &segmenter{
+		duration: 2 * time.Second,
+		next: func() string {
+			paths = append(paths, filepath.Join(dir, fmt.Sprintf("out%d", len(paths))))
+			return paths[len(paths)-1]
+		},
+	}
+	writer := newTSSegmentWriter(seg, "ts")
+
+	// a broken byte before the stream, written in chunks across packets
+	data := append([]byte{0x00}, buildTestTS(5)...)
+	for len(data) > 0 {
+		n := 100
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := writer.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keyframes every second, cut before the third and the fifth
+	wantFrames := []int{2, 2, 1}
+	if len(paths) != len(wantFrames) {
+		t.Fatalf("want %d segments, got %d", len(wantFrames), len(paths))
+	}
+	for i, path := range paths {
+		data, err := ioutil.ReadFile(path + ".ts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data)%tsPacketLen != 0 {
+			t.Errorf("%s: size %d not whole packets", path, len(data))
+			continue
+		}
+		if data[2] != 0x00 || data[tsPacketLen+2] != 0x00 || data[tsPacketLen+1]&0x1f != 0x01 {
+			t.Errorf("%s: segment not start with PAT and PMT", path)
+		}
+		if !tsRandomAccess(data[2*tsPacketLen:]) {
+			t.Errorf("%s: first frame not a keyframe", path)
+		}
+		if packets := len(data) / tsPacketLen; packets != 2+4*wantFrames[i] {
+			t.Errorf("%s: want %d packets, got %d", path, 2+4*wantFrames[i], packets)
+		}
+	}
+}
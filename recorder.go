@@ -1,10 +1,12 @@
 package main
 
 import (
-	"sync"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/danmaku"
+	"github.com/lintmx/dd-recorder/history"
 	"github.com/lintmx/dd-recorder/instance"
 	"github.com/lintmx/dd-recorder/logger"
 	"github.com/lintmx/dd-recorder/manager"
@@ -13,7 +15,11 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 // App Variable
@@ -26,28 +32,67 @@ var (
 
 // Flag Variable
 var (
-	help     bool
-	conf     string
-	version  bool
-	path     string
-	rooms    []string
-	interval uint16
-	logPath  string
-	debug    bool
+	help        bool
+	conf        string
+	version     bool
+	checkConfig bool
+	printConfig bool
+	path        string
+	rooms       []string
+	interval    uint16
+	logPath     string
+	debug       bool
+	download    string
+	quality     int64
+	cdn         string
+	segDur      uint32
+	segSize     int64
+	split       bool
+	dirTmpl     string
+	fileTmpl    string
+	danmakus    []string
+	httpAddr    string
+	ass         configs.ASSConfig
+	limit       int
+	since       string
+	jsonOutput  bool
 )
 
 func init() {
+	defaults := configs.Default()
 	flag.BoolVarP(&help, "help", "h", false, "This help")
 	flag.StringVarP(&conf, "config", "c", "", "Configuration file")
 	flag.BoolVarP(&version, "version", "v", false, "Show version number")
-	flag.StringVarP(&path, "out_path", "o", "./Lives", "Live Video output path")
+	flag.BoolVar(&checkConfig, "check-config", false, "Check the configuration and exit, non-zero if invalid")
+	flag.BoolVar(&printConfig, "print-config", false, "Print the effective configuration and exit")
+	flag.StringVarP(&path, "out_path", "o", defaults.OutPath, "Live Video output path")
 	flag.StringArrayVarP(&rooms, "url", "u", nil, "Live Rooms url")
-	flag.Uint16Var(&interval, "interval", 10, "Refresh second")
+	flag.Uint16Var(&interval, "interval", defaults.Interval, "Refresh second")
 	flag.StringVar(&logPath, "log", "", "Log Path")
 	flag.BoolVar(&debug, "debug", false, "Debug Mode")
+	flag.Int64Var(&quality, "quality", 0, "Preferred stream quality, 0 for the best")
+	flag.StringVar(&cdn, "cdn", "", "Preferred cdn host keyword")
+	flag.StringVar(&download, "downloader", defaults.Downloader, "Stream downloader, native or ffmpeg")
+	flag.Uint32Var(&segDur, "segment_duration", 0, "Split recording every second, 0 to disable")
+	flag.Int64Var(&segSize, "segment_size", 0, "Split recording every MiB, 0 to disable")
+	flag.StringVar(&dirTmpl, "dir_template", defaults.DirTemplate, "Output directory template")
+	flag.StringVar(&fileTmpl, "file_template", defaults.FileTemplate, "Output file name template")
+	flag.BoolVar(&split, "split_on_title_change", false, "Start a new file when the title changed")
+	flag.StringVar(&httpAddr, "http", "", "Control api listen address, e.g. 127.0.0.1:8080")
+	flag.StringSliceVar(&danmakus, "danmaku", defaults.Danmaku, "Danmaku formats, xml, ass and jsonl")
+	flag.StringVar(&ass.FontName, "font_name", "", "ASS danmaku font name")
+	flag.IntVar(&ass.FontSize, "font_size", 0, "ASS danmaku font size, 0 for default")
+	flag.Float64Var(&ass.Duration, "danmaku_duration", 0, "ASS danmaku on screen second, 0 for default")
+	flag.Float64Var(&ass.Opacity, "danmaku_opacity", 0, "ASS danmaku opacity from 0 to 1, 0 for default")
+	flag.IntVar(&limit, "limit", 20, "History sessions shown, 0 for all")
+	flag.StringVar(&since, "since", "", "History sessions started since, e.g. 2006-01-02")
+	flag.BoolVar(&jsonOutput, "json", false, "History in json")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stdout, "Usage of %s:\n", Name)
+		fmt.Fprintf(os.Stdout, "  %s [flags]\n", Name)
+		fmt.Fprintf(os.Stdout, "  %s [flags] ass <danmaku.xml> [out.ass]\tConvert danmaku xml to ass\n", Name)
+		fmt.Fprintf(os.Stdout, "  %s [flags] history [session|monitor id|author]\tShow recording history\n\n", Name)
 		flag.PrintDefaults()
 	}
 
@@ -65,53 +110,337 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Check FFmpeg
-	if _, ok := exec.LookPath("ffmpeg"); ok != nil {
-		fmt.Fprintf(os.Stdout, "[Error] FFmpeg not found.\n")
+	if flag.Arg(0) == "ass" {
+		convertASS()
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "history" {
+		showHistory()
+		os.Exit(0)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		printConfigError(err)
 		os.Exit(1)
 	}
 
-	fmt.Fprintf(os.Stdout, "DD recorder - 誰でも大好き！\n\n")
+	if checkConfig {
+		fmt.Fprintf(os.Stdout, "Configuration OK\n")
+		os.Exit(0)
+	}
 
-	var config *configs.Config
+	if printConfig {
+		data, err := config.Redacted()
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "[Error] %s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Stdout.Write(data)
+		os.Exit(0)
+	}
 
-	// Init Config
-	if conf != "" {
-		config = configs.InitConfig(conf)
-	} else {
-		config = &configs.Config{
-			Interval: interval,
-			OutPath:  path,
-			Rooms:    rooms,
-			LogPath:  logPath,
-			Debug:    debug,
+	// Check FFmpeg
+	if needFFmpeg(config) {
+		if _, ok := exec.LookPath("ffmpeg"); ok != nil {
+			fmt.Fprintf(os.Stdout, "[Error] FFmpeg not found.\n")
+			os.Exit(1)
 		}
 	}
 
+	fmt.Fprintf(os.Stdout, "DD recorder - 誰でも大好き！\n\n")
+
 	// Init Logger
 	log := logger.InitLogger(config.Debug, config.LogPath)
 	defer log.Sync()
 	zap.ReplaceGlobals(log)
 
-	inst := &instance.Instance{
-		Config:    config,
-		WaitGroup: &sync.WaitGroup{},
-	}
+	inst := instance.New(config)
 	ctx := context.WithValue(context.Background(), instance.InstanceKey, inst)
 	ctx, cannel := context.WithCancel(ctx)
 
 	// start dd
-	manager.DD(ctx)
+	m := manager.DD(ctx)
+
+	// reload the config file on change or SIGHUP
+	reload := func() {
+		if conf == "" {
+			zap.L().Warn("Config Reload", zap.String("Err", "no configuration file"))
+			return
+		}
+		config, err := loadConfig()
+		if err != nil {
+			zap.L().Error("Config Reload", zap.String("Err", err.Error()))
+			return
+		}
+		m.Reload(config)
+	}
+	if conf != "" {
+		go configs.Watch(ctx, conf, 2*time.Second, reload)
+	}
 
 	// Catch the exit signals
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		<-sigCh
-		cannel()
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			cannel()
+			return
+		}
 	}()
 
 	inst.WaitGroup.Wait()
 	fmt.Fprintf(os.Stdout, "\nさようなら～\n")
 }
+
+// loadConfig return the config of defaults, the file, DD_* environment variables and
+// flags set on the command line in order, it is validated
+func loadConfig() (*configs.Config, error) {
+	return configs.Load(conf, os.Environ(), applyFlags)
+}
+
+// applyFlags override config with flags set on the command line
+func applyFlags(config *configs.Config) {
+	changed := flag.CommandLine.Changed
+	if changed("out_path") {
+		config.OutPath = path
+	}
+	if changed("url") {
+		config.Rooms = configs.Rooms(rooms)
+	}
+	if changed("interval") {
+		config.Interval = interval
+	}
+	if changed("log") {
+		config.LogPath = logPath
+	}
+	if changed("debug") {
+		config.Debug = debug
+	}
+	if changed("quality") {
+		config.Quality = quality
+	}
+	if changed("cdn") {
+		config.CDN = cdn
+	}
+	if changed("downloader") {
+		config.Downloader = download
+	}
+	if changed("segment_duration") {
+		config.SegmentDuration = segDur
+	}
+	if changed("segment_size") {
+		config.SegmentSize = segSize
+	}
+	if changed("dir_template") {
+		config.DirTemplate = dirTmpl
+	}
+	if changed("file_template") {
+		config.FileTemplate = fileTmpl
+	}
+	if changed("split_on_title_change") {
+		config.SplitOnTitle = split
+	}
+	if changed("http") {
+		config.HTTP.Listen = httpAddr
+	}
+	if changed("danmaku") {
+		config.Danmaku = danmakus
+	}
+	if changed("font_name") {
+		config.ASS.FontName = ass.FontName
+	}
+	if changed("font_size") {
+		config.ASS.FontSize = ass.FontSize
+	}
+	if changed("danmaku_duration") {
+		config.ASS.Duration = ass.Duration
+	}
+	if changed("danmaku_opacity") {
+		config.ASS.Opacity = ass.Opacity
+	}
+}
+
+// printConfigError print every problem of the config
+func printConfigError(err error) {
+	errs, ok := err.(configs.Errors)
+	if !ok {
+		fmt.Fprintf(os.Stdout, "[Error] %s\n", err.Error())
+		return
+	}
+
+	fmt.Fprintf(os.Stdout, "[Error] Configuration invalid - %d problems\n", len(errs))
+	for _, e := range errs {
+		fmt.Fprintf(os.Stdout, "  %s\n", e.Error())
+	}
+}
+
+// convertASS generate ass from a danmaku xml
+func convertASS() {
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	src := flag.Arg(1)
+	dst := flag.Arg(2)
+	if dst == "" {
+		dst = strings.TrimSuffix(src, filepath.Ext(src)) + ".ass"
+	}
+
+	// the same layers as recording
+	config, err := loadConfig()
+	if err != nil {
+		printConfigError(err)
+		os.Exit(1)
+	}
+	options := config.ASS
+
+	count, err := danmaku.ConvertXMLToASS(src, dst, danmaku.NewASSOptions(options))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[Error] Convert %s - %s\n", src, err.Error())
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "%d danmaku written to %s\n", count, dst)
+}
+
+// showHistory print a session, or sessions of a monitor id or an author
+func showHistory() {
+	config, err := loadConfig()
+	if err != nil {
+		printConfigError(err)
+		os.Exit(1)
+	}
+	store := history.New(history.Path(config))
+	arg := flag.Arg(1)
+
+	if arg != "" {
+		session, err := store.Session(arg)
+		if err == nil {
+			printSession(session)
+			return
+		} else if err != history.ErrNotFound {
+			fmt.Fprintf(os.Stderr, "[Error] History - %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	query := history.Query{MonitorID: arg, Limit: limit}
+	if since != "" {
+		if query.Since, err = history.ParseTime(since); err != nil {
+			fmt.Fprintf(os.Stderr, "[Error] %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	sessions, err := store.Sessions(query)
+	if err == nil && len(sessions) == 0 && arg != "" {
+		query.MonitorID, query.Author = "", arg
+		sessions, err = store.Sessions(query)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[Error] History - %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(sessions)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "START\tDURATION\tSIZE\tDANMAKU\tREASON\tAUTHOR\tTITLE\tSESSION\n")
+	for _, session := range sessions {
+		title := ""
+		if n := len(session.Titles); n > 0 {
+			title = session.Titles[n-1].Title
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			session.Start.Local().Format("2006-01-02 15:04"),
+			sessionDuration(session),
+			formatSize(session.Size),
+			session.Danmaku,
+			session.Reason,
+			session.Author,
+			title,
+			session.ID,
+		)
+	}
+	w.Flush()
+}
+
+// printSession print details of a session
+func printSession(session history.Session) {
+	if jsonOutput {
+		printJSON(session)
+		return
+	}
+
+	fmt.Fprintf(os.Stdout, "Session:  %s\n", session.ID)
+	fmt.Fprintf(os.Stdout, "Room:     %s [%s] %s\n", session.Author, session.Platform, session.URL)
+	fmt.Fprintf(os.Stdout, "Start:    %s\n", session.Start.Local().Format("2006-01-02 15:04:05"))
+	if session.End != nil {
+		fmt.Fprintf(os.Stdout, "End:      %s (%s)\n", session.End.Local().Format("2006-01-02 15:04:05"), session.Reason)
+	}
+	fmt.Fprintf(os.Stdout, "Duration: %s\n", sessionDuration(session))
+	fmt.Fprintf(os.Stdout, "Size:     %s\n", formatSize(session.Size))
+	fmt.Fprintf(os.Stdout, "Quality:  %s\n", session.Quality)
+	fmt.Fprintf(os.Stdout, "Danmaku:  %d\n", session.Danmaku)
+	if session.Errors > 0 {
+		fmt.Fprintf(os.Stdout, "Errors:   %d, last %s\n", session.Errors, session.LastError)
+	}
+
+	fmt.Fprintf(os.Stdout, "Titles:\n")
+	for _, title := range session.Titles {
+		fmt.Fprintf(os.Stdout, "  %s  %s\n", title.Time.Local().Format("15:04:05"), title.Title)
+	}
+	fmt.Fprintf(os.Stdout, "Files:\n")
+	for _, file := range session.Files {
+		fmt.Fprintf(os.Stdout, "  %s  %9s  %s\n", file.Open.Local().Format("15:04:05"), formatSize(file.Size), file.Path)
+	}
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// sessionDuration return the duration, recording if not ended
+func sessionDuration(session history.Session) string {
+	if session.End == nil {
+		return "recording"
+	}
+	return (time.Duration(session.Duration) * time.Second).String()
+}
+
+// formatSize return bytes in binary units
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// needFFmpeg return true if the global downloader or that of an enabled room is ffmpeg
+func needFFmpeg(config *configs.Config) bool {
+	if config.Downloader == configs.DownloaderFFmpeg {
+		return true
+	}
+	for _, room := range config.Rooms {
+		if room.IsEnabled() && config.ForRoom(room).Downloader == configs.DownloaderFFmpeg {
+			return true
+		}
+	}
+	return false
+}
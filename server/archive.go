@@ -0,0 +1,287 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/danmaku"
+)
+
+// video extensions listed as recordings
+var videoExts = map[string]bool{
+	".flv": true,
+	".ts":  true,
+	".mp4": true,
+	".mkv": true,
+}
+
+// Recording is an archived video under the output paths
+type Recording struct {
+	// Path is relative to the output path, separated by slash and prefixed by rootPrefix
+	// if under an output path of rooms
+	Path    string    `json:"path"`
+	Dir     string    `json:"dir"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Danmaku bool      `json:"danmaku"`
+}
+
+// Disk is the usage of the output paths
+type Disk struct {
+	Path string `json:"path"`
+	// Used by files under the output paths
+	Used  int64  `json:"used"`
+	Free  uint64 `json:"free"`
+	Total uint64 `json:"total"`
+	// Roots is the usage of each output path if rooms have their own
+	Roots []Disk `json:"roots,omitempty"`
+}
+
+// hidden return true if a part of the slash separated path start with a dot,
+// queues and temporary files of the recorder are hidden
+func hidden(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// rootPrefix mark a path under an output path of rooms by its index, like @1/dir/1.flv,
+// paths under the global output path have no prefix
+const rootPrefix = "@"
+
+// roots return output paths not inside an earlier one
+func roots(outPaths []string) []string {
+	result := []string{}
+	for _, p := range outPaths {
+		p = filepath.Clean(p)
+		nested := false
+		for _, root := range result {
+			if inside(root, p) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// inside return true if local is root or under it
+func inside(root, local string) bool {
+	rootAbs, err1 := filepath.Abs(root)
+	localAbs, err2 := filepath.Abs(local)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(rootAbs, localAbs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// rootLabel return the prefix of paths under the i-th output path
+func rootLabel(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return rootPrefix + strconv.Itoa(i) + "/"
+}
+
+// walk call f for every visible file under the output paths, a missing one is skipped
+func (s *Server) walk(f func(rel string, info os.FileInfo)) error {
+	for i, root := range s.outPaths {
+		err := walkRoot(root, func(rel string, info os.FileInfo) {
+			f(rootLabel(i)+rel, info)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkRoot call f for every visible file under root
+func walkRoot(root string, f func(rel string, info os.FileInfo)) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if hidden(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() {
+			f(rel, info)
+		}
+		return nil
+	})
+}
+
+// recordings list videos under the output paths, ordered by path
+func (s *Server) recordings() ([]Recording, error) {
+	list := []Recording{}
+	names := map[string]bool{}
+
+	err := s.walk(func(rel string, info os.FileInfo) {
+		names[rel] = true
+		if !videoExts[strings.ToLower(path.Ext(rel))] {
+			return
+		}
+
+		dir := path.Dir(rel)
+		if dir == "." {
+			dir = ""
+		}
+		list = append(list, Recording{
+			Path:    rel,
+			Dir:     dir,
+			Name:    path.Base(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range list {
+		base := strings.TrimSuffix(list[i].Path, path.Ext(list[i].Path))
+		list[i].Danmaku = names[base+".xml"] || names[base+".jsonl"]
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+	return list, nil
+}
+
+// disk return usage of the output paths, free and total are of the global one
+func (s *Server) disk() Disk {
+	if len(s.outPaths) == 0 {
+		return Disk{}
+	}
+	d := Disk{Path: s.outPaths[0]}
+	for _, root := range s.outPaths {
+		r := Disk{Path: root}
+		walkRoot(root, func(rel string, info os.FileInfo) {
+			r.Used += info.Size()
+		})
+		r.Free, r.Total = diskSpace(root)
+		d.Used += r.Used
+		d.Roots = append(d.Roots, r)
+	}
+	d.Free, d.Total = d.Roots[0].Free, d.Roots[0].Total
+	if len(d.Roots) == 1 {
+		d.Roots = nil
+	}
+	return d
+}
+
+// file return the local path of a visible file under the output paths,
+// backslashes are rejected as they separate paths on windows
+func (s *Server) file(rel string) (string, error) {
+	rel = path.Clean("/" + rel)[1:]
+	if rel == "" || hidden(rel) || strings.ContainsRune(rel, '\\') || len(s.outPaths) == 0 {
+		return "", fmt.Errorf("file not found")
+	}
+
+	root := s.outPaths[0]
+	if parts := strings.SplitN(rel, "/", 2); len(parts) == 2 && strings.HasPrefix(parts[0], rootPrefix) {
+		if i, err := strconv.Atoi(parts[0][len(rootPrefix):]); err == nil && i > 0 && i < len(s.outPaths) {
+			root, rel = s.outPaths[i], parts[1]
+		}
+	}
+
+	local := filepath.Join(root, filepath.FromSlash(rel))
+	if !inside(root, local) {
+		return "", fmt.Errorf("file not found")
+	}
+	info, err := os.Stat(local)
+	if err != nil || info.IsDir() {
+		return "", fmt.Errorf("file not found")
+	}
+	return local, nil
+}
+
+// handleRecordings list archived videos
+func (s *Server) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	list, err := s.recordings()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleDisk return usage of the output paths
+func (s *Server) handleDisk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.disk())
+}
+
+// handleFile serve a file under the output paths with range support
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+
+	local, err := s.file(strings.TrimPrefix(r.URL.Path, "/files/"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	http.ServeFile(w, r, local)
+}
+
+// handleDPlayer is the DPlayer danmaku api v3, id is the path of the video,
+// sending danmaku is not supported
+func (s *Server) handleDPlayer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"code": 1, "msg": "read only"})
+		return
+	}
+
+	local, err := s.file(r.URL.Query().Get("id"))
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"code": 1, "msg": err.Error()})
+		return
+	}
+	items, err := danmaku.ReadDPlayer(local)
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"code": 1, "msg": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"code": 0, "data": items})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lintmx/dd-recorder/configs"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"bilibili/a/2020-01-02/1.flv":  "0123456789",
+		"bilibili/a/2020-01-02/1.xml":  `<?xml version="1.0"?><i><d p="1.5,1,25,16777215,0,0,1,0" user="u">hi</d>`,
+		"bilibili/a/2020-01-02/2.mp4":  "01234",
+		"youtube/b/2020-01-03/1.ts":    "0",
+		"youtube/b/2020-01-03/1.jsonl": `{"type":"chat","offset":2,"user_name":"v","content":"yo"}` + "\n",
+		".webhook/1.json":              "{}",
+		".postprocess.json":            "{}",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+	// rooms with their own output path, one inside the global and one missing
+	room, err := ioutil.TempDir("", "dd-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(room)
+	ioutil.WriteFile(filepath.Join(room, "3.flv"), []byte("012"), 0644)
+	outPaths := []string{dir, room, filepath.Join(dir, "bilibili"), room + "-missing"}
+
+	s := New(configs.HTTPConfig{Token: "secret"}, outPaths, &fakeController{})
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		s.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/api/recordings")
+	list := []Recording{}
+	if err := json.Unmarshal([]byte(body), &list); code != 200 || err != nil {
+		t.Fatalf("recordings = %d %s", code, body)
+	}
+	got := []string{}
+	for _, r := range list {
+		got = append(got, r.Dir+"|"+r.Name+"|"+strings.Repeat("d", map[bool]int{true: 1}[r.Danmaku]))
+	}
+	want := "@1|3.flv| bilibili/a/2020-01-02|1.flv|d bilibili/a/2020-01-02|2.mp4| youtube/b/2020-01-03|1.ts|d"
+	if strings.Join(got, " ") != want {
+		t.Errorf("recordings = %v, want %s", got, want)
+	}
+
+	code, body = get("/api/disk")
+	disk := Disk{}
+	json.Unmarshal([]byte(body), &disk)
+	if code != 200 || disk.Path != dir || len(disk.Roots) != 3 || disk.Roots[1].Path != room || disk.Roots[1].Used != 3 ||
+		disk.Used != disk.Roots[0].Used+3 {
+		t.Errorf("disk = %d %s", code, body)
+	}
+
+	tests := []struct {
+		path string
+		code int
+		want string
+	}{
+		{"/files/bilibili/a/2020-01-02/1.flv", 200, "0123456789"},
+		{"/files/bilibili/a/2020-01-02/2.mp4", 200, "01234"},
+		{"/files/@1/3.flv", 200, "012"},
+		{"/files/@2/3.flv", 404, "file not found"},
+		{"/files/.postprocess.json", 404, "file not found"},
+		{"/files/.webhook/1.json", 404, "file not found"},
+		{"/files/bilibili/a", 404, "file not found"},
+		{"/api/dplayer/v3/?id=bilibili/a/2020-01-02/1.flv", 200, `{"code":0,"data":[[1.5,0,16777215,"u","hi"]]}`},
+		{"/api/dplayer/v3/?id=youtube/b/2020-01-03/1.ts", 200, `{"code":0,"data":[[2,0,16777215,"v","yo"]]}`},
+		{"/api/dplayer/v3/?id=bilibili/a/2020-01-02/2.mp4", 200, `{"code":0,"data":[]}`},
+		{"/api/dplayer/v3/?id=nothing.flv", 200, `"code":1`},
+		{"/", 200, "<title>DD Recorder</title>"},
+		{"/static/app.js", 200, "DPlayer"},
+		{"/missing", 404, "not found"},
+	}
+
+	for _, test := range tests {
+		code, body := get(test.path)
+		if code != test.code || !strings.Contains(body, test.want) {
+			t.Errorf("GET %s = %d %s, want %d %s", test.path, code, body, test.code, test.want)
+		}
+	}
+
+	for _, rel := range []string{"../etc/passwd", "bilibili/../../x", "bilibili/a/.hidden", `bilibili\..\..\x`, `bilibili\a\2020-01-02\1.flv`, "@1/../../x", "@1/.hidden"} {
+		if local, err := s.file(rel); err == nil {
+			t.Errorf("file(%s) = %s", rel, local)
+		}
+	}
+	if local, err := s.file("bilibili/x/../a/2020-01-02/1.flv"); err != nil || !strings.HasPrefix(local, dir) {
+		t.Errorf("file in output path = %s, %v", local, err)
+	}
+
+	// the page ask for the token itself
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("GET / without token = %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/files/bilibili/a/2020-01-02/1.flv", nil))
+	if w.Code != 401 {
+		t.Errorf("GET file without token = %d", w.Code)
+	}
+}
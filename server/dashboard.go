@@ -0,0 +1,320 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dashboard assets compiled into the binary, DPlayer and mpegts.js are in vendors
+var assets = map[string]struct {
+	contentType string
+	content     string
+}{
+	"/":               {"text/html; charset=utf-8", indexHTML},
+	"/static/app.js":  {"application/javascript; charset=utf-8", appJS},
+	"/static/app.css": {"text/css; charset=utf-8", appCSS},
+}
+
+// assets never change while running
+var assetTime = time.Now()
+
+// handleDashboard serve the web ui
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	asset, ok := assets[r.URL.Path]
+	if v, vendored := vendors[r.URL.Path]; vendored {
+		asset.contentType = v.contentType
+		asset.content, ok = vendorContent[r.URL.Path]
+		if !ok {
+			http.Redirect(w, r, v.url, http.StatusFound)
+			return
+		}
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+
+	w.Header().Set("Content-Type", asset.contentType)
+	http.ServeContent(w, r, r.URL.Path, assetTime, strings.NewReader(asset.content))
+}
+
+const indexHTML = `<!DOCTYPE html>
+<html lang="zh">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>DD Recorder</title>
+<link rel="stylesheet" href="/static/vendor/DPlayer.min.css">
+<link rel="stylesheet" href="/static/app.css">
+</head>
+<body>
+<header>
+  <h1>DD Recorder</h1>
+  <span id="disk"></span>
+</header>
+<main>
+  <section>
+    <h2>直播间</h2>
+    <form id="add">
+      <input name="url" type="url" placeholder="直播间地址" required>
+      <button type="submit">添加</button>
+    </form>
+    <table>
+      <thead><tr><th>主播</th><th>平台</th><th>标题</th><th>状态</th><th>录制</th><th></th></tr></thead>
+      <tbody id="monitors"></tbody>
+    </table>
+  </section>
+  <section id="player-section" hidden>
+    <h2 id="player-title"></h2>
+    <div id="player"></div>
+  </section>
+  <section>
+    <h2>录像</h2>
+    <div id="recordings"></div>
+  </section>
+  <section>
+    <h2>事件</h2>
+    <ul id="events"></ul>
+  </section>
+</main>
+<script src="/static/vendor/mpegts.min.js"></script>
+<script src="/static/vendor/DPlayer.min.js"></script>
+<script src="/static/app.js"></script>
+</body>
+</html>
+`
+
+const appCSS = `body { margin: 0; font: 14px/1.5 -apple-system, "Segoe UI", "Microsoft YaHei", sans-serif; color: #222; background: #f5f6f8; }
+header { display: flex; align-items: baseline; justify-content: space-between; padding: 12px 24px; background: #fff; border-bottom: 1px solid #e3e5e8; }
+h1 { margin: 0; font-size: 20px; }
+h2 { font-size: 16px; margin: 0 0 12px; }
+main { max-width: 1200px; margin: 0 auto; padding: 16px; }
+section { background: #fff; border: 1px solid #e3e5e8; border-radius: 6px; padding: 16px; margin-bottom: 16px; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: 6px 8px; border-bottom: 1px solid #eef0f2; vertical-align: top; }
+td.file { color: #666; font-size: 12px; word-break: break-all; }
+button { margin: 0 4px 4px 0; padding: 2px 10px; border: 1px solid #c8ccd1; border-radius: 4px; background: #fff; cursor: pointer; }
+button:hover { background: #f0f2f4; }
+form { display: flex; margin-bottom: 12px; }
+form input { flex: 1; margin-right: 8px; padding: 4px 8px; }
+.badge { display: inline-block; padding: 0 6px; margin-right: 4px; border-radius: 3px; font-size: 12px; color: #fff; background: #999; }
+.live { background: #e5484d; }
+.recording { background: #30a46c; }
+.paused { background: #f5a623; }
+.stalled { background: #8e4ec6; }
+details { margin-bottom: 8px; }
+summary { cursor: pointer; font-weight: 600; }
+#events { margin: 0; padding-left: 20px; max-height: 240px; overflow: auto; font-size: 12px; }
+#player { max-width: 960px; }
+`
+
+const appJS = `(function () {
+  'use strict';
+
+  var token = localStorage.getItem('dd-token') || '';
+  var player = null;
+
+  function request(method, path, body) {
+    var headers = {};
+    if (token) headers['Authorization'] = 'Bearer ' + token;
+    if (body) headers['Content-Type'] = 'application/json';
+    return fetch(path, { method: method, headers: headers, body: body ? JSON.stringify(body) : undefined })
+      .then(function (res) {
+        if (res.status === 401) {
+          token = prompt('Token') || '';
+          localStorage.setItem('dd-token', token);
+          throw new Error('unauthorized');
+        }
+        if (res.status === 204) return null;
+        return res.json().then(function (data) {
+          if (!res.ok) throw new Error(data.error || res.statusText);
+          return data;
+        });
+      });
+  }
+
+  function el(tag, attrs, children) {
+    var node = document.createElement(tag);
+    Object.keys(attrs || {}).forEach(function (key) {
+      if (key === 'onclick') node.onclick = attrs[key];
+      else node.setAttribute(key, attrs[key]);
+    });
+    (children || []).forEach(function (child) {
+      node.appendChild(typeof child === 'string' ? document.createTextNode(child) : child);
+    });
+    return node;
+  }
+
+  function size(bytes) {
+    var units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+    var i = 0;
+    while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+    return bytes.toFixed(i ? 1 : 0) + ' ' + units[i];
+  }
+
+  function elapsed(since) {
+    var s = Math.max(0, Math.floor((Date.now() - new Date(since).getTime()) / 1000));
+    var pad = function (n) { return (n < 10 ? '0' : '') + n; };
+    return Math.floor(s / 3600) + ':' + pad(Math.floor(s / 60) % 60) + ':' + pad(s % 60);
+  }
+
+  function fileURL(path) {
+    var url = '/files/' + path.split('/').map(encodeURIComponent).join('/');
+    return token ? url + '?token=' + encodeURIComponent(token) : url;
+  }
+
+  function action(method, path) {
+    return function () {
+      request(method, path).then(refresh).catch(function (err) { alert(err.message); });
+    };
+  }
+
+  function renderMonitors(list) {
+    var body = document.getElementById('monitors');
+    body.innerHTML = '';
+    list.forEach(function (m) {
+      var base = '/api/monitors/' + m.id;
+      var status = [];
+      if (m.live) status.push(el('span', { 'class': 'badge live' }, ['直播中']));
+      if (m.recording) status.push(el('span', { 'class': 'badge recording' }, ['录制中']));
+      if (m.paused) status.push(el('span', { 'class': 'badge paused' }, ['已暂停']));
+      (m.stalled || []).forEach(function (part) {
+        status.push(el('span', { 'class': 'badge stalled' }, [part === 'stream' ? '录像卡住' : '弹幕中断']));
+      });
+      if (!status.length) status.push(el('span', { 'class': 'badge' }, ['未开播']));
+
+      var progress = m.recording && m.record_time ? elapsed(m.record_time) + ' / ' + size(m.size || 0) : '';
+      body.appendChild(el('tr', {}, [
+        el('td', {}, [el('a', { href: m.url, target: '_blank', rel: 'noopener' }, [m.name || m.author || m.id])]),
+        el('td', {}, [m.platform]),
+        el('td', {}, [m.title]),
+        el('td', {}, status),
+        el('td', { 'class': 'file' }, [progress, el('br'), m.file || '']),
+        el('td', {}, [
+          m.paused ? el('button', { onclick: action('POST', base + '/resume') }, ['恢复'])
+                   : el('button', { onclick: action('POST', base + '/pause') }, ['暂停']),
+          m.recording ? el('button', { onclick: action('POST', base + '/stop') }, ['停止录制'])
+                      : el('button', { onclick: action('POST', base + '/start') }, ['开始录制']),
+          el('button', { onclick: function () {
+            if (confirm('移除 ' + (m.name || m.author || m.url) + '?')) action('DELETE', base)();
+          } }, ['移除'])
+        ])
+      ]));
+    });
+  }
+
+  function renderRecordings(list) {
+    var groups = {};
+    list.forEach(function (r) { (groups[r.dir] = groups[r.dir] || []).push(r); });
+
+    var root = document.getElementById('recordings');
+    var open = {};
+    root.querySelectorAll('details[open]').forEach(function (d) { open[d.dataset.dir] = true; });
+    root.innerHTML = '';
+    Object.keys(groups).sort().reverse().forEach(function (dir) {
+      var rows = groups[dir].map(function (r) {
+        return el('tr', {}, [
+          el('td', {}, [r.name]),
+          el('td', {}, [size(r.size)]),
+          el('td', {}, [new Date(r.mod_time).toLocaleString()]),
+          el('td', {}, [
+            el('button', { onclick: function () { play(r); } }, ['播放']),
+            el('a', { href: fileURL(r.path), download: r.name }, ['下载'])
+          ])
+        ]);
+      });
+      var details = el('details', { 'data-dir': dir }, [
+        el('summary', {}, [(dir || '/') + ' (' + rows.length + ')']),
+        el('table', {}, [el('tbody', {}, rows)])
+      ]);
+      details.open = !!open[dir];
+      root.appendChild(details);
+    });
+  }
+
+  function renderEvents(list) {
+    var root = document.getElementById('events');
+    root.innerHTML = '';
+    list.forEach(function (e) {
+      root.appendChild(el('li', {}, [
+        new Date(e.time).toLocaleString() + ' [' + e.type + '] ' + e.author + ' ' + (e.file || e.error || e.title)
+      ]));
+    });
+  }
+
+  function play(r) {
+    var ext = r.name.split('.').pop().toLowerCase();
+    var video = { url: fileURL(r.path) };
+    if (ext === 'flv' || ext === 'ts') {
+      video.type = 'mpegts';
+      video.customType = {
+        mpegts: function (element) {
+          var p = mpegts.createPlayer({ type: ext === 'flv' ? 'flv' : 'mpegts', url: element.src });
+          p.attachMediaElement(element);
+          p.load();
+        }
+      };
+    }
+
+    if (player) player.destroy();
+    document.getElementById('player-section').hidden = false;
+    document.getElementById('player-title').textContent = r.path;
+    player = new DPlayer({
+      container: document.getElementById('player'),
+      video: video,
+      danmaku: {
+        id: encodeURIComponent(r.path),
+        api: '/api/dplayer/',
+        bottom: '15%',
+        unlimited: true
+      },
+      // read with the token header, colors are numbers in api v3
+      apiBackend: {
+        read: function (options) {
+          request('GET', options.url).then(function (data) {
+            if (data.code !== 0) throw new Error(data.msg);
+            options.success(data.data.map(function (d) {
+              return { time: d[0], type: ['right', 'top', 'bottom'][d[1]], color: '#' + ('00000' + d[2].toString(16)).slice(-6), author: d[3], text: d[4] };
+            }));
+          }).catch(function (err) { options.error(err.message); });
+        },
+        send: function (options) { options.error('read only'); }
+      }
+    });
+    document.getElementById('player-section').scrollIntoView();
+  }
+
+  function refresh() {
+    request('GET', '/api/monitors').then(renderMonitors).catch(function () {});
+    request('GET', '/api/events?limit=20').then(renderEvents).catch(function () {});
+    request('GET', '/api/disk').then(function (d) {
+      var text = '录像 ' + size(d.used);
+      if (d.total) text += ' · 剩余 ' + size(d.free) + ' / ' + size(d.total);
+      document.getElementById('disk').textContent = text;
+    }).catch(function () {});
+  }
+
+  function refreshRecordings() {
+    request('GET', '/api/recordings').then(renderRecordings).catch(function () {});
+  }
+
+  document.getElementById('add').onsubmit = function (e) {
+    e.preventDefault();
+    var input = e.target.elements.url;
+    request('POST', '/api/monitors', { url: input.value }).then(function () {
+      input.value = '';
+      refresh();
+    }).catch(function (err) { alert(err.message); });
+  };
+
+  refresh();
+  refreshRecordings();
+  setInterval(refresh, 5000);
+  setInterval(refreshRecordings, 60000);
+})();
+`
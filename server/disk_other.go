@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!openbsd,!dragonfly,!windows
+
+package server
+
+// diskSpace is unknown on this system
+func diskSpace(path string) (uint64, uint64) {
+	return 0, 0
+}
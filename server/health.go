@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// health status
+const (
+	healthOK       = "ok"
+	healthStalled  = "stalled"
+	healthStarting = "starting"
+)
+
+// healthReport is the body of /healthz and /readyz
+type healthReport struct {
+	Status  string        `json:"status"`
+	Stalled []stalledRoom `json:"stalled,omitempty"`
+}
+
+// stalledRoom is a recording the watchdog found stalled
+type stalledRoom struct {
+	ID          string     `json:"id"`
+	Platform    string     `json:"platform"`
+	Author      string     `json:"author"`
+	Stalled     []string   `json:"stalled"`
+	LastWrite   *time.Time `json:"last_write,omitempty"`
+	LastDanmaku *time.Time `json:"last_danmaku,omitempty"`
+}
+
+// stalledRooms return recordings with stalled stream or danmaku
+func (s *Server) stalledRooms() []stalledRoom {
+	rooms := []stalledRoom{}
+	for _, status := range s.controller.List() {
+		if len(status.Stalled) == 0 {
+			continue
+		}
+		rooms = append(rooms, stalledRoom{
+			ID:          status.ID,
+			Platform:    status.Platform,
+			Author:      status.Author,
+			Stalled:     status.Stalled,
+			LastWrite:   status.LastWrite,
+			LastDanmaku: status.LastDanmaku,
+		})
+	}
+	return rooms
+}
+
+// handleHealth report stalled recordings, it is 200 while the process serve
+// as a stalled room is handled by the watchdog, not by restarting the process
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+
+	report := healthReport{Status: healthOK, Stalled: s.stalledRooms()}
+	if len(report.Stalled) > 0 {
+		report.Status = healthStalled
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleReady is 503 until rooms of the config are started, stalled rooms are listed only
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+
+	if !s.controller.Ready() {
+		writeJSON(w, http.StatusServiceUnavailable, healthReport{Status: healthStarting})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthReport{Status: healthOK, Stalled: s.stalledRooms()})
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/monitor"
+)
+
+func TestHealth(t *testing.T) {
+	last := time.Now().Add(-time.Hour)
+	c := &fakeController{monitors: []monitor.Status{
+		{ID: "a", Recording: true},
+		{ID: "b", Recording: true, LastWrite: &last, Stalled: []string{monitor.StalledStream}},
+	}}
+	// probes are public
+	s := New(configs.HTTPConfig{Token: "secret"}, nil, c)
+
+	get := func(path string) (int, healthReport) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		report := healthReport{}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("GET %s body %s", path, w.Body.String())
+		}
+		return w.Code, report
+	}
+
+	code, report := get("/healthz")
+	if code != http.StatusOK || report.Status != healthStalled ||
+		len(report.Stalled) != 1 || report.Stalled[0].ID != "b" || report.Stalled[0].LastWrite == nil {
+		t.Errorf("healthz = %d %+v", code, report)
+	}
+
+	code, report = get("/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != healthStarting {
+		t.Errorf("readyz before ready = %d %+v", code, report)
+	}
+
+	c.ready = true
+	code, report = get("/readyz")
+	if code != http.StatusOK || report.Status != healthOK || len(report.Stalled) != 1 {
+		t.Errorf("readyz = %d %+v", code, report)
+	}
+
+	c.monitors[1].Stalled = nil
+	code, report = get("/healthz")
+	if code != http.StatusOK || report.Status != healthOK || len(report.Stalled) != 0 {
+		t.Errorf("healthz recovered = %d %+v", code, report)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/healthz", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /healthz = %d", w.Code)
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+	"github.com/lintmx/dd-recorder/history"
+	"github.com/lintmx/dd-recorder/instance"
+	"github.com/lintmx/dd-recorder/metrics"
+	"github.com/lintmx/dd-recorder/monitor"
+	"go.uber.org/zap"
+)
+
+// default count of events returned
+const defaultEventLimit = 50
+
+// Controller manage monitors at runtime
+type Controller interface {
+	List() []monitor.Status
+	Status(id string) (monitor.Status, error)
+	Add(room string) (monitor.Status, error)
+	Remove(id string) error
+	Pause(id string) error
+	Resume(id string) error
+	StartRecord(id string) error
+	StopRecord(id string) error
+	Events(monitorID string, limit int) []event.Event
+	// Ready return true once rooms of the config are started
+	Ready() bool
+	History(query history.Query) ([]history.Session, error)
+	HistorySession(id string) (history.Session, error)
+}
+
+// Server is the http control api and the dashboard
+type Server struct {
+	listen string
+	token  string
+	// outPaths of recordings, the global one first
+	outPaths   []string
+	controller Controller
+	mux        *http.ServeMux
+}
+
+// New return a server of controller, recordings are served from outPaths,
+// the global output path first then those of rooms
+func New(conf configs.HTTPConfig, outPaths []string, controller Controller) *Server {
+	s := &Server{
+		listen:     conf.Listen,
+		token:      conf.Token,
+		outPaths:   roots(outPaths),
+		controller: controller,
+		mux:        http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/api/monitors", s.handleMonitors)
+	s.mux.HandleFunc("/api/monitors/", s.handleMonitor)
+	s.mux.HandleFunc("/api/events", s.handleEvents)
+	s.mux.HandleFunc("/api/recordings", s.handleRecordings)
+	s.mux.HandleFunc("/api/disk", s.handleDisk)
+	s.mux.HandleFunc("/api/history", s.handleHistory)
+	s.mux.HandleFunc("/api/history/", s.handleHistorySession)
+	s.mux.HandleFunc("/api/dplayer/v3/", s.handleDPlayer)
+	s.mux.HandleFunc("/files/", s.handleFile)
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	s.mux.HandleFunc("/", s.handleDashboard)
+
+	return s
+}
+
+// Run serve until ctx done
+func (s *Server) Run(ctx context.Context) {
+	inst := instance.GetInstance(ctx)
+	defer inst.WaitGroup.Done()
+
+	server := &http.Server{
+		Addr:    s.listen,
+		Handler: s,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	zap.L().Info("Http Server", zap.String("Listen", s.listen))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		zap.L().Error("Http Server",
+			zap.String("Listen", s.listen),
+			zap.String("Err", err.Error()),
+		)
+	}
+}
+
+// ServeHTTP check the token and dispatch the request, the dashboard page and probes are public
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	public := !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/files/") &&
+		r.URL.Path != "/metrics"
+	if s.token != "" && !public && !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized accept the token in Authorization header or token query
+func (s *Server) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// handleMonitors list monitors or add a room
+func (s *Server) handleMonitors(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.controller.List())
+	case http.MethodPost:
+		request := struct {
+			URL string `json:"url"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad request body - %s", err.Error()))
+			return
+		}
+
+		status, err := s.controller.Add(request.URL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, status)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleMonitor serve /api/monitors/{id} and /api/monitors/{id}/{action}
+func (s *Server) handleMonitor(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/monitors/"), "/")
+	id := parts[0]
+	if id == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.writeStatus(w, id, nil)
+		case http.MethodDelete:
+			if err := s.controller.Remove(id); err != nil {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+		return
+	}
+
+	actions := map[string]func(string) error{
+		"pause":  s.controller.Pause,
+		"resume": s.controller.Resume,
+		"start":  s.controller.StartRecord,
+		"stop":   s.controller.StopRecord,
+	}
+	action, ok := actions[parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	s.writeStatus(w, id, action(id))
+}
+
+// writeStatus write the monitor status or err
+func (s *Server) writeStatus(w http.ResponseWriter, id string, err error) {
+	if err == nil {
+		var status monitor.Status
+		if status, err = s.controller.Status(id); err == nil {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, err)
+}
+
+// handleEvents return recent events, filtered by monitor and limit query
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	limit := defaultEventLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad limit %q", value))
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, s.controller.Events(r.URL.Query().Get("monitor"), limit))
+}
+
+// handleHistory return recorded sessions, filtered by monitor, author, since, until and limit query
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	values := r.URL.Query()
+	query := history.Query{
+		MonitorID: values.Get("monitor"),
+		Author:    values.Get("author"),
+		Limit:     defaultEventLimit,
+	}
+	if value := values.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad limit %q", value))
+			return
+		}
+		query.Limit = n
+	}
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := values.Get(name); value != "" {
+			parsed, err := history.ParseTime(value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	sessions, err := s.controller.History(query)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// handleHistorySession serve /api/history/{session id}
+func (s *Server) handleHistorySession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	session, err := s.controller.HistorySession(strings.TrimPrefix(r.URL.Path, "/api/history/"))
+	if err == history.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
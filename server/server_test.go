@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+	"github.com/lintmx/dd-recorder/history"
+	"github.com/lintmx/dd-recorder/monitor"
+)
+
+type fakeController struct {
+	monitors []monitor.Status
+	calls    []string
+	ready    bool
+}
+
+func (c *fakeController) List() []monitor.Status {
+	return c.monitors
+}
+
+func (c *fakeController) find(id string) (*monitor.Status, error) {
+	for i := range c.monitors {
+		if c.monitors[i].ID == id {
+			return &c.monitors[i], nil
+		}
+	}
+	return nil, fmt.Errorf("monitor not found")
+}
+
+func (c *fakeController) Status(id string) (monitor.Status, error) {
+	status, err := c.find(id)
+	if err != nil {
+		return monitor.Status{}, err
+	}
+	return *status, nil
+}
+
+func (c *fakeController) Add(room string) (monitor.Status, error) {
+	if !strings.HasPrefix(room, "https://") {
+		return monitor.Status{}, fmt.Errorf("room url %q invalid", room)
+	}
+	status := monitor.Status{ID: fmt.Sprint(len(c.monitors) + 1), URL: room}
+	c.monitors = append(c.monitors, status)
+	return status, nil
+}
+
+func (c *fakeController) Remove(id string) error {
+	return c.call("remove", id)
+}
+
+func (c *fakeController) Pause(id string) error {
+	status, err := c.find(id)
+	if err == nil {
+		status.Paused = true
+	}
+	return err
+}
+
+func (c *fakeController) Resume(id string) error {
+	return c.call("resume", id)
+}
+
+func (c *fakeController) StartRecord(id string) error {
+	return c.call("start", id)
+}
+
+func (c *fakeController) StopRecord(id string) error {
+	return c.call("stop", id)
+}
+
+func (c *fakeController) call(action, id string) error {
+	if _, err := c.find(id); err != nil {
+		return err
+	}
+	c.calls = append(c.calls, action+" "+id)
+	return nil
+}
+
+func (c *fakeController) History(query history.Query) ([]history.Session, error) {
+	c.calls = append(c.calls, fmt.Sprintf("history %s %s %d %d", query.MonitorID, query.Author, query.Since.Year(), query.Limit))
+	return []history.Session{{ID: "a-1", MonitorID: query.MonitorID}}, nil
+}
+
+func (c *fakeController) HistorySession(id string) (history.Session, error) {
+	if id != "a-1" {
+		return history.Session{}, history.ErrNotFound
+	}
+	return history.Session{ID: id}, nil
+}
+
+func (c *fakeController) Ready() bool {
+	return c.ready
+}
+
+func (c *fakeController) Events(monitorID string, limit int) []event.Event {
+	return []event.Event{{Type: event.LiveStart, MonitorID: monitorID, Title: fmt.Sprint(limit)}}
+}
+
+func TestServer(t *testing.T) {
+	c := &fakeController{monitors: []monitor.Status{{ID: "a", URL: "https://example.com/a"}}}
+	s := New(configs.HTTPConfig{}, nil, c)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		want   string
+	}{
+		{"GET", "/api/monitors", "", 200, `"id":"a"`},
+		{"POST", "/api/monitors", `{"url":"https://example.com/b"}`, 201, `"url":"https://example.com/b"`},
+		{"POST", "/api/monitors", `{"url":"ftp://example.com"}`, 400, `invalid`},
+		{"POST", "/api/monitors", `{`, 400, `bad request body`},
+		{"PUT", "/api/monitors", "", 405, `method not allowed`},
+		{"GET", "/api/monitors/a", "", 200, `"paused":false`},
+		{"GET", "/api/monitors/x", "", 404, `monitor not found`},
+		{"POST", "/api/monitors/a/pause", "", 200, `"paused":true`},
+		{"POST", "/api/monitors/a/start", "", 200, `"id":"a"`},
+		{"POST", "/api/monitors/x/stop", "", 404, `monitor not found`},
+		{"GET", "/api/monitors/a/stop", "", 405, `method not allowed`},
+		{"POST", "/api/monitors/a/jump", "", 404, `not found`},
+		{"DELETE", "/api/monitors/a", "", 204, ``},
+		{"GET", "/api/events?monitor=a&limit=3", "", 200, `"monitor_id":"a","url":"","platform":"","author":"","title":"3"`},
+		{"GET", "/api/events", "", 200, `"title":"50"`},
+		{"GET", "/api/events?limit=-1", "", 400, `bad limit`},
+		{"GET", "/metrics", "", 200, "# TYPE dd_bytes_written_total counter"},
+		{"GET", "/api/history?monitor=a&author=b&since=2020-01-02&limit=5", "", 200, `"id":"a-1","monitor_id":"a"`},
+		{"GET", "/api/history?since=yesterday", "", 400, `bad time`},
+		{"GET", "/api/history?limit=0", "", 400, `bad limit`},
+		{"GET", "/api/history/a-1", "", 200, `"id":"a-1"`},
+		{"GET", "/api/history/x", "", 404, `session not found`},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != test.code || !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s %s = %d %s, want %d %s", test.method, test.path, w.Code, w.Body.String(), test.code, test.want)
+		}
+	}
+
+	if want := "[start a remove a history a b 2020 5]"; fmt.Sprint(c.calls) != want {
+		t.Errorf("calls = %v, want %s", c.calls, want)
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	s := New(configs.HTTPConfig{Token: "secret"}, nil, &fakeController{})
+
+	tests := []struct {
+		path   string
+		header string
+		code   int
+	}{
+		{"/api/monitors", "", http.StatusUnauthorized},
+		{"/api/monitors", "Bearer wrong", http.StatusUnauthorized},
+		{"/api/monitors", "Bearer secret", http.StatusOK},
+		{"/api/monitors?token=secret", "", http.StatusOK},
+		{"/metrics", "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		s.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("GET %s with %q = %d, want %d", test.path, test.header, w.Code, test.code)
+		}
+		if w.Code == http.StatusOK {
+			list := []monitor.Status{}
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Errorf("GET %s body %s", test.path, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestDashboardVendor(t *testing.T) {
+	s := New(configs.HTTPConfig{}, nil, &fakeController{})
+	const path = "/static/vendor/DPlayer.min.js"
+	defer func(content map[string]string) { vendorContent = content }(vendorContent)
+
+	// not generated yet, the pinned url is used
+	vendorContent = map[string]string{}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != vendors[path].url {
+		t.Errorf("GET %s = %d %s, want redirect to %s", path, w.Code, w.Header().Get("Location"), vendors[path].url)
+	}
+
+	vendorContent = map[string]string{path: "player"}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK || w.Body.String() != "player" || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/javascript") {
+		t.Errorf("GET %s = %d %s %s", path, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(w.Body.String(), "cdn.jsdelivr.net") {
+		t.Error("dashboard page load from cdn")
+	}
+}
@@ -0,0 +1,20 @@
+package server
+
+//go:generate go run vendor_gen.go
+
+// vendor is a third-party library of the dashboard pinned to a version
+type vendor struct {
+	contentType string
+	url         string
+}
+
+// vendors of the dashboard, compiled into vendor_assets.go by go generate
+var vendors = map[string]vendor{
+	"/static/vendor/DPlayer.min.css": {"text/css; charset=utf-8", "https://cdn.jsdelivr.net/npm/dplayer@1.26.0/dist/DPlayer.min.css"},
+	"/static/vendor/DPlayer.min.js":  {"application/javascript; charset=utf-8", "https://cdn.jsdelivr.net/npm/dplayer@1.26.0/dist/DPlayer.min.js"},
+	"/static/vendor/mpegts.min.js":   {"application/javascript; charset=utf-8", "https://cdn.jsdelivr.net/npm/mpegts.js@1.7.3/dist/mpegts.min.js"},
+}
+
+// vendorContent of vendors by path, set by the generated vendor_assets.go.
+// A library not generated yet is redirected to its pinned url.
+var vendorContent = map[string]string{}
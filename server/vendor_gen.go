@@ -0,0 +1,126 @@
+//go:build ignore
+// +build ignore
+
+// vendor_gen download the libraries listed in vendors of vendor.go into vendor_assets.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const output = "vendor_assets.go"
+
+func main() {
+	urls, err := vendorURLs("vendor.go")
+	if err != nil {
+		fail(err)
+	}
+
+	paths := make([]string, 0, len(urls))
+	for path := range urls {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("// Code generated by vendor_gen.go; DO NOT EDIT.\n\npackage server\n\n")
+	for _, path := range paths {
+		fmt.Fprintf(buf, "// %s\n", urls[path])
+	}
+	buf.WriteString("\nfunc init() {\n\tvendorContent = map[string]string{\n")
+	client := &http.Client{Timeout: time.Minute}
+	for _, path := range paths {
+		data, err := download(client, urls[path])
+		if err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(buf, "\t\t// sha256 %x\n", sha256.Sum256(data))
+		fmt.Fprintf(buf, "\t\t%s: %s,\n", strconv.Quote(path), strconv.Quote(string(data)))
+	}
+	buf.WriteString("\t}\n}\n")
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		fail(err)
+	}
+	if err := ioutil.WriteFile(output, source, 0644); err != nil {
+		fail(err)
+	}
+}
+
+// vendorURLs read path and url of each entry in the vendors map
+func vendorURLs(file string) (map[string]string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make(map[string]string)
+	ast.Inspect(f, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok || len(spec.Names) != 1 || spec.Names[0].Name != "vendors" || len(spec.Values) != 1 {
+			return true
+		}
+		list, ok := spec.Values[0].(*ast.CompositeLit)
+		if !ok {
+			return false
+		}
+		for _, elt := range list.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			value, ok := kv.Value.(*ast.CompositeLit)
+			if !ok || len(value.Elts) != 2 {
+				continue
+			}
+			path, err1 := stringLit(kv.Key)
+			url, err2 := stringLit(value.Elts[1])
+			if err1 == nil && err2 == nil {
+				urls[path] = url
+			}
+		}
+		return false
+	})
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no vendors in %s", file)
+	}
+	return urls, nil
+}
+
+func stringLit(expr ast.Expr) (string, error) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", fmt.Errorf("not a string")
+	}
+	return strconv.Unquote(lit.Value)
+}
+
+func download(client *http.Client, url string) ([]byte, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s - %s", url, response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "vendor_gen:", err)
+	os.Exit(1)
+}
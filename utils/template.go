@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PathData is the fields of output path template
+type PathData struct {
+	Platform string
+	Author   string
+	// Name of the room in config, default the author
+	Name   string
+	RoomID string
+	LiveID string
+	Title  string
+	// Time is the start time of the file
+	Time time.Time
+	// RecordTime is the start time of the recording session
+	RecordTime time.Time
+	// Segment is the index of the file in a recording session, from 1
+	Segment     int
+	Quality     int64
+	QualityName string
+}
+
+// PathTemplate render the directory and file name of a recording
+type PathTemplate struct {
+	dir  *template.Template
+	file *template.Template
+}
+
+// NewPathTemplate parse templates and check them with sample data,
+// dir can contain "/" to make sub directories.
+func NewPathTemplate(dir, file string) (*PathTemplate, error) {
+	dirTemplate, err := template.New("dir").Option("missingkey=error").Parse(dir)
+	if err != nil {
+		return nil, fmt.Errorf("dir template - %s", err.Error())
+	}
+	fileTemplate, err := template.New("file").Option("missingkey=error").Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("file template - %s", err.Error())
+	}
+
+	p := &PathTemplate{
+		dir:  dirTemplate,
+		file: fileTemplate,
+	}
+
+	now := time.Now()
+	_, err = p.Render(PathData{
+		Platform:    "Platform",
+		Author:      "Author",
+		Name:        "Name",
+		RoomID:      "1",
+		LiveID:      "1",
+		Title:       "Title",
+		Time:        now,
+		RecordTime:  now,
+		Segment:     1,
+		Quality:     10000,
+		QualityName: "Quality",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Render return the path without extension relative to the output path.
+// Fields are sanitized before render, so a title never create a directory.
+func (p *PathTemplate) Render(data PathData) (string, error) {
+	data.Platform = FilterInvalidCharacters(data.Platform)
+	data.Author = FilterInvalidCharacters(data.Author)
+	data.Name = FilterInvalidCharacters(data.Name)
+	data.RoomID = FilterInvalidCharacters(data.RoomID)
+	data.LiveID = FilterInvalidCharacters(data.LiveID)
+	data.Title = FilterInvalidCharacters(data.Title)
+	data.QualityName = FilterInvalidCharacters(data.QualityName)
+
+	buf := &bytes.Buffer{}
+	if err := p.dir.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("dir template - %s", err.Error())
+	}
+	// keep the directory inside the output path
+	dirs := []string{}
+	for _, name := range strings.Split(filepath.ToSlash(buf.String()), "/") {
+		name = strings.TrimSpace(FilterInvalidCharacters(name))
+		if name == "" || name == "." {
+			continue
+		} else if name == ".." {
+			name = "_"
+		}
+		dirs = append(dirs, name)
+	}
+
+	buf.Reset()
+	if err := p.file.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("file template - %s", err.Error())
+	}
+	file := strings.TrimSpace(FilterInvalidCharacters(buf.String()))
+	if file == "" || file == "." || file == ".." {
+		return "", fmt.Errorf("file template - render an empty name")
+	}
+
+	return filepath.FromSlash(path.Join(append(dirs, file)...)), nil
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPathTemplate(t *testing.T) {
+	data := PathData{
+		Platform:    "哔哩哔哩",
+		Author:      "a/b",
+		RoomID:      "14917277",
+		LiveID:      "123",
+		Title:       "Minecraft: day 1?",
+		Time:        time.Date(2019, 6, 20, 12, 30, 0, 0, time.UTC),
+		RecordTime:  time.Date(2019, 6, 20, 12, 0, 0, 0, time.UTC),
+		Segment:     2,
+		Quality:     10000,
+		QualityName: "原画",
+	}
+
+	tests := []struct {
+		dir  string
+		file string
+		want string
+		err  bool
+	}{
+		{
+			dir:  `{{.Platform}}/{{.Author}}/{{.RecordTime.Format "2006-01-02"}}`,
+			file: `[{{.Time.Format "2006-01-02 15-04-05"}}][{{.Platform}}][{{.Author}}] {{.Title}}`,
+			want: "哔哩哔哩/a_b/2019-06-20/[2019-06-20 12-30-00][哔哩哔哩][a_b] Minecraft_ day 1_",
+		},
+		{
+			dir:  `{{.RoomID}}/../{{.LiveID}}`,
+			file: `{{.Segment}}-{{.QualityName}}-{{.Quality}}`,
+			want: "14917277/_/123/2-原画-10000",
+		},
+		{
+			dir:  ``,
+			file: `{{.Time.Format "15:04"}}/x`,
+			want: "12_30_x",
+		},
+		{file: `{{.Unknown}}`, err: true},
+		{file: `{{.Title`, err: true},
+		{dir: `{{if}}`, file: `a`, err: true},
+		{file: ` `, err: true},
+	}
+
+	for _, test := range tests {
+		p, err := NewPathTemplate(test.dir, test.file)
+		if (err != nil) != test.err {
+			t.Errorf("%q %q: unexpected error %v", test.dir, test.file, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		got, err := p.Render(data)
+		if err != nil {
+			t.Errorf("%q %q: %s", test.dir, test.file, err.Error())
+		} else if got != filepath.FromSlash(test.want) {
+			t.Errorf("%q %q: got %q, want %q", test.dir, test.file, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+	"github.com/lintmx/dd-recorder/instance"
+	"go.uber.org/zap"
+)
+
+// request headers
+const (
+	HeaderEvent     = "X-DD-Event"
+	HeaderDelivery  = "X-DD-Delivery"
+	HeaderSignature = "X-DD-Signature"
+)
+
+// events sent when a webhook has no event list
+var defaultEvents = []string{
+	string(event.LiveStart),
+	string(event.LiveEnd),
+	string(event.RecordFileClose),
+}
+
+// delivery is a request waiting to be sent, saved as a file in the queue dir
+type delivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+}
+
+// Sender post events to webhooks, retry with backoff until delivered
+type Sender struct {
+	hooks       []configs.WebhookConfig
+	dir         string
+	client      *http.Client
+	lock        sync.Mutex
+	queue       []*delivery
+	notify      chan struct{}
+	seq         int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+}
+
+// New return a sender and load deliveries left in dir
+func New(hooks []configs.WebhookConfig, dir string) (*Sender, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &Sender{
+		hooks:       hooks,
+		dir:         dir,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		notify:      make(chan struct{}, 1),
+		minBackoff:  time.Second,
+		maxBackoff:  10 * time.Minute,
+		maxAttempts: 20,
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		d := &delivery{}
+		if err == nil {
+			err = json.Unmarshal(data, d)
+		}
+		if err != nil {
+			zap.L().Error("Load Webhook Delivery",
+				zap.String("Path", file),
+				zap.String("Err", err.Error()),
+			)
+			os.Remove(file)
+			continue
+		}
+		s.queue = append(s.queue, d)
+	}
+	sort.Slice(s.queue, func(i, j int) bool {
+		return s.queue[i].ID < s.queue[j].ID
+	})
+
+	return s, nil
+}
+
+// SetHooks replace webhooks, queued deliveries are sent with the secret of the new config
+func (s *Sender) SetHooks(hooks []configs.WebhookConfig) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hooks = hooks
+}
+
+// Handle queue the event for every webhook want it, subscribed to the event bus
+func (s *Sender) Handle(e *event.Event) {
+	s.lock.Lock()
+	hooks := s.hooks
+	s.lock.Unlock()
+
+	var body []byte
+	for _, hook := range hooks {
+		events := hook.Events
+		if len(events) == 0 {
+			events = defaultEvents
+		}
+		if !contains(events, string(e.Type)) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(e); err != nil {
+				return
+			}
+		}
+
+		s.lock.Lock()
+		s.seq++
+		d := &delivery{
+			ID:    fmt.Sprintf("%019d-%04d", time.Now().UnixNano(), s.seq%10000),
+			URL:   hook.URL,
+			Event: string(e.Type),
+			Body:  body,
+			Next:  time.Now(),
+		}
+		s.queue = append(s.queue, d)
+		s.save(d)
+		s.lock.Unlock()
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run send deliveries until ctx done
+func (s *Sender) Run(ctx context.Context) {
+	inst := instance.GetInstance(ctx)
+	defer inst.WaitGroup.Done()
+
+	s.run(ctx)
+}
+
+func (s *Sender) run(ctx context.Context) {
+	for {
+		wait := s.sendDue(ctx)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// sendDue send deliveries whose time come in order of each url,
+// return the time until the next one
+func (s *Sender) sendDue(ctx context.Context) time.Duration {
+	s.lock.Lock()
+	queue := append([]*delivery{}, s.queue...)
+	s.lock.Unlock()
+
+	wait := time.Hour
+	blocked := make(map[string]bool)
+	for _, d := range queue {
+		if ctx.Err() != nil {
+			return 0
+		}
+		// keep the order of one receiver
+		if blocked[d.URL] {
+			continue
+		}
+		if until := time.Until(d.Next); until > 0 {
+			blocked[d.URL] = true
+			if until < wait {
+				wait = until
+			}
+			continue
+		}
+
+		err := s.send(ctx, d)
+		if err != nil && ctx.Err() != nil {
+			// send again on next start
+			return 0
+		}
+
+		s.lock.Lock()
+		if err == nil {
+			s.remove(d)
+		} else {
+			d.Attempts++
+			zap.L().Warn("Webhook",
+				zap.String("Url", d.URL),
+				zap.String("Event", d.Event),
+				zap.Int("Attempts", d.Attempts),
+				zap.String("Err", err.Error()),
+			)
+			if d.Attempts >= s.maxAttempts {
+				zap.L().Error("Webhook Dropped",
+					zap.String("Url", d.URL),
+					zap.String("Event", d.Event),
+				)
+				s.remove(d)
+			} else {
+				d.Next = time.Now().Add(s.backoff(d.Attempts))
+				s.save(d)
+				blocked[d.URL] = true
+				if until := time.Until(d.Next); until < wait {
+					wait = until
+				}
+			}
+		}
+		s.lock.Unlock()
+	}
+
+	return wait
+}
+
+// backoff double the delay after each failure
+func (s *Sender) backoff(attempts int) time.Duration {
+	delay := s.minBackoff
+	for i := 1; i < attempts && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	return delay
+}
+
+func (s *Sender) send(ctx context.Context, d *delivery) error {
+	request, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "dd-recorder")
+	request.Header.Set(HeaderEvent, d.Event)
+	request.Header.Set(HeaderDelivery, d.ID)
+	if secret := s.secret(d.URL); secret != "" {
+		request.Header.Set(HeaderSignature, Sign(secret, d.Body))
+	}
+
+	response, err := s.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Http Error - %s - %s", d.URL, response.Status)
+	}
+	return nil
+}
+
+// secret return the secret of url, deliveries left by an old config use the current one
+func (s *Sender) secret(url string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, hook := range s.hooks {
+		if hook.URL == url {
+			return hook.Secret
+		}
+	}
+	return ""
+}
+
+// save write the delivery file, lock held
+func (s *Sender) save(d *delivery) {
+	data, err := json.Marshal(d)
+	if err == nil {
+		path := filepath.Join(s.dir, d.ID+".json")
+		if err = ioutil.WriteFile(path+".tmp", data, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+
+	if err != nil {
+		zap.L().Error("Save Webhook Delivery",
+			zap.String("Id", d.ID),
+			zap.String("Err", err.Error()),
+		)
+	}
+}
+
+// remove drop the delivery and its file, lock held
+func (s *Sender) remove(d *delivery) {
+	for i, item := range s.queue {
+		if item == d {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	os.Remove(filepath.Join(s.dir, d.ID+".json"))
+}
+
+// Sign return the signature header value of body, "sha256=" and hex of hmac-sha256
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify check the signature header value of body
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(strings.TrimSpace(signature)))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lintmx/dd-recorder/configs"
+	"github.com/lintmx/dd-recorder/event"
+)
+
+type receiver struct {
+	lock     sync.Mutex
+	fail     int
+	requests []*http.Request
+	bodies   [][]byte
+	got      chan struct{}
+}
+
+func newReceiver(fail int) *receiver {
+	return &receiver{fail: fail, got: make(chan struct{}, 16)}
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	r.got <- struct{}{}
+}
+
+func (r *receiver) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("receive %d of %d deliveries", i, n)
+		}
+	}
+}
+
+// drain wait until the sender queue is empty
+func drain(t *testing.T, s *Sender) {
+	for i := 0; i < 500; i++ {
+		s.lock.Lock()
+		n := len(s.queue)
+		s.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("queue not drained")
+}
+
+func newTestSender(t *testing.T, hooks []configs.WebhookConfig, dir string) *Sender {
+	s, err := New(hooks, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.minBackoff = 10 * time.Millisecond
+	s.maxBackoff = 50 * time.Millisecond
+	return s
+}
+
+func TestSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newReceiver(2)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	s := newTestSender(t, []configs.WebhookConfig{
+		{URL: server.URL, Secret: "secret"},
+	}, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	s.Handle(&event.Event{Type: event.LiveStart, MonitorID: "a", Title: "first"})
+	s.Handle(&event.Event{Type: event.RecordFileOpen, MonitorID: "a"})
+	s.Handle(&event.Event{Type: event.RecordFileClose, MonitorID: "a", File: "a.flv"})
+	r.wait(t, 2)
+	drain(t, s)
+	cancel()
+	<-done
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.requests) != 2 {
+		t.Fatalf("receive %d deliveries, want 2", len(r.requests))
+	}
+	// retried in order
+	for i, want := range []event.Type{event.LiveStart, event.RecordFileClose} {
+		req := r.requests[i]
+		if req.Header.Get(HeaderEvent) != string(want) {
+			t.Errorf("delivery %d event %q, want %q", i, req.Header.Get(HeaderEvent), want)
+		}
+		if !Verify("secret", r.bodies[i], req.Header.Get(HeaderSignature)) {
+			t.Errorf("delivery %d bad signature %q", i, req.Header.Get(HeaderSignature))
+		}
+		e := event.Event{}
+		if err := json.Unmarshal(r.bodies[i], &e); err != nil || e.Type != want {
+			t.Errorf("delivery %d body %s", i, r.bodies[i])
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 0 {
+		t.Errorf("queue left %v", files)
+	}
+}
+
+func TestSenderQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newReceiver(0)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	hooks := []configs.WebhookConfig{
+		{URL: server.URL, Events: []string{string(event.Error)}},
+	}
+
+	// receiver down, deliveries stay on disk
+	s := newTestSender(t, hooks, dir)
+	s.Handle(&event.Event{Type: event.Error, MonitorID: "a", Error: "1"})
+	s.Handle(&event.Event{Type: event.LiveStart, MonitorID: "a"})
+	s.Handle(&event.Event{Type: event.Error, MonitorID: "a", Error: "2"})
+
+	s = newTestSender(t, hooks, dir)
+	if len(s.queue) != 2 {
+		t.Fatalf("load %d deliveries, want 2", len(s.queue))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	r.wait(t, 2)
+	drain(t, s)
+	cancel()
+	<-done
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, want := range []string{"1", "2"} {
+		e := event.Event{}
+		json.Unmarshal(r.bodies[i], &e)
+		if e.Error != want {
+			t.Errorf("delivery %d error %q, want %q", i, e.Error, want)
+		}
+		if r.requests[i].Header.Get(HeaderSignature) != "" {
+			t.Errorf("delivery %d signed without secret", i)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &Sender{minBackoff: time.Second, maxBackoff: 10 * time.Second}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{30, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := s.backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}